@@ -3,10 +3,13 @@ package caddy
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	caddy "github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
@@ -15,6 +18,7 @@ import (
 	"github.com/peterbourgon/diskv"
 	"go.uber.org/zap"
 	"willnorris.com/go/imageproxy"
+	"willnorris.com/go/imageproxy/internal/filecache"
 )
 
 func init() {
@@ -26,6 +30,11 @@ func init() {
 type ImageProxy struct {
 	Cache string `json:"cache,omitempty"`
 
+	StaleWhileRevalidate caddy.Duration `json:"stale_while_revalidate,omitempty"`
+	StaleIfError         caddy.Duration `json:"stale_if_error,omitempty"`
+
+	NegativeCacheDuration caddy.Duration `json:"negative_cache_duration,omitempty"`
+
 	DefaultBaseURL string `json:"default_base_url,omitempty"`
 
 	AllowHosts   []string `json:"allow_hosts,omitempty"`
@@ -33,16 +42,66 @@ type ImageProxy struct {
 	Referrers    []string `json:"referrers,omitempty"`
 	ContentTypes []string `json:"content_types,omitempty"`
 
+	DenyNetworks  []string `json:"deny_networks,omitempty"`
+	AllowNetworks []string `json:"allow_networks,omitempty"`
+
+	// rate limits of the form "rate[/unit][:burst]".  See imageproxy.ParseRateLimit.
+	ClientRateLimit string   `json:"client_rate_limit,omitempty"`
+	KeyRateLimit    string   `json:"key_rate_limit,omitempty"`
+	OriginRateLimit string   `json:"origin_rate_limit,omitempty"`
+	TrustedProxies  []string `json:"trusted_proxies,omitempty"`
+
 	SignatureKeys []string `json:"signature_keys,omitempty"`
 	Verbose       bool     `json:"verbose,omitempty"`
 
+	QueryOptions bool              `json:"query_options,omitempty"`
+	Presets      map[string]string `json:"presets,omitempty"`
+	PresetsOnly  bool              `json:"presets_only,omitempty"`
+
+	IIIFPrefix    string `json:"iiif_prefix,omitempty"`
+	ThumborPrefix string `json:"thumbor_prefix,omitempty"`
+	ImgixPrefix   string `json:"imgix_prefix,omitempty"`
+
+	AdminToken    string `json:"admin_token,omitempty"`
+	PurgeWebhook  string `json:"purge_webhook,omitempty"`
+	SurrogateKeys bool   `json:"surrogate_keys,omitempty"`
+
+	ProgressiveJPEG bool `json:"progressive_jpeg,omitempty"`
+
+	MaxInputBytes      int64 `json:"max_input_bytes,omitempty"`
+	MaxPixels          int   `json:"max_pixels,omitempty"`
+	MaxAnimationPixels int   `json:"max_animation_pixels,omitempty"`
+	MaxOutputWidth     int   `json:"max_output_width,omitempty"`
+	MaxOutputHeight    int   `json:"max_output_height,omitempty"`
+
+	MaxTransformQueue  int            `json:"max_transform_queue,omitempty"`
+	MaxTransformWait   caddy.Duration `json:"max_transform_wait,omitempty"`
+	MaxTransformMemory int64          `json:"max_transform_memory,omitempty"`
+
+	TransformErrorPolicy string `json:"transform_error_policy,omitempty"`
+	TransformErrorImage  string `json:"transform_error_image,omitempty"`
+
+	Fallbacks      []Fallback     `json:"fallbacks,omitempty"`
+	FallbackMaxAge caddy.Duration `json:"fallback_max_age,omitempty"`
+
 	logger *zap.Logger
 	proxy  *imageproxy.Proxy
+	cache  imageproxy.Cache
+}
+
+// Fallback is an image served in place of remote images that could not be
+// fetched.  See imageproxy.Fallback.
+type Fallback struct {
+	Host       string `json:"host,omitempty"`
+	Status     string `json:"status,omitempty"`
+	Image      string `json:"image,omitempty"` // path of image file
+	StatusCode int    `json:"status_code,omitempty"`
 }
 
 // interface guard
 var (
 	_ caddyhttp.MiddlewareHandler = (*ImageProxy)(nil)
+	_ caddy.CleanerUpper          = (*ImageProxy)(nil)
 )
 
 // CaddyModule returns the Caddy module information.
@@ -55,12 +114,43 @@ func (ImageProxy) CaddyModule() caddy.ModuleInfo {
 
 func (p *ImageProxy) Provision(ctx caddy.Context) error {
 	p.logger = ctx.Logger()
-	cache, _ := parseCache(p.Cache)
+	cache, err := parseCache(p.Cache)
+	if err != nil {
+		return fmt.Errorf("parsing cache: %w", err)
+	}
+	p.cache = cache
 	p.proxy = imageproxy.NewProxy(nil, cache)
+	p.proxy.StaleWhileRevalidate = time.Duration(p.StaleWhileRevalidate)
+	p.proxy.StaleIfError = time.Duration(p.StaleIfError)
+	p.proxy.NegativeCacheDuration = time.Duration(p.NegativeCacheDuration)
 	p.proxy.DefaultBaseURL, _ = url.Parse(p.DefaultBaseURL)
 	p.proxy.AllowHosts = p.AllowHosts
 	p.proxy.DenyHosts = p.DenyHosts
 	p.proxy.Referrers = p.Referrers
+	p.proxy.DenyNetworks = p.DenyNetworks
+	p.proxy.AllowNetworks = p.AllowNetworks
+	for _, l := range []struct {
+		s     string
+		limit *imageproxy.RateLimit
+	}{
+		{p.ClientRateLimit, &p.proxy.ClientRateLimit},
+		{p.KeyRateLimit, &p.proxy.KeyRateLimit},
+		{p.OriginRateLimit, &p.proxy.OriginRateLimit},
+	} {
+		if l.s == "" {
+			continue
+		}
+		var err error
+		if *l.limit, err = imageproxy.ParseRateLimit(l.s); err != nil {
+			return err
+		}
+	}
+	p.proxy.TrustedProxies = p.TrustedProxies
+	for _, networks := range [][]string{p.DenyNetworks, p.AllowNetworks, p.TrustedProxies} {
+		if _, err := imageproxy.ParseNetworks(networks); err != nil {
+			return fmt.Errorf("parsing networks: %w", err)
+		}
+	}
 	p.proxy.ContentTypes = p.ContentTypes
 	if len(p.proxy.ContentTypes) == 0 {
 		p.proxy.ContentTypes = []string{"image/*"}
@@ -70,10 +160,58 @@ func (p *ImageProxy) Provision(ctx caddy.Context) error {
 	}
 	p.proxy.Logger = zap.NewStdLog(p.logger)
 	p.proxy.Verbose = p.Verbose
+	p.proxy.QueryOptions = p.QueryOptions
+	p.proxy.Presets = p.Presets
+	p.proxy.PresetsOnly = p.PresetsOnly
+	p.proxy.IIIFPrefix = p.IIIFPrefix
+	p.proxy.ThumborPrefix = p.ThumborPrefix
+	p.proxy.ImgixPrefix = p.ImgixPrefix
+	p.proxy.AdminToken = p.AdminToken
+	p.proxy.PurgeWebhook = p.PurgeWebhook
+	p.proxy.SurrogateKeys = p.SurrogateKeys
+	p.proxy.ProgressiveJPEG = p.ProgressiveJPEG
+	p.proxy.MaxInputBytes = p.MaxInputBytes
+	p.proxy.MaxPixels = p.MaxPixels
+	p.proxy.MaxAnimationPixels = p.MaxAnimationPixels
+	p.proxy.MaxOutputWidth = p.MaxOutputWidth
+	p.proxy.MaxOutputHeight = p.MaxOutputHeight
+	p.proxy.MaxTransformQueue = p.MaxTransformQueue
+	p.proxy.MaxTransformWait = time.Duration(p.MaxTransformWait)
+	p.proxy.MaxTransformMemory = p.MaxTransformMemory
+	p.proxy.TransformErrorPolicy = p.TransformErrorPolicy
+	if p.TransformErrorImage != "" {
+		img, err := os.ReadFile(p.TransformErrorImage)
+		if err != nil {
+			return fmt.Errorf("reading transform error image: %w", err)
+		}
+		p.proxy.TransformErrorImage = img
+	}
+	for _, f := range p.Fallbacks {
+		img, err := os.ReadFile(f.Image)
+		if err != nil {
+			return fmt.Errorf("reading fallback image: %w", err)
+		}
+		p.proxy.Fallbacks = append(p.proxy.Fallbacks, imageproxy.Fallback{
+			Host:       f.Host,
+			Status:     f.Status,
+			Image:      img,
+			StatusCode: f.StatusCode,
+		})
+	}
+	p.proxy.FallbackMaxAge = time.Duration(p.FallbackMaxAge)
 	p.proxy.FollowRedirects = true
 	return nil
 }
 
+// Cleanup releases the resources of the cache, such as the background
+// eviction of a size-bounded disk cache.
+func (p *ImageProxy) Cleanup() error {
+	if c, ok := p.cache.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 func (p *ImageProxy) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
 	p.proxy.ServeHTTP(w, r)
 	return nil
@@ -90,6 +228,33 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 				return nil, h.ArgErr()
 			}
 			p.Cache = h.Val()
+		case "stale_while_revalidate":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			d, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return nil, h.Errf("invalid stale_while_revalidate: %v", err)
+			}
+			p.StaleWhileRevalidate = caddy.Duration(d)
+		case "stale_if_error":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			d, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return nil, h.Errf("invalid stale_if_error: %v", err)
+			}
+			p.StaleIfError = caddy.Duration(d)
+		case "negative_cache_duration":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			d, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return nil, h.Errf("invalid negative_cache_duration: %v", err)
+			}
+			p.NegativeCacheDuration = caddy.Duration(d)
 		case "default_base_url":
 			if !h.NextArg() {
 				return nil, h.ArgErr()
@@ -105,6 +270,36 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 				return nil, h.ArgErr()
 			}
 			p.DenyHosts = append(p.DenyHosts, strings.Split(h.Val(), ",")...)
+		case "deny_networks":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.DenyNetworks = append(p.DenyNetworks, strings.Split(h.Val(), ",")...)
+		case "allow_networks":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.AllowNetworks = append(p.AllowNetworks, strings.Split(h.Val(), ",")...)
+		case "client_rate_limit":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.ClientRateLimit = h.Val()
+		case "key_rate_limit":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.KeyRateLimit = h.Val()
+		case "origin_rate_limit":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.OriginRateLimit = h.Val()
+		case "trusted_proxies":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.TrustedProxies = append(p.TrustedProxies, strings.Split(h.Val(), ",")...)
 		case "referrers":
 			if !h.NextArg() {
 				return nil, h.ArgErr()
@@ -125,6 +320,144 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 				return nil, h.ArgErr()
 			}
 			p.Verbose, _ = strconv.ParseBool(h.Val())
+		case "query_options":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.QueryOptions, _ = strconv.ParseBool(h.Val())
+		case "preset":
+			args := h.RemainingArgs()
+			if len(args) != 2 {
+				return nil, h.ArgErr()
+			}
+			if p.Presets == nil {
+				p.Presets = make(map[string]string)
+			}
+			p.Presets[args[0]] = args[1]
+		case "presets_only":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.PresetsOnly, _ = strconv.ParseBool(h.Val())
+		case "iiif_prefix":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.IIIFPrefix = h.Val()
+		case "thumbor_prefix":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.ThumborPrefix = h.Val()
+		case "imgix_prefix":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.ImgixPrefix = h.Val()
+		case "admin_token":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.AdminToken = h.Val()
+		case "purge_webhook":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.PurgeWebhook = h.Val()
+		case "surrogate_keys":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.SurrogateKeys, _ = strconv.ParseBool(h.Val())
+		case "progressive_jpeg":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.ProgressiveJPEG, _ = strconv.ParseBool(h.Val())
+		case "max_input_bytes":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.MaxInputBytes, _ = strconv.ParseInt(h.Val(), 10, 64)
+		case "max_pixels":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.MaxPixels, _ = strconv.Atoi(h.Val())
+		case "max_animation_pixels":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.MaxAnimationPixels, _ = strconv.Atoi(h.Val())
+		case "max_output_width":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.MaxOutputWidth, _ = strconv.Atoi(h.Val())
+		case "max_output_height":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.MaxOutputHeight, _ = strconv.Atoi(h.Val())
+		case "max_transform_queue":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.MaxTransformQueue, _ = strconv.Atoi(h.Val())
+		case "max_transform_wait":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			d, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return nil, h.Errf("invalid max_transform_wait: %v", err)
+			}
+			p.MaxTransformWait = caddy.Duration(d)
+		case "max_transform_memory":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.MaxTransformMemory, _ = strconv.ParseInt(h.Val(), 10, 64)
+		case "transform_error_policy":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.TransformErrorPolicy = h.Val()
+		case "transform_error_image":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			p.TransformErrorImage = h.Val()
+		case "fallback":
+			// fallback [host/]status file [code]
+			args := h.RemainingArgs()
+			if len(args) != 2 && len(args) != 3 {
+				return nil, h.ArgErr()
+			}
+			var f Fallback
+			if host, status, ok := strings.Cut(args[0], "/"); ok {
+				f.Host, f.Status = host, status
+			} else {
+				f.Status = args[0]
+			}
+			f.Image = args[1]
+			if len(args) == 3 {
+				code, err := strconv.Atoi(args[2])
+				if err != nil {
+					return nil, h.Errf("invalid fallback status code: %v", args[2])
+				}
+				f.StatusCode = code
+			}
+			p.Fallbacks = append(p.Fallbacks, f)
+		case "fallback_max_age":
+			if !h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			d, err := caddy.ParseDuration(h.Val())
+			if err != nil {
+				return nil, h.Errf("invalid fallback_max_age: %v", err)
+			}
+			p.FallbackMaxAge = caddy.Duration(d)
 		}
 	}
 	return p, nil
@@ -149,6 +482,13 @@ func parseCache(c string) (imageproxy.Cache, error) {
 
 	switch u.Scheme {
 	case "file":
+		if maxSize := u.Query().Get("maxSize"); maxSize != "" {
+			size, err := filecache.ParseSize(maxSize)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing cache maxSize: %w", err)
+			}
+			return filecache.New(u.Path, size), nil
+		}
 		return diskCache(u.Path), nil
 	default:
 		return diskCache(c), nil
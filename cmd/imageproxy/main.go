@@ -5,8 +5,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -24,6 +27,7 @@ import (
 	rediscache "github.com/gregjones/httpcache/redis"
 	"github.com/peterbourgon/diskv"
 	"willnorris.com/go/imageproxy"
+	"willnorris.com/go/imageproxy/internal/filecache"
 	"willnorris.com/go/imageproxy/internal/gcscache"
 	"willnorris.com/go/imageproxy/internal/s3cache"
 	"willnorris.com/go/imageproxy/third_party/envy"
@@ -34,6 +38,10 @@ const defaultMemorySize = 100
 var addr = flag.String("addr", "localhost:8080", "address to listen on, either a TCP address or a Unix domain socket path prefixed with unix:")
 var allowHosts = flag.String("allowHosts", "", "comma separated list of allowed remote hosts")
 var denyHosts = flag.String("denyHosts", "", "comma separated list of denied remote hosts")
+var denyNetworks = flag.String("denyNetworks", "", "comma separated list of IP networks that remote images cannot be fetched from (default private, loopback, and link-local networks)")
+var allowNetworks = flag.String("allowNetworks", "", "comma separated list of IP networks that remote images can be fetched from, overriding denyNetworks")
+var clientRateLimit, keyRateLimit, originRateLimit imageproxy.RateLimit
+var trustedProxies = flag.String("trustedProxies", "", "comma separated list of IP networks of reverse proxies whose X-Forwarded-For header is trusted")
 var referrers = flag.String("referrers", "", "comma separated list of allowed referring hosts")
 var includeReferer = flag.Bool("includeReferer", false, "include referer header in remote requests")
 var followRedirects = flag.Bool("followRedirects", true, "follow redirects")
@@ -43,23 +51,60 @@ var passResponseHeaders = flag.String("passResponseHeaders", "Cache-Control,Last
 var cache tieredCache
 var signatureKeys signatureKeyList
 var scaleUp = flag.Bool("scaleUp", false, "allow images to scale beyond their original dimensions")
+var progressiveJPEG = flag.Bool("progressiveJPEG", false, "encode transformed JPEG images as progressive JPEGs")
+var maxInputBytes = flag.Int64("maxInputBytes", 0, "maximum size in bytes of remote images to transform (0 for no limit)")
+var maxPixels = flag.Int("maxPixels", 100_000_000, "maximum number of pixels in images, or each frame of animated images, to transform")
+var maxAnimationPixels = flag.Int("maxAnimationPixels", 100_000_000, "maximum total number of pixels in all frames of animated images to transform")
+var maxOutputWidth = flag.Int("maxOutputWidth", 0, "maximum width of transformed images (0 for no limit)")
+var maxOutputHeight = flag.Int("maxOutputHeight", 0, "maximum height of transformed images (0 for no limit)")
+var maxTransformQueue = flag.Int("maxTransformQueue", 0, "maximum number of requests waiting for images to be transformed (0 for no limit)")
+var maxTransformWait = flag.Duration("maxTransformWait", 0, "maximum time requests wait for images to be transformed (0 for no limit)")
+var maxTransformMemory = flag.Int64("maxTransformMemory", 0, "maximum bytes of decoded images being transformed at once (0 for no limit)")
+var transformErrors = flag.String("transformErrors", "original", "how to handle images that cannot be transformed: original, error, or fallback")
+var transformErrorImage = flag.String("transformErrorImage", "", "path of image to serve for images that cannot be transformed when transformErrors is fallback")
+var fallbacks fallbackList
+var fallbackMaxAge = flag.Duration("fallbackMaxAge", time.Minute, "duration that clients may cache fallback images")
 var timeout = flag.Duration("timeout", 0, "time limit for requests served by this proxy")
 var verbose = flag.Bool("verbose", false, "print verbose logging messages")
 var _ = flag.Bool("version", false, "Deprecated: this flag does nothing")
 var contentTypes = flag.String("contentTypes", "image/*", "comma separated list of allowed content types")
 var userAgent = flag.String("userAgent", "willnorris/imageproxy", "specify the user-agent used by imageproxy when fetching images from origin website")
 var minCacheDuration = flag.Duration("minCacheDuration", 0, "minimum duration to cache remote images")
+var staleWhileRevalidate = flag.Duration("staleWhileRevalidate", 0, "minimum duration to serve stale cached images while revalidating them in the background")
+var staleIfError = flag.Duration("staleIfError", 0, "minimum duration to serve stale cached images when remote servers return errors")
+var negativeCacheDuration = flag.Duration("negativeCacheDuration", 0, "duration to cache remote 404, 410, and 5xx responses and transformation failures (0 to not cache failures)")
 var forceCache = flag.Bool("forceCache", false, "Ignore no-store and private directives in responses")
+var queryOptions = flag.Bool("queryOptions", false, "allow transformation options to be specified using reserved query parameters")
+var presets = presetMap{}
+var presetsOnly = flag.Bool("presetsOnly", false, "only allow transformation options to be specified using presets")
+var iiifPrefix = flag.String("iiifPrefix", "", "path prefix at which to serve an IIIF Image API endpoint, such as /iiif")
+var thumborPrefix = flag.String("thumborPrefix", "", "path prefix at which to serve requests using Thumbor URL syntax, such as /thumbor")
+var adminToken = flag.String("adminToken", "", "bearer token that authenticates admin requests, such as purging cached images (admin endpoints are disabled if empty)")
+var purgeWebhook = flag.String("purgeWebhook", "", "URL to forward purges made using the admin endpoint to, such as to purge a CDN")
+var surrogateKeys = flag.Bool("surrogateKeys", false, "include Surrogate-Key and Cache-Tag headers in responses for purging CDNs")
+var imgixPrefix = flag.String("imgixPrefix", "", "path prefix at which to serve requests using imgix URL syntax, such as /imgix")
 
 func init() {
 	flag.Var(&cache, "cache", "location to cache images (see https://github.com/willnorris/imageproxy#cache)")
 	flag.Var(&signatureKeys, "signatureKey", "HMAC key used in calculating request signatures")
+	flag.Var(presets, "preset", "named preset of the form name=options, such as thumb=300x200,sc (may be repeated)")
+	flag.Func("clientRateLimit", "rate limit of requests from each client IP, such as 10/s or 600/m:100", rateLimitFlag(&clientRateLimit))
+	flag.Func("keyRateLimit", "rate limit of requests signed with each signature key, such as 100/s", rateLimitFlag(&keyRateLimit))
+	flag.Func("originRateLimit", "rate limit of requests for images on each remote host, such as 50/s", rateLimitFlag(&originRateLimit))
+	flag.Var(&fallbacks, "fallback", "fallback image for remote errors of the form [host/]status=file[,code], such as 4xx=missing.png (may be repeated)")
 }
 
 func main() {
 	envy.Parse("IMAGEPROXY")
 	flag.Parse()
 
+	if flag.Arg(0) == "purge" {
+		if err := purge(*addr, *adminToken, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	p := imageproxy.NewProxy(nil, cache.Cache)
 	if *allowHosts != "" {
 		p.AllowHosts = strings.Split(*allowHosts, ",")
@@ -67,6 +112,23 @@ func main() {
 	if *denyHosts != "" {
 		p.DenyHosts = strings.Split(*denyHosts, ",")
 	}
+	if *denyNetworks != "" {
+		p.DenyNetworks = strings.Split(*denyNetworks, ",")
+	}
+	if *allowNetworks != "" {
+		p.AllowNetworks = strings.Split(*allowNetworks, ",")
+	}
+	p.ClientRateLimit = clientRateLimit
+	p.KeyRateLimit = keyRateLimit
+	p.OriginRateLimit = originRateLimit
+	if *trustedProxies != "" {
+		p.TrustedProxies = strings.Split(*trustedProxies, ",")
+	}
+	for _, networks := range [][]string{p.DenyNetworks, p.AllowNetworks, p.TrustedProxies} {
+		if _, err := imageproxy.ParseNetworks(networks); err != nil {
+			log.Fatalf("error parsing networks: %v", err)
+		}
+	}
 	if *referrers != "" {
 		p.Referrers = strings.Split(*referrers, ",")
 	}
@@ -95,10 +157,41 @@ func main() {
 	p.FollowRedirects = *followRedirects
 	p.Timeout = *timeout
 	p.ScaleUp = *scaleUp
+	p.ProgressiveJPEG = *progressiveJPEG
+	p.MaxInputBytes = *maxInputBytes
+	p.MaxPixels = *maxPixels
+	p.MaxAnimationPixels = *maxAnimationPixels
+	p.MaxOutputWidth = *maxOutputWidth
+	p.MaxOutputHeight = *maxOutputHeight
+	p.Fallbacks = fallbacks
+	p.FallbackMaxAge = *fallbackMaxAge
+	p.MaxTransformQueue = *maxTransformQueue
+	p.MaxTransformWait = *maxTransformWait
+	p.MaxTransformMemory = *maxTransformMemory
+	p.TransformErrorPolicy = *transformErrors
+	if *transformErrorImage != "" {
+		var err error
+		p.TransformErrorImage, err = os.ReadFile(*transformErrorImage)
+		if err != nil {
+			log.Fatalf("error reading transformErrorImage: %v", err)
+		}
+	}
 	p.Verbose = *verbose
 	p.UserAgent = *userAgent
 	p.MinimumCacheDuration = *minCacheDuration
+	p.StaleWhileRevalidate = *staleWhileRevalidate
+	p.StaleIfError = *staleIfError
+	p.NegativeCacheDuration = *negativeCacheDuration
 	p.ForceCache = *forceCache
+	p.QueryOptions = *queryOptions
+	p.Presets = presets
+	p.PresetsOnly = *presetsOnly
+	p.IIIFPrefix = *iiifPrefix
+	p.ThumborPrefix = *thumborPrefix
+	p.ImgixPrefix = *imgixPrefix
+	p.AdminToken = *adminToken
+	p.PurgeWebhook = *purgeWebhook
+	p.SurrogateKeys = *surrogateKeys
 
 	var ln net.Listener
 	var err error
@@ -125,6 +218,48 @@ func main() {
 	log.Fatal(server.Serve(ln))
 }
 
+// purge asks the imageproxy server listening on addr to purge each of the
+// remote URLs in args from its cache, authenticating with token.
+func purge(addr, token string, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: imageproxy [flags] purge <url>...")
+	}
+
+	client := new(http.Client)
+	host := addr
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		host = "localhost"
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, "unix", path)
+			},
+		}
+	} else if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+
+	for _, u := range args {
+		req, err := http.NewRequest("POST", "http://"+host+imageproxy.PurgePath, strings.NewReader(url.Values{"url": {u}}.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("error purging %s: %w", u, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("error purging %s: %s: %s", u, resp.Status, strings.TrimSpace(string(body)))
+		}
+		fmt.Print(string(body))
+	}
+	return nil
+}
+
 type signatureKeyList [][]byte
 
 func (skl *signatureKeyList) String() string {
@@ -147,6 +282,68 @@ func (skl *signatureKeyList) Set(value string) error {
 	return nil
 }
 
+// presetMap allows specifying named presets via flags.  Multiple presets may
+// be separated by whitespace.
+type presetMap map[string]string
+
+func (pm presetMap) String() string {
+	return fmt.Sprint(map[string]string(pm))
+}
+
+func (pm presetMap) Set(value string) error {
+	for _, v := range strings.Fields(value) {
+		name, opts, ok := strings.Cut(v, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid preset %q, must be of the form name=options", v)
+		}
+		pm[name] = opts
+	}
+	return nil
+}
+
+// rateLimitFlag returns a flag.Func that parses a rate limit into l.
+func rateLimitFlag(l *imageproxy.RateLimit) func(string) error {
+	return func(s string) (err error) {
+		*l, err = imageproxy.ParseRateLimit(s)
+		return err
+	}
+}
+
+// fallbackList allows specifying fallback images via flags.  Multiple
+// fallbacks may be separated by whitespace.
+type fallbackList []imageproxy.Fallback
+
+func (fl *fallbackList) String() string {
+	return fmt.Sprint(len(*fl), " fallbacks")
+}
+
+func (fl *fallbackList) Set(value string) error {
+	for _, v := range strings.Fields(value) {
+		match, file, ok := strings.Cut(v, "=")
+		if !ok || file == "" {
+			return fmt.Errorf("invalid fallback %q, must be of the form [host/]status=file[,code]", v)
+		}
+		var f imageproxy.Fallback
+		if host, status, ok := strings.Cut(match, "/"); ok {
+			f.Host, f.Status = host, status
+		} else {
+			f.Status = match
+		}
+		file, code, hasCode := strings.Cut(file, ",")
+		var err error
+		if hasCode {
+			if f.StatusCode, err = strconv.Atoi(code); err != nil {
+				return fmt.Errorf("invalid fallback status code %q", code)
+			}
+		}
+		if f.Image, err = os.ReadFile(file); err != nil {
+			return fmt.Errorf("error reading fallback image: %w", err)
+		}
+		*fl = append(*fl, f)
+	}
+	return nil
+}
+
 // tieredCache allows specifying multiple caches via flags, which will create
 // tiered caches using the twotier package.
 type tieredCache struct {
@@ -204,6 +401,13 @@ func parseCache(c string) (imageproxy.Cache, error) {
 	case "s3":
 		return s3cache.New(u.String())
 	case "file":
+		if maxSize := u.Query().Get("maxSize"); maxSize != "" {
+			size, err := filecache.ParseSize(maxSize)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing cache maxSize: %w", err)
+			}
+			return filecache.New(u.Path, size), nil
+		}
 		return diskCache(u.Path), nil
 	default:
 		return diskCache(c), nil
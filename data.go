@@ -21,8 +21,11 @@ const (
 	optFlipVertical    = "fv"
 	optFlipHorizontal  = "fh"
 	optFormatJPEG      = "jpeg"
+	optFormatAPNG      = "apng"
 	optFormatPNG       = "png"
 	optFormatTIFF      = "tiff"
+	optFormatWEBP      = "webp"
+	optFormatAuto      = "auto"
 	optRotatePrefix    = "r"
 	optQualityPrefix   = "q"
 	optSignaturePrefix = "s"
@@ -35,6 +38,15 @@ const (
 	optSmartCrop       = "sc"
 	optTrim            = "trim"
 	optValidUntil      = "vu"
+	optPresetPrefix    = "p:"
+	optProgressive     = "progressive"
+	optSubsampling420  = "420"
+	optSubsampling422  = "422"
+	optSubsampling444  = "444"
+	optSubsampling     = "ss"
+	optStatic          = "static"
+	optFramePrefix     = "frame"
+	optMaxFramesPrefix = "frames"
 )
 
 // URLError reports a malformed URL error.
@@ -67,6 +79,13 @@ type Options struct {
 	// Quality of output image
 	Quality int
 
+	// If true, JPEG images are encoded as progressive JPEGs.
+	Progressive bool
+
+	// Chroma subsampling ratio of JPEG images.  Valid values are "420",
+	// "422", and "444".  If empty, "420" is used.
+	Subsampling string
+
 	// HMAC Signature for signed requests.
 	Signature string
 
@@ -74,9 +93,15 @@ type Options struct {
 	// will always be overwritten by the value of Proxy.ScaleUp.
 	ScaleUp bool
 
-	// Desired image format. Valid values are "jpeg", "png", "tiff".
+	// Desired image format. Valid values are "apng", "jpeg", "png", "tiff",
+	// "webp".
 	Format string
 
+	// If true, the output format is negotiated by the proxy based on the
+	// image formats accepted by the client, and Format is set to the
+	// result.  Images with transparency are never encoded as JPEG.
+	AutoFormat bool
+
 	// Crop rectangle params
 	CropX      float64
 	CropY      float64
@@ -89,8 +114,77 @@ type Options struct {
 	// If true, automatically trim pixels of the same color around the edges
 	Trim bool
 
+	// If true, animated images are reduced to the single frame at index
+	// Frame, counting from zero.
+	Static bool
+	Frame  int
+
+	// If non-zero, animated images are limited to their first MaxFrames
+	// frames.
+	MaxFrames int
+
 	// If non-zero, the URL is valid until this time.
 	ValidUntil time.Time
+
+	// Options parsed by OptionParser plugins, stored as a sorted, comma
+	// separated list of their canonical string forms.  This is stored as
+	// a string rather than a map so that Options remains comparable.
+	plugins string
+}
+
+// PluginOption returns the value of the option parsed by the OptionParser
+// plugin registered with the provided name, and whether o includes such an
+// option.
+func (o Options) PluginOption(name string) (value any, ok bool) {
+	parser, _ := lookupPlugin(name).(OptionParser)
+	if parser == nil || o.plugins == "" {
+		return nil, false
+	}
+	for _, opt := range strings.Split(o.plugins, ",") {
+		if v, ok := parser.ParseOption(opt); ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// SetPluginOption sets the value of the option for the OptionParser plugin
+// registered with the provided name, replacing any existing value for that
+// plugin.  It panics if no such plugin is registered.
+func (o *Options) SetPluginOption(name string, value any) {
+	parser, _ := lookupPlugin(name).(OptionParser)
+	if parser == nil {
+		panic(fmt.Sprintf("imageproxy: no OptionParser plugin registered with name %q", name))
+	}
+	o.setPluginOption(parser, value)
+}
+
+func (o *Options) setPluginOption(parser OptionParser, value any) {
+	var opts []string
+	if o.plugins != "" {
+		for _, opt := range strings.Split(o.plugins, ",") {
+			if _, ok := parser.ParseOption(opt); !ok {
+				opts = append(opts, opt)
+			}
+		}
+	}
+	opts = append(opts, parser.FormatOption(value))
+	sort.Strings(opts)
+	o.plugins = strings.Join(opts, ",")
+}
+
+// parsePluginOption parses opt using the first of parsers that recognizes
+// it, returning that parser and the parsed value.
+func parsePluginOption(parsers []OptionParser, opt string) (OptionParser, any, bool) {
+	if opt == "" {
+		return nil, nil, false
+	}
+	for _, p := range parsers {
+		if v, ok := p.ParseOption(opt); ok {
+			return p, v, true
+		}
+	}
+	return nil, nil, false
 }
 
 func (o Options) String() string {
@@ -110,6 +204,12 @@ func (o Options) String() string {
 	if o.Quality != 0 {
 		opts = append(opts, fmt.Sprintf("%s%d", optQualityPrefix, o.Quality))
 	}
+	if o.Progressive {
+		opts = append(opts, optProgressive)
+	}
+	if o.Subsampling != "" {
+		opts = append(opts, optSubsampling+o.Subsampling)
+	}
 	if o.Signature != "" {
 		opts = append(opts, fmt.Sprintf("%s%s", optSignaturePrefix, o.Signature))
 	}
@@ -119,6 +219,9 @@ func (o Options) String() string {
 	if o.Format != "" {
 		opts = append(opts, o.Format)
 	}
+	if o.AutoFormat {
+		opts = append(opts, optFormatAuto)
+	}
 	if o.CropX != 0 {
 		opts = append(opts, fmt.Sprintf("%s%v", optCropX, o.CropX))
 	}
@@ -137,9 +240,20 @@ func (o Options) String() string {
 	if o.Trim {
 		opts = append(opts, optTrim)
 	}
+	if o.Static && o.Frame != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optFramePrefix, o.Frame))
+	} else if o.Static {
+		opts = append(opts, optStatic)
+	}
+	if o.MaxFrames != 0 {
+		opts = append(opts, fmt.Sprintf("%s%d", optMaxFramesPrefix, o.MaxFrames))
+	}
 	if !o.ValidUntil.IsZero() {
 		opts = append(opts, fmt.Sprintf("%s%d", optValidUntil, o.ValidUntil.Unix()))
 	}
+	if o.plugins != "" {
+		opts = append(opts, strings.Split(o.plugins, ",")...)
+	}
 
 	sort.Strings(opts)
 
@@ -149,9 +263,17 @@ func (o Options) String() string {
 // transform returns whether o includes transformation options.  Some fields
 // are not transform related at all (like Signature), and others only apply in
 // the presence of other fields (like Fit).  A non-empty Format value is
-// assumed to involve a transformation.
+// assumed to involve a transformation, as are any options parsed by
+// OptionParser plugins.
 func (o Options) transform() bool {
-	return o.Width != 0 || o.Height != 0 || o.Rotate != 0 || o.FlipHorizontal || o.FlipVertical || o.Quality != 0 || o.Format != "" || o.CropX != 0 || o.CropY != 0 || o.CropWidth != 0 || o.CropHeight != 0 || o.Trim
+	return o.Width != 0 || o.Height != 0 || o.Rotate != 0 || o.FlipHorizontal || o.FlipVertical || o.Quality != 0 || o.Progressive || o.Subsampling != "" || o.Format != "" || o.CropX != 0 || o.CropY != 0 || o.CropWidth != 0 || o.CropHeight != 0 || o.Trim || o.Static || o.MaxFrames != 0 || o.plugins != ""
+}
+
+// transformsPixels returns whether o changes the pixels of images, rather
+// than only how they are encoded or which frames are kept.  Options parsed
+// by plugins are assumed to change pixels.
+func (o Options) transformsPixels() bool {
+	return o.Width != 0 || o.Height != 0 || o.Rotate != 0 || o.FlipHorizontal || o.FlipVertical || o.CropX != 0 || o.CropY != 0 || o.CropWidth != 0 || o.CropHeight != 0 || o.Trim || o.plugins != ""
 }
 
 // ParseOptions parses str as a list of comma separated transformation options.
@@ -224,10 +346,40 @@ func (o Options) transform() bool {
 // The "q{qualityPercentage}" option can be used to specify the quality of the
 // output file (JPEG only). If not specified, the default value of "95" is used.
 //
+// # Progressive JPEG
+//
+// The "progressive" option encodes JPEG images as progressive JPEGs, which
+// browsers can display at increasing levels of detail while they download,
+// rather than from top to bottom.  Proxy.ProgressiveJPEG enables this for all
+// transformed JPEG images.
+//
+// The "ss{ratio}" option sets the chroma subsampling ratio of JPEG images to
+// one of "ss420" (the default), "ss422", or "ss444".  Less subsampling
+// preserves more color detail at the cost of larger files.
+//
 // # Format
 //
-// The "jpeg", "png", and "tiff" options can be used to specify the desired
-// image format of the proxied image.
+// The "jpeg", "png", "tiff", "webp", and "apng" options can be used to
+// specify the desired image format of the proxied image.  WebP images are
+// encoded losslessly, so the quality option does not apply to them.
+// Animated GIFs converted to "apng" or "webp" remain animated, with the full
+// color depth of resized frames preserved.
+//
+// The "auto" option instead negotiates the image format based on the Accept
+// header of the request, choosing the most preferred format that the client
+// accepts.  WebP is preferred for clients that accept it, except for opaque
+// images in lossy formats such as JPEG, which remain JPEG since WebP images
+// are encoded losslessly.  Otherwise opaque images are encoded as JPEG, and
+// images with transparency as PNG.  Animated GIFs are left as GIFs.  The
+// quality option only applies to images encoded as JPEG.
+//
+// # Animation
+//
+// The "frame{n}" option reduces an animated GIF to the single frame at index
+// n, counting from zero.  If n is past the last frame, the last frame is
+// used.  The "static" option is the same as "frame0".
+//
+// The "frames{n}" option limits an animated GIF to its first n frames.
 //
 // # Signature
 //
@@ -250,6 +402,22 @@ func (o Options) transform() bool {
 // The "vu{unixtime}" option specifies a Unix timestamp at which the request URL is no longer valid.
 // For example, "vu1800000000" would mean the URL is valid until 2027-01-15T08:00:00Z.
 //
+// # Presets
+//
+// The "p:{name}" option expands to the options of the named preset, as
+// configured by Proxy.Presets.  Presets are expanded in place, so options
+// specified after a preset override those of the preset, and options
+// specified before it are overridden.  Presets are expanded by the Proxy
+// before options are parsed, so ParseOptions itself ignores this option.
+// Signatures cover the expanded options.
+//
+// # Plugin Options
+//
+// Additional options may be provided by plugins that implement the
+// OptionParser interface (see RegisterPlugin).  Plugin options are parsed
+// before the built-in options described above, and their values can be
+// retrieved using Options.PluginOption.
+//
 // Examples
 //
 //	0x0         - no resizing
@@ -262,12 +430,23 @@ func (o Options) transform() bool {
 //	100,fv,fh   - 100 pixels square, flipped horizontal and vertical
 //	200x,q60    - 200 pixels wide, proportional height, 60% quality
 //	200x,png    - 200 pixels wide, converted to PNG format
+//	200x,auto   - 200 pixels wide, converted to the best format the client accepts
+//	200x,progressive - 200 pixels wide, encoded as a progressive JPEG
+//	200x,apng   - 200 pixels wide, animated GIFs converted to animated PNG
+//	static,png  - first frame of an animated GIF, converted to PNG format
 //	cw100,ch100 - crop image to 100px square, starting at (0,0)
 //	cx10,cy20,cw100,ch200 - crop image starting at (10,20) is 100px wide and 200px tall
+//	p:thumb     - options of the "thumb" preset
 func ParseOptions(str string) Options {
 	var options Options
+	parsers := pluginsImplementing[OptionParser]()
 
 	for _, opt := range strings.Split(str, ",") {
+		if parser, v, ok := parsePluginOption(parsers, opt); ok {
+			options.setPluginOption(parser, v)
+			continue
+		}
+
 		switch {
 		case len(opt) == 0: // do nothing
 		case opt == optFit:
@@ -278,12 +457,32 @@ func ParseOptions(str string) Options {
 			options.FlipHorizontal = true
 		case opt == optScaleUp: // this option is intentionally not documented above
 			options.ScaleUp = true
-		case opt == optFormatJPEG, opt == optFormatPNG, opt == optFormatTIFF:
+		case opt == optFormatJPEG, opt == optFormatPNG, opt == optFormatTIFF, opt == optFormatWEBP, opt == optFormatAPNG:
 			options.Format = opt
+		case opt == optFormatAuto:
+			options.AutoFormat = true
+		case opt == optProgressive:
+			options.Progressive = true
+		case opt == optSubsampling+optSubsampling420, opt == optSubsampling+optSubsampling422, opt == optSubsampling+optSubsampling444:
+			options.Subsampling = strings.TrimPrefix(opt, optSubsampling)
 		case opt == optSmartCrop:
 			options.SmartCrop = true
 		case opt == optTrim:
 			options.Trim = true
+		case opt == optStatic:
+			options.Static = true
+			options.Frame = 0
+		case strings.HasPrefix(opt, optMaxFramesPrefix):
+			value := strings.TrimPrefix(opt, optMaxFramesPrefix)
+			if v, err := strconv.Atoi(value); err == nil && v > 0 {
+				options.MaxFrames = v
+			}
+		case strings.HasPrefix(opt, optFramePrefix):
+			value := strings.TrimPrefix(opt, optFramePrefix)
+			if v, err := strconv.Atoi(value); err == nil && v >= 0 {
+				options.Static = true
+				options.Frame = v
+			}
 		case strings.HasPrefix(opt, optRotatePrefix):
 			value := strings.TrimPrefix(opt, optRotatePrefix)
 			options.Rotate, _ = strconv.Atoi(value)
@@ -374,15 +573,44 @@ func (r Request) String() string {
 //	http://localhost/http://example.com/image.jpg
 //	http://localhost/x/http%3A%2F%2Fexample.com%2Fimage.jpg
 //	http://localhost/100x200/aHR0cDovL2V4YW1wbGUuY29tL2ltYWdlLmpwZw
+//
+// When Proxy.QueryOptions is enabled, options may also be specified using
+// reserved query parameters, which are removed from the remote URL:
+//
+//	http://localhost/http://example.com/image.jpg?w=100&h=200&fit=1
 func NewRequest(r *http.Request, baseURL *url.URL) (*Request, error) {
+	p := &Proxy{DefaultBaseURL: baseURL}
+	return p.newRequest(r)
+}
+
+// newRequest parses an http.Request into an imageproxy Request, as described
+// by NewRequest.  p.DefaultBaseURL is used to resolve relative remote URLs.
+// If p.QueryOptions is true, options are also read from reserved query
+// parameters (see parseQueryOptions), which take precedence over options in
+// the request path.  Any presets are then expanded using p.Presets.
+//
+// Requests under p.ThumborPrefix or p.ImgixPrefix are instead parsed as
+// Thumbor or imgix URLs (see newThumborRequest and newImgixRequest).
+func (p *Proxy) newRequest(r *http.Request) (*Request, error) {
+	if path, ok := cutPathPrefix(r, p.ThumborPrefix); ok {
+		return p.newThumborRequest(r, path)
+	}
+	if path, ok := cutPathPrefix(r, p.ImgixPrefix); ok {
+		return p.newImgixRequest(r, path)
+	}
+
 	var err error
 	req := &Request{Original: r}
 	var enc bool // whether the remote URL was base64 or URL encoded
+	var opts string
 
+	baseURL := p.DefaultBaseURL
 	path := r.URL.EscapedPath()[1:] // strip leading slash
 	req.URL, enc, err = parseURL(path, baseURL)
-	if err != nil || !req.URL.IsAbs() {
-		// first segment should be options
+	if err != nil || !req.URL.IsAbs() || !isHTTP(req.URL) {
+		// first segment should be options.  Options that contain a
+		// colon such as presets can look like a URL scheme, so only
+		// treat the full path as the remote URL if it's http(s).
 		parts := strings.SplitN(path, "/", 2)
 		if len(parts) != 2 {
 			return nil, URLError{"too few path segments", r.URL}
@@ -394,7 +622,7 @@ func NewRequest(r *http.Request, baseURL *url.URL) (*Request, error) {
 			return nil, URLError{fmt.Sprintf("unable to parse remote URL: %v", err), r.URL}
 		}
 
-		req.Options = ParseOptions(parts[0])
+		opts = parts[0]
 	}
 
 	if baseURL != nil {
@@ -405,18 +633,174 @@ func NewRequest(r *http.Request, baseURL *url.URL) (*Request, error) {
 		return nil, URLError{"must provide absolute remote URL", r.URL}
 	}
 
-	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+	if !isHTTP(req.URL) {
 		return nil, URLError{"remote URL must have http or https scheme", r.URL}
 	}
 
+	query := r.URL.RawQuery
+	if p.QueryOptions {
+		var queryOpts string
+		queryOpts, query = parseQueryOptions(query)
+		opts += "," + queryOpts
+	}
+	if opts, err = expandPresets(opts, p.Presets, p.PresetsOnly); err != nil {
+		return nil, URLError{err.Error(), r.URL}
+	}
+	req.Options = ParseOptions(opts)
+
 	if !enc {
 		// if the remote URL was not base64 or URL encoded,
 		// then the query string is part of the remote URL
-		req.URL.RawQuery = r.URL.RawQuery
+		req.URL.RawQuery = query
 	}
 	return req, nil
 }
 
+// expandPresets replaces each "p:{name}" option in opts with the options of
+// the named preset in presets, returning the expanded options string.  An
+// error is returned if opts refers to an unknown preset.  If presetsOnly is
+// true, an error is also returned if opts includes any options other than
+// presets, signatures, and valid until times.
+func expandPresets(opts string, presets map[string]string, presetsOnly bool) (string, error) {
+	var expanded []string
+	for _, opt := range strings.Split(opts, ",") {
+		if name, ok := strings.CutPrefix(opt, optPresetPrefix); ok {
+			preset, ok := presets[name]
+			if !ok {
+				return "", fmt.Errorf("unknown preset %q", name)
+			}
+			expanded = append(expanded, preset)
+			continue
+		}
+
+		if presetsOnly && opt != "" {
+			if o := ParseOptions(opt); o.Signature == "" && o.ValidUntil.IsZero() {
+				return "", fmt.Errorf("option %q not allowed, only presets may be used", opt)
+			}
+		}
+		expanded = append(expanded, opt)
+	}
+	return strings.Join(expanded, ","), nil
+}
+
+// presetOptions returns an error if p.PresetsOnly is true and opt are not
+// the options of one of p.Presets.  It is used for requests whose options
+// are not specified as an options string, such as IIIF, Thumbor, and imgix
+// requests, which may only request the same transformations as a preset.
+// Requests without any options are unaffected.
+func (p *Proxy) presetOptions(opt Options) error {
+	if !p.PresetsOnly {
+		return nil
+	}
+	opt = opt.unsigned()
+	if opt == (Options{}) {
+		return nil
+	}
+	for _, preset := range p.Presets {
+		if ParseOptions(preset) == opt {
+			return nil
+		}
+	}
+	return fmt.Errorf("options %q not allowed, only presets may be used", opt)
+}
+
+// unsigned returns a copy of o without its signature and expiration time,
+// which identifies the transformation however the request was signed.
+func (o Options) unsigned() Options {
+	o.Signature, o.ValidUntil = "", time.Time{}
+	return o
+}
+
+// queryOptionFlags maps reserved query parameters to the boolean options
+// they enable.
+var queryOptionFlags = map[string]string{
+	"fit":  optFit,
+	"fv":   optFlipVertical,
+	"fh":   optFlipHorizontal,
+	"sc":   optSmartCrop,
+	"trim": optTrim,
+}
+
+// queryOptionPrefixes maps reserved query parameters to the prefix of the
+// option their value is used with.
+var queryOptionPrefixes = map[string]string{
+	"q":   optQualityPrefix,
+	"r":   optRotatePrefix,
+	"sig": optSignaturePrefix,
+	"cx":  optCropX,
+	"cy":  optCropY,
+	"cw":  optCropWidth,
+	"ch":  optCropHeight,
+	"vu":  optValidUntil,
+	"p":   optPresetPrefix,
+}
+
+// parseQueryOptions extracts transformation options from the reserved query
+// parameters in rawQuery, returning them as an options string suitable for
+// ParseOptions, along with the remaining query string.  The remaining query
+// string preserves the order and encoding of the original.
+//
+// The reserved query parameters are:
+//
+//	w, h                  - width and height
+//	fit, fv, fh, sc, trim - boolean options, enabled if the value is empty or true
+//	q, r, cx, cy, cw, ch  - quality, rotation, and crop options
+//	vu                    - valid until
+//	p                     - preset name
+//	sig                   - signature
+//	format                - output format
+//	opt                   - an options string, as accepted by ParseOptions
+func parseQueryOptions(rawQuery string) (opts string, remaining string) {
+	var w, h string
+	var o, rest []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		k, v, _ := strings.Cut(param, "=")
+		key, err := url.QueryUnescape(k)
+		if err != nil {
+			rest = append(rest, param)
+			continue
+		}
+		value, err := url.QueryUnescape(v)
+		if err != nil {
+			rest = append(rest, param)
+			continue
+		}
+
+		if opt, ok := queryOptionFlags[key]; ok {
+			if b, err := strconv.ParseBool(value); value == "" || (err == nil && b) {
+				o = append(o, opt)
+			}
+			continue
+		}
+		if prefix, ok := queryOptionPrefixes[key]; ok {
+			o = append(o, prefix+value)
+			continue
+		}
+
+		switch key {
+		case "w":
+			w = value
+		case "h":
+			h = value
+		case "format", "opt":
+			o = append(o, value)
+		default:
+			if param != "" {
+				rest = append(rest, param)
+			}
+		}
+	}
+	if w != "" || h != "" {
+		o = append(o, w+optSizeDelimiter+h)
+	}
+	return strings.Join(o, ","), strings.Join(rest, "&")
+}
+
+// isHTTP returns whether u has an http or https scheme.
+func isHTTP(u *url.URL) bool {
+	return u.Scheme == "http" || u.Scheme == "https"
+}
+
 var reCleanedURL = regexp.MustCompile(`^(https?):/+([^/])`)
 var reIsEncodedURL = regexp.MustCompile(`^(?i)https?%3A%2F`)
 
@@ -37,6 +37,26 @@ func TestOptions_String(t *testing.T) {
 			Options{ScaleUp: true, CropX: 100, CropY: 200, CropWidth: 300, CropHeight: 400, SmartCrop: true},
 			"0x0,ch400,cw300,cx100,cy200,sc,scaleUp",
 		},
+		{
+			Options{Width: 100, AutoFormat: true, Format: "png"},
+			"100x0,auto,png",
+		},
+		{
+			Options{Width: 100, Progressive: true, Subsampling: "444"},
+			"100x0,progressive,ss444",
+		},
+		{
+			Options{Width: 100, Static: true, Format: "png"},
+			"100x0,png,static",
+		},
+		{
+			Options{Static: true, Frame: 3},
+			"0x0,frame3",
+		},
+		{
+			Options{MaxFrames: 10, Format: "apng"},
+			"0x0,apng,frames10",
+		},
 	}
 
 	for i, tt := range tests {
@@ -72,6 +92,21 @@ func TestParseOptions(t *testing.T) {
 		{"fv", Options{FlipVertical: true}},
 		{"fh", Options{FlipHorizontal: true}},
 		{"jpeg", Options{Format: "jpeg"}},
+		{"webp", Options{Format: "webp"}},
+		{"auto", Options{AutoFormat: true}},
+		{"auto,png", Options{AutoFormat: true, Format: "png"}},
+		{"progressive", Options{Progressive: true}},
+		{"ss444", Options{Subsampling: "444"}},
+		{"ss422", Options{Subsampling: "422"}},
+		{"ss420", Options{Subsampling: "420"}},
+		{"ss411", Options{Signature: "s411"}},
+		{"apng", Options{Format: "apng"}},
+		{"static", Options{Static: true}},
+		{"frame0", Options{Static: true}},
+		{"frame3", Options{Static: true, Frame: 3}},
+		{"frame-1", emptyOptions},
+		{"frames10", Options{MaxFrames: 10}},
+		{"frames0", emptyOptions},
 
 		// duplicate flags (last one wins)
 		{"1x2,3x4", Options{Width: 3, Height: 4}},
@@ -80,6 +115,7 @@ func TestParseOptions(t *testing.T) {
 		{"1x,x2", Options{Width: 1, Height: 2}},
 		{"r90,r270", Options{Rotate: 270}},
 		{"jpeg,png", Options{Format: "png"}},
+		{"frame3,static", Options{Static: true}},
 
 		// mix of valid and invalid flags
 		{"FOO,1,BAR,r90,BAZ", Options{Width: 1, Height: 1, Rotate: 90}},
@@ -97,6 +133,61 @@ func TestParseOptions(t *testing.T) {
 	}
 }
 
+func TestParseOptions_Plugin(t *testing.T) {
+	registerTestPlugin(t, "blur", testOptionParser{})
+
+	tests := []struct {
+		Input  string
+		Blur   any    // expected value of the blur plugin option
+		String string // expected canonical form of the parsed options
+	}{
+		{"", nil, "0x0"},
+		{"blur", nil, "0x0"},
+		{"blur5", 5, "0x0,blur5"},
+		{"blur005", 5, "0x0,blur5"},
+		{"blur1,blur2", 2, "0x0,blur2"}, // last one wins
+		{"q70,blur3,1x2", 3, "1x2,blur3,q70"},
+	}
+
+	for _, tt := range tests {
+		opt := ParseOptions(tt.Input)
+		if got, _ := opt.PluginOption("blur"); got != tt.Blur {
+			t.Errorf("ParseOptions(%q).PluginOption returned %v, want %v", tt.Input, got, tt.Blur)
+		}
+		if got, want := opt.String(), tt.String; got != want {
+			t.Errorf("ParseOptions(%q).String() returned %q, want %q", tt.Input, got, want)
+		}
+		if got, want := ParseOptions(opt.String()), opt; got != want {
+			t.Errorf("ParseOptions(%q) returned %#v, want %#v", opt.String(), got, want)
+		}
+	}
+}
+
+func TestOptions_SetPluginOption(t *testing.T) {
+	registerTestPlugin(t, "blur", testOptionParser{})
+
+	var opt Options
+	if _, ok := opt.PluginOption("blur"); ok {
+		t.Errorf("PluginOption on empty options returned ok")
+	}
+
+	opt.SetPluginOption("blur", 4)
+	opt.SetPluginOption("blur", 7)
+	if got, want := opt.String(), "0x0,blur7"; got != want {
+		t.Errorf("String() returned %q, want %q", got, want)
+	}
+	if !opt.transform() {
+		t.Errorf("transform() returned false for options with plugin options")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("SetPluginOption for unregistered plugin did not panic")
+		}
+	}()
+	opt.SetPluginOption("unknown", 1)
+}
+
 // Test that request URLs are properly parsed into Options and RemoteURL.  This
 // test verifies that invalid remote URLs throw errors, and that valid
 // combinations of Options and URL are accept.  This does not exhaustively test
@@ -273,3 +364,133 @@ func TestNewRequest_BaseURL(t *testing.T) {
 		}
 	}
 }
+
+func TestNewRequest_QueryOptions(t *testing.T) {
+	p := &Proxy{QueryOptions: true}
+
+	tests := []struct {
+		URL       string  // input URL to parse as an imageproxy request
+		RemoteURL string  // expected URL of remote image parsed from input
+		Options   Options // expected options parsed from input
+	}{
+		{
+			"http://localhost/http://example.com/foo",
+			"http://example.com/foo", emptyOptions,
+		},
+		{
+			"http://localhost/http://example.com/foo?w=300&h=200&fit=1&sig=c0ffee",
+			"http://example.com/foo", Options{Width: 300, Height: 200, Fit: true, Signature: "c0ffee"},
+		},
+		{ // non-reserved params are kept in order, with original encoding
+			"http://localhost/http://example.com/foo?b=2&w=300&a=%2F&fv&fh=false",
+			"http://example.com/foo?b=2&a=%2F", Options{Width: 300, FlipVertical: true},
+		},
+		{ // query options override path options
+			"http://localhost/100x100,q80/http://example.com/foo?h=50&q=60",
+			"http://example.com/foo", Options{Width: 100, Height: 50, Quality: 60},
+		},
+		{
+			"http://localhost/http://example.com/foo?opt=r90,png&format=jpeg&cx=10&vu=1234567890",
+			"http://example.com/foo", Options{Rotate: 90, Format: "jpeg", CropX: 10, ValidUntil: time.Unix(1234567890, 0)},
+		},
+		{ // encoded remote URLs still read options from the query string
+			"http://localhost/aHR0cDovL2V4YW1wbGUuY29tL2Zvbz9h?w=10&b",
+			"http://example.com/foo?a", Options{Width: 10},
+		},
+	}
+
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.URL, nil)
+		if err != nil {
+			t.Errorf("http.NewRequest(%q) returned error: %v", tt.URL, err)
+			continue
+		}
+
+		r, err := p.newRequest(req)
+		if err != nil {
+			t.Errorf("newRequest(%q) returned unexpected error: %v", tt.URL, err)
+			continue
+		}
+
+		if got, want := r.URL.String(), tt.RemoteURL; got != want {
+			t.Errorf("newRequest(%q) request URL = %v, want %v", tt.URL, got, want)
+		}
+		if got, want := r.Options, tt.Options; got != want {
+			t.Errorf("newRequest(%q) request options = %v, want %v", tt.URL, got, want)
+		}
+	}
+}
+
+// Test that signatures on query option requests cover the same canonical form
+// as options in the request path.
+func TestNewRequest_QueryOptions_Signature(t *testing.T) {
+	p := &Proxy{QueryOptions: true, SignatureKeys: [][]byte{[]byte("c0ffee")}}
+
+	for _, u := range []string{
+		"http://localhost/r90,sZGTzEm32o4iZ7qcChls3EVYaWyrDd9u0etySo0-WkF8=/http://test/image",
+		"http://localhost/http://test/image?r=90&sig=ZGTzEm32o4iZ7qcChls3EVYaWyrDd9u0etySo0-WkF8%3D",
+	} {
+		req, _ := http.NewRequest("GET", u, nil)
+		r, err := p.newRequest(req)
+		if err != nil {
+			t.Errorf("newRequest(%q) returned unexpected error: %v", u, err)
+			continue
+		}
+		if err := p.allowed(r); err != nil {
+			t.Errorf("allowed(%q) returned error: %v", u, err)
+		}
+	}
+}
+
+func TestNewRequest_Presets(t *testing.T) {
+	presets := map[string]string{
+		"thumb": "300x200,sc,q80,jpeg",
+		"small": "100x",
+	}
+
+	tests := []struct {
+		URL         string  // input URL to parse as an imageproxy request
+		PresetsOnly bool    // whether only presets are allowed
+		Options     Options // expected options parsed from input
+		ExpectError bool    // whether an error is expected from newRequest
+	}{
+		{"http://localhost/p:thumb/http://example.com/", false, Options{Width: 300, Height: 200, SmartCrop: true, Quality: 80, Format: "jpeg"}, false},
+		{"http://localhost/p:thumb,q50/http://example.com/", false, Options{Width: 300, Height: 200, SmartCrop: true, Quality: 50, Format: "jpeg"}, false},
+		{"http://localhost/q50,p:thumb/http://example.com/", false, Options{Width: 300, Height: 200, SmartCrop: true, Quality: 80, Format: "jpeg"}, false},
+		{"http://localhost/p:small,r90/http://example.com/", false, Options{Width: 100, Rotate: 90}, false},
+		{"http://localhost/http://example.com/?p=small&q=70", false, Options{Width: 100, Quality: 70}, false},
+		{"http://localhost/p:unknown/http://example.com/", false, emptyOptions, true},
+
+		// presets only
+		{"http://localhost/http://example.com/", true, emptyOptions, false},
+		{"http://localhost/p:small/http://example.com/", true, Options{Width: 100}, false},
+		{"http://localhost/p:small,sc0ffee,vu123/http://example.com/", true, Options{Width: 100, Signature: "c0ffee", ValidUntil: time.Unix(123, 0)}, false},
+		{"http://localhost/p:small,r90/http://example.com/", true, emptyOptions, true},
+		{"http://localhost/500x/http://example.com/", true, emptyOptions, true},
+		{"http://localhost/http://example.com/?w=500", true, emptyOptions, true},
+	}
+
+	for _, tt := range tests {
+		p := &Proxy{Presets: presets, PresetsOnly: tt.PresetsOnly, QueryOptions: true}
+		req, err := http.NewRequest("GET", tt.URL, nil)
+		if err != nil {
+			t.Errorf("http.NewRequest(%q) returned error: %v", tt.URL, err)
+			continue
+		}
+
+		r, err := p.newRequest(req)
+		if tt.ExpectError {
+			if err == nil {
+				t.Errorf("newRequest(%q) did not return expected error", tt.URL)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("newRequest(%q) returned unexpected error: %v", tt.URL, err)
+			continue
+		}
+
+		if got, want := r.Options, tt.Options; got != want {
+			t.Errorf("newRequest(%q) request options = %v, want %v", tt.URL, got, want)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultDenyNetworks are the networks that remote images are not fetched
+// from if Proxy.DenyNetworks is empty.  These include private, loopback,
+// link-local (including cloud metadata services), and other special-purpose
+// networks.
+var defaultDenyNetworks = []string{
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // shared address space
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, including cloud metadata services
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, including broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b::/96",   // IPv4/IPv6 translation
+	"100::/64",       // discard-only
+	"fc00::/7",       // unique local, including cloud metadata services
+	"fe80::/10",      // link-local
+	"fec0::/10",      // deprecated site-local
+	"ff00::/8",       // multicast
+}
+
+var errDeniedNetwork = errors.New("remote address is in a denied network")
+
+// maximum number of issuer certificates fetched to complete the certificate
+// chain of a remote server.
+const maxIssuerFetches = 5
+
+// newTransport returns the transport used to fetch remote images when none is
+// provided to NewProxy.  The resolved address of every connection, including
+// connections made after redirects, is checked against p.DenyNetworks and
+// p.AllowNetworks when it is dialed.
+//
+// Like the transport provided by github.com/fcjr/aia-transport-go, missing
+// intermediate certificates of remote servers are fetched using the URLs in
+// their certificates, with the same restrictions on remote addresses.
+//
+// Like http.DefaultTransport, requests are sent through the proxy specified
+// by the environment, if any, in which case the address of the proxy is
+// checked rather than the remote server.
+func (p *Proxy) newTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   p.checkDialAddress,
+	}
+
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	issuerClient := &http.Client{
+		Transport: t.Clone(),
+		Timeout:   10 * time.Second,
+	}
+
+	t.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(ctx, t.TLSHandshakeTimeout)
+		defer cancel()
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: host,
+			// certificates are instead verified by
+			// VerifyPeerCertificate, which fetches missing
+			// intermediate certificates.
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				return verifyCertificates(issuerClient, host, rawCerts)
+			},
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	return t
+}
+
+// checkDialAddress returns an error if the IP address being dialed is in
+// p.DenyNetworks, or the default denied networks if that is empty, and is not
+// in p.AllowNetworks.  If either list is invalid, all addresses are denied.
+// It is used as the Control function of a net.Dialer.
+func (p *Proxy) checkDialAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.WithZone("")
+
+	allow, err := p.allowNetworks.parse(p.AllowNetworks)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errDeniedNetwork, err)
+	}
+	if networksContain(allow, ip) {
+		return nil
+	}
+	denyNetworks := p.DenyNetworks
+	if len(denyNetworks) == 0 {
+		denyNetworks = defaultDenyNetworks
+	}
+	deny, err := p.denyNetworks.parse(denyNetworks)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errDeniedNetwork, err)
+	}
+	if networksContain(deny, ip) {
+		return fmt.Errorf("%w: %v", errDeniedNetwork, ip)
+	}
+	return nil
+}
+
+// ParseNetworks parses networks, which are IP networks in CIDR notation or
+// individual IP addresses, as used by Proxy.DenyNetworks and
+// Proxy.AllowNetworks.  It returns an error if any of them are invalid.
+func ParseNetworks(networks []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(networks))
+	for _, n := range networks {
+		n = strings.TrimSpace(n)
+		var prefix netip.Prefix
+		var err error
+		if strings.Contains(n, "/") {
+			prefix, err = netip.ParsePrefix(n)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(n)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", n)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// networkList caches the result of parsing a list of networks, so that it
+// is only parsed again if the list changes.
+type networkList struct {
+	mu       sync.Mutex
+	parsed   bool
+	networks []string
+	prefixes []netip.Prefix
+	err      error
+}
+
+// parse returns the result of ParseNetworks(networks).
+func (l *networkList) parse(networks []string) ([]netip.Prefix, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.parsed || !slices.Equal(networks, l.networks) {
+		l.parsed = true
+		l.networks = slices.Clone(networks)
+		l.prefixes, l.err = ParseNetworks(networks)
+	}
+	return l.prefixes, l.err
+}
+
+// networksContain returns whether ip is in any of networks.  IPv4-mapped IPv6
+// addresses are also compared as IPv4 addresses.
+func networksContain(networks []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range networks {
+		if prefix.Contains(ip) || prefix.Contains(ip.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyCertificates verifies the certificate chain rawCerts presented by
+// host.  If the chain is incomplete, missing issuer certificates are fetched
+// using client.
+func verifyCertificates(client *http.Client, host string, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no certificates presented by server")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate from server: %w", err)
+		}
+		certs[i] = cert
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	issuer := certs[0]
+	for range maxIssuerFetches {
+		_, err := certs[0].Verify(opts)
+		var uaerr x509.UnknownAuthorityError
+		if err == nil || !errors.As(err, &uaerr) || len(issuer.IssuingCertificateURL) == 0 {
+			return err
+		}
+		issuer, err = fetchCertificate(client, issuer.IssuingCertificateURL[0])
+		if err != nil {
+			return err
+		}
+		opts.Intermediates.AddCert(issuer)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// fetchCertificate fetches the DER encoded certificate at url.
+func fetchCertificate(client *http.Client, url string) (*x509.Certificate, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching issuer certificate %s: %s", url, resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(b)
+}
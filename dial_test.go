@@ -0,0 +1,115 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckDialAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		deny    []string
+		allow   []string
+		wantErr bool
+	}{
+		{"93.184.215.14:80", nil, nil, false},
+		{"[2606:2800:21f:cb07:6820:80da:af6b:8b2c]:443", nil, nil, false},
+		{"127.0.0.1:80", nil, nil, true},
+		{"10.1.2.3:80", nil, nil, true},
+		{"169.254.169.254:80", nil, nil, true},
+		{"[::1]:80", nil, nil, true},
+		{"[::ffff:127.0.0.1]:80", nil, nil, true},
+		{"[fe80::1%eth0]:80", nil, nil, true},
+		{"[fd00:ec2::254]:80", nil, nil, true},
+
+		// custom deny list replaces the defaults
+		{"127.0.0.1:80", []string{"10.0.0.0/8"}, nil, false},
+		{"10.1.2.3:80", []string{"10.0.0.0/8"}, nil, true},
+		{"93.184.215.14:80", []string{"93.184.215.14"}, nil, true},
+
+		// allowed networks override denied networks
+		{"10.1.2.3:80", nil, []string{"10.1.2.0/24"}, false},
+		{"10.1.3.3:80", nil, []string{"10.1.2.0/24"}, true},
+		{"127.0.0.1:80", nil, []string{"127.0.0.1"}, false},
+		{"[::ffff:127.0.0.1]:80", nil, []string{"127.0.0.1"}, false},
+		{"10.1.2.3:80", nil, []string{"invalid"}, true},
+	}
+
+	for _, tt := range tests {
+		p := &Proxy{DenyNetworks: tt.deny, AllowNetworks: tt.allow}
+		err := p.checkDialAddress("tcp", tt.address, nil)
+		if got := err != nil; got != tt.wantErr {
+			t.Errorf("checkDialAddress(%q) with deny %v, allow %v returned error %v, want error: %t", tt.address, tt.deny, tt.allow, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, errDeniedNetwork) {
+			t.Errorf("checkDialAddress(%q) returned unexpected error: %v", tt.address, err)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	tests := []struct {
+		networks []string
+		want     []netip.Prefix
+		wantErr  bool
+	}{
+		{nil, []netip.Prefix{}, false},
+		{[]string{"10.0.0.0/8", " 127.0.0.1", "::1"}, []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("127.0.0.1/32"),
+			netip.MustParsePrefix("::1/128"),
+		}, false},
+		{[]string{"10.0.0.0/8", "invalid"}, nil, true},
+		{[]string{"10.0.0.0/33"}, nil, true},
+		{[]string{""}, nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseNetworks(tt.networks)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseNetworks(%q) returned error %v, want error: %t", tt.networks, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("ParseNetworks(%q) returned %v, want %v", tt.networks, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_DenyNetworks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		url   string
+		allow []string
+		code  int
+	}{
+		{server.URL, nil, http.StatusInternalServerError},
+		{strings.Replace(server.URL, "127.0.0.1", "localhost", 1), nil, http.StatusInternalServerError},
+		{server.URL, []string{"127.0.0.0/8", "::1"}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		p := NewProxy(nil, nil)
+		p.AllowNetworks = tt.allow
+
+		req := httptest.NewRequest("GET", "http://localhost/"+tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%v) with allowed networks %v returned status %d, want %d", tt.url, tt.allow, got, want)
+		}
+	}
+}
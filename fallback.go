@@ -0,0 +1,139 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/die-net/lrucache"
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultFallbackMaxAge is the cache lifetime of fallback images if
+// Proxy.FallbackMaxAge is not set.
+const defaultFallbackMaxAge = time.Minute
+
+// errorImageCacheSize is the maximum total size of the transformed fallback
+// and transformation error images cached by a Proxy.
+const errorImageCacheSize = 16 << 20
+
+// Fallback is an image served in place of remote images that could not be
+// fetched.  See Proxy.Fallbacks.
+type Fallback struct {
+	// Host, if non-empty, limits the fallback to remote images from
+	// matching hosts.  It has the same form as the hosts in
+	// Proxy.AllowHosts.
+	Host string
+
+	// Status is the status code, such as "404", or status class, such as
+	// "4xx", of remote responses the fallback is served for.  Remote
+	// images that could not be fetched at all are treated as having a 502
+	// status.  If empty, all error responses are matched.
+	Status string
+
+	// Image is the fallback image, which is transformed using the
+	// requested options.
+	Image []byte
+
+	// StatusCode is the status code of fallback responses.  If zero, the
+	// status code of the remote response is used.
+	StatusCode int
+}
+
+// matches returns whether f should be served for remote URL u that
+// returned the error status code.
+func (f Fallback) matches(u *url.URL, status int) bool {
+	if f.Host != "" && !hostMatches([]string{f.Host}, u) {
+		return false
+	}
+	s := strconv.Itoa(status)
+	return f.Status == "" || f.Status == s || strings.EqualFold(f.Status, s[:1]+"xx")
+}
+
+// serveFallback serves the first of p.Fallbacks that matches req and the
+// remote status code, and reports whether a fallback was served.
+func (p *Proxy) serveFallback(w http.ResponseWriter, req *Request, status int) bool {
+	for _, f := range p.Fallbacks {
+		if !f.matches(req.URL, status) {
+			continue
+		}
+
+		code := f.StatusCode
+		if code == 0 {
+			code = status
+		}
+		maxAge := p.FallbackMaxAge
+		if maxAge == 0 {
+			maxAge = defaultFallbackMaxAge
+		}
+		cacheControl := fmt.Sprintf("max-age=%d", int(maxAge.Seconds()))
+		if err := p.serveErrorImage(w, req, f.Image, code, cacheControl); err != nil {
+			p.logf("error transforming fallback image: %v", err)
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// serveErrorImage serves img, transformed using the options of req, in
+// response to req with the provided status code and Cache-Control header.
+// Nothing is written to w if img cannot be transformed.
+func (p *Proxy) serveErrorImage(w http.ResponseWriter, req *Request, img []byte, code int, cacheControl string) error {
+	img, err := p.errorImages.transform(img, req.Options, p.limits())
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(img))
+	w.Header().Set("Content-Length", strconv.Itoa(len(img)))
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("Content-Security-Policy", "script-src 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	if _, err := w.Write(img); err != nil {
+		p.logf("error writing image: %v", err)
+	}
+	return nil
+}
+
+// errorImageCache caches error images transformed with each set of options,
+// so that they are not transformed again for every failed request.
+type errorImageCache struct {
+	once  sync.Once
+	cache *lrucache.LruCache
+	group singleflight.Group
+}
+
+// transform returns img transformed using opt and limits, which is cached
+// for subsequent calls with the same arguments.  Concurrent calls with the same arguments share a
+// single transformation.
+func (c *errorImageCache) transform(img []byte, opt Options, limits Limits) ([]byte, error) {
+	c.once.Do(func() {
+		c.cache = lrucache.New(errorImageCacheSize, 0)
+	})
+
+	// requests that are signed differently share the same cached image
+	key := fmt.Sprintf("%s#%s#%v", hashKey(string(img)), opt.unsigned(), limits)
+	if b, ok := c.cache.Get(key); ok {
+		return b, nil
+	}
+	v, err, _ := c.group.Do(key, func() (any, error) {
+		b, err := TransformWithLimits(img, opt, limits)
+		if err == nil {
+			c.cache.Set(key, b)
+		}
+		return b, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
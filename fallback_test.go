@@ -0,0 +1,125 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestFallback_Matches(t *testing.T) {
+	tests := []struct {
+		fallback Fallback
+		url      string
+		status   int
+		want     bool
+	}{
+		{Fallback{}, "http://a.test/", 404, true},
+		{Fallback{}, "http://a.test/", 502, true},
+		{Fallback{Status: "404"}, "http://a.test/", 404, true},
+		{Fallback{Status: "404"}, "http://a.test/", 403, false},
+		{Fallback{Status: "4xx"}, "http://a.test/", 403, true},
+		{Fallback{Status: "4XX"}, "http://a.test/", 410, true},
+		{Fallback{Status: "4xx"}, "http://a.test/", 500, false},
+		{Fallback{Status: "5xx"}, "http://a.test/", 502, true},
+		{Fallback{Host: "a.test"}, "http://a.test/", 404, true},
+		{Fallback{Host: "a.test"}, "http://b.test/", 404, false},
+		{Fallback{Host: "*.a.test", Status: "404"}, "http://img.a.test/", 404, true},
+		{Fallback{Host: "*.a.test", Status: "404"}, "http://img.a.test/", 500, false},
+	}
+
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if got := tt.fallback.matches(u, tt.status); got != tt.want {
+			t.Errorf("%+v.matches(%q, %d) returned %t, want %t", tt.fallback, tt.url, tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_Fallback(t *testing.T) {
+	buf := new(bytes.Buffer)
+	_ = png.Encode(buf, image.NewNRGBA(image.Rect(0, 0, 4, 4)))
+	img := buf.Bytes()
+
+	tests := []struct {
+		url       string
+		fallbacks []Fallback
+		code      int // expected response status code
+		width     int // expected width of fallback image, if served
+	}{
+		{"/http://good.test/404", nil, http.StatusNotFound, 0},
+		{"/http://good.test/404", []Fallback{{Status: "5xx", Image: img}}, http.StatusNotFound, 0},
+		{"/http://good.test/404", []Fallback{{Status: "4xx", Image: img}}, http.StatusNotFound, 4},
+		{"/2/http://good.test/404", []Fallback{{Status: "404", Image: img}}, http.StatusNotFound, 2},
+		{"/2/http://good.test/404", []Fallback{{Image: img, StatusCode: http.StatusOK}}, http.StatusOK, 2},
+		{"/http://good.test/404", []Fallback{{Host: "other.test", Image: img}}, http.StatusNotFound, 0},
+		{"/http://good.test/error", []Fallback{{Status: "5xx", Image: img}}, http.StatusBadGateway, 4},
+		{"/http://good.test/404", []Fallback{{Image: []byte("invalid")}}, http.StatusNotFound, 0},
+	}
+
+	for _, tt := range tests {
+		p := NewProxy(&testTransport{}, nil)
+		p.AllowHosts = []string{"good.test"}
+		p.Fallbacks = tt.fallbacks
+
+		req := httptest.NewRequest("GET", "http://localhost"+tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%v) returned status %d, want %d", tt.url, got, want)
+		}
+		if tt.width == 0 {
+			if ct := resp.Header().Get("Content-Type"); ct == "image/png" {
+				t.Errorf("ServeHTTP(%v) unexpectedly served fallback image", tt.url)
+			}
+			continue
+		}
+		if got, want := resp.Header().Get("Cache-Control"), "max-age=60"; got != want {
+			t.Errorf("ServeHTTP(%v) returned Cache-Control %q, want %q", tt.url, got, want)
+		}
+		cfg, err := png.DecodeConfig(resp.Body)
+		if err != nil {
+			t.Errorf("ServeHTTP(%v) returned invalid image: %v", tt.url, err)
+			continue
+		}
+		if got, want := cfg.Width, tt.width; got != want {
+			t.Errorf("ServeHTTP(%v) returned image with width %d, want %d", tt.url, got, want)
+		}
+	}
+}
+
+func TestErrorImageCache(t *testing.T) {
+	img := new(bytes.Buffer)
+	_ = png.Encode(img, image.NewNRGBA(image.Rect(0, 0, 4, 4)))
+
+	var c errorImageCache
+	opt := Options{Width: 2, Height: 2}
+	a, err := c.transform(img.Bytes(), opt, Limits{})
+	if err != nil {
+		t.Fatalf("transform returned unexpected error: %v", err)
+	}
+	b, _ := c.transform(img.Bytes(), opt, Limits{})
+	if &a[0] != &b[0] {
+		t.Errorf("transform with the same options did not return cached image")
+	}
+	signed := opt
+	signed.Signature, signed.ValidUntil = "sig", time.Unix(1e9, 0)
+	if b, _ := c.transform(img.Bytes(), signed, Limits{}); &a[0] != &b[0] {
+		t.Errorf("transform with a different signature did not return cached image")
+	}
+	if b, _ := c.transform(img.Bytes(), Options{Width: 3}, Limits{}); &a[0] == &b[0] {
+		t.Errorf("transform with different options returned cached image")
+	}
+
+	if _, err := c.transform(img.Bytes(), opt, Limits{MaxInputBytes: 10}); err == nil {
+		t.Errorf("transform did not return error for image over limits")
+	}
+}
@@ -0,0 +1,475 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// This file implements an endpoint compatible with the IIIF Image API 3.0,
+// as described at https://iiif.io/api/image/3.0/.  IIIF requests are served
+// under Proxy.IIIFPrefix and take the form:
+//
+//	{prefix}/{identifier}/{region}/{size}/{rotation}/{quality}.{format}
+//	{prefix}/{identifier}/info.json
+//
+// The identifier is the percent-encoded remote URL, which may be relative to
+// Proxy.DefaultBaseURL.  IIIF parameters are mapped onto the equivalent
+// Options, so IIIF requests share the caching and transformation behavior
+// of other imageproxy requests.
+
+const (
+	iiifContext  = "http://iiif.io/api/image/3/context.json"
+	iiifProtocol = "http://iiif.io/api/image"
+	iiifProfile  = "http://iiif.io/api/image/3/level2.json"
+
+	// tile size advertised in info.json
+	iiifTileSize = 512
+)
+
+// iiifFormats maps supported IIIF formats to imageproxy formats.
+var iiifFormats = map[string]string{
+	"jpg":  optFormatJPEG,
+	"png":  optFormatPNG,
+	"tif":  optFormatTIFF,
+	"webp": optFormatWEBP,
+}
+
+// iiifError is an error in an IIIF request, along with the HTTP status code
+// that should be returned to the client.
+type iiifError struct {
+	code int
+	msg  string
+}
+
+func (e iiifError) Error() string {
+	return e.msg
+}
+
+func errIIIFBadRequest(format string, a ...any) error {
+	return iiifError{http.StatusBadRequest, fmt.Sprintf(format, a...)}
+}
+
+func errIIIFNotImplemented(format string, a ...any) error {
+	return iiifError{http.StatusNotImplemented, fmt.Sprintf(format, a...)}
+}
+
+// serveIIIF handles incoming IIIF Image API requests.
+func (p *Proxy) serveIIIF(w http.ResponseWriter, r *http.Request) {
+	path, _ := cutPathPrefix(r, p.IIIFPrefix)
+	segments := strings.Split(path, "/")
+
+	u, err := p.iiifURL(segments[0])
+	if err != nil {
+		msg := fmt.Sprintf("invalid IIIF identifier: %v", err)
+		p.log(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	// IIIF requests have no place for options in the request path, so
+	// signed requests include a signature of the remote URL as a query
+	// parameter.
+	req := &Request{URL: u, Original: r}
+	req.Options.Signature = r.URL.Query().Get("sig")
+	if err := p.allowed(req); err != nil {
+		p.serveNotAllowed(w, req, err)
+		return
+	}
+	req.Options.Signature = ""
+
+	switch {
+	case len(segments) == 1:
+		// the base URI of an image redirects to its image information
+		loc := url.URL{Path: r.URL.Path + "/info.json", RawPath: r.URL.EscapedPath() + "/info.json", RawQuery: r.URL.RawQuery}
+		w.Header().Set("Location", loc.String())
+		w.WriteHeader(http.StatusSeeOther)
+	case len(segments) == 2 && segments[1] == "info.json":
+		p.serveIIIFInfo(w, req)
+	case len(segments) == 5:
+		p.serveIIIFImage(w, req, segments[1:])
+	default:
+		http.Error(w, "invalid IIIF request", http.StatusBadRequest)
+	}
+}
+
+// iiifURL parses the IIIF identifier id as a remote URL.
+func (p *Proxy) iiifURL(id string) (*url.URL, error) {
+	s, err := url.PathUnescape(id)
+	if err != nil {
+		return nil, err
+	}
+	u, _, err := parseURL(s, p.DefaultBaseURL)
+	if err != nil {
+		return nil, err
+	}
+	if p.DefaultBaseURL != nil {
+		u = p.DefaultBaseURL.ResolveReference(u)
+	}
+	if !u.IsAbs() {
+		return nil, fmt.Errorf("must provide absolute remote URL")
+	}
+	if !isHTTP(u) {
+		return nil, fmt.Errorf("remote URL must have http or https scheme")
+	}
+	return u, nil
+}
+
+// iiifImageSize fetches the remote image for req and returns its
+// dimensions after applying any EXIF orientation, along with the headers of
+// the remote response.  If the image cannot be fetched, an error response or
+// fallback image is written to w and ok is false.
+func (p *Proxy) iiifImageSize(w http.ResponseWriter, req *Request) (width, height int, header http.Header, ok bool) {
+	if p.serveCachedFailure(w, req) {
+		return 0, 0, nil, false
+	}
+	resp, err := p.fetch(w, req, req.URL.String())
+	if err != nil {
+		p.serveFetchError(w, req, err)
+		return 0, 0, nil, false
+	}
+	defer resp.Body.Close()
+
+	if p.serveRemoteError(w, req, resp) {
+		return 0, 0, nil, false
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		http.Error(w, "not found", http.StatusNotFound)
+		return 0, 0, nil, false
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg := fmt.Sprintf("error fetching remote image: %s", resp.Status)
+		p.log(msg)
+		http.Error(w, msg, http.StatusBadGateway)
+		return 0, 0, nil, false
+	}
+
+	if err := p.authorizeResponse(req, resp); err != nil {
+		p.log(err)
+		http.Error(w, msgNotAllowed, http.StatusForbidden)
+		return 0, 0, nil, false
+	}
+
+	// only the start of the image needed to decode its configuration
+	// and EXIF orientation is read.
+	if p.MaxInputBytes > 0 && resp.ContentLength > p.MaxInputBytes {
+		msg := fmt.Sprintf("error fetching remote image: %v: %d bytes", errInputTooLarge, resp.ContentLength)
+		p.log(msg)
+		http.Error(w, msg, http.StatusRequestEntityTooLarge)
+		return 0, 0, nil, false
+	}
+	var body io.Reader = resp.Body
+	if p.MaxInputBytes > 0 {
+		body = io.LimitReader(resp.Body, p.MaxInputBytes)
+	}
+	var head bytes.Buffer
+	cfg, format, err := image.DecodeConfig(io.TeeReader(body, &head))
+	if err != nil {
+		msg := fmt.Sprintf("error decoding remote image: %v", err)
+		p.log(msg)
+		http.Error(w, msg, http.StatusInternalServerError)
+		return 0, 0, nil, false
+	}
+
+	width, height = cfg.Width, cfg.Height
+	if format == "jpeg" || format == "tiff" {
+		// Transform applies EXIF orientation to these formats, which
+		// may swap the width and height.
+		r := io.LimitReader(io.MultiReader(&head, body), maxExifSize)
+		if opt := exifOrientation(r); opt.Rotate%180 != 0 {
+			width, height = height, width
+		}
+	}
+	return width, height, resp.Header, true
+}
+
+// iiifInfo is the image information document returned for info.json
+// requests.
+type iiifInfo struct {
+	Context        string      `json:"@context"`
+	ID             string      `json:"id"`
+	Type           string      `json:"type"`
+	Protocol       string      `json:"protocol"`
+	Profile        string      `json:"profile"`
+	Width          int         `json:"width"`
+	Height         int         `json:"height"`
+	Tiles          []iiifTiles `json:"tiles,omitempty"`
+	ExtraFormats   []string    `json:"extraFormats,omitempty"`
+	ExtraQualities []string    `json:"extraQualities,omitempty"`
+	ExtraFeatures  []string    `json:"extraFeatures,omitempty"`
+}
+
+type iiifTiles struct {
+	Width        int   `json:"width"`
+	ScaleFactors []int `json:"scaleFactors"`
+}
+
+// serveIIIFInfo serves the image information for req.
+func (p *Proxy) serveIIIFInfo(w http.ResponseWriter, req *Request) {
+	width, height, header, ok := p.iiifImageSize(w, req)
+	if !ok {
+		return
+	}
+
+	r := req.Original
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	path := strings.TrimSuffix(r.URL.EscapedPath(), "/info.json")
+
+	info := iiifInfo{
+		Context:        iiifContext,
+		ID:             fmt.Sprintf("%s://%s%s", scheme, r.Host, path),
+		Type:           "ImageService3",
+		Protocol:       iiifProtocol,
+		Profile:        "level2",
+		Width:          width,
+		Height:         height,
+		Tiles:          []iiifTiles{{Width: iiifTileSize, ScaleFactors: iiifScaleFactors(width, height)}},
+		ExtraFormats:   []string{"tif", "webp"},
+		ExtraQualities: []string{"color"},
+		ExtraFeatures:  []string{"mirroring"},
+	}
+	if p.ScaleUp {
+		info.ExtraFeatures = append(info.ExtraFeatures, "sizeUpscaling")
+	}
+
+	copyHeader(w.Header(), header, "Cache-Control", "Last-Modified", "Expires", "Etag")
+	if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		w.Header().Set("Content-Type", fmt.Sprintf("application/ld+json;profile=%q", iiifContext))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		p.logf("error writing response: %v", err)
+	}
+}
+
+// iiifScaleFactors returns the scale factors at which tiles are available
+// for an image of the provided dimensions: successive powers of two, up to
+// the factor at which the full image fits in a single tile.
+func iiifScaleFactors(width, height int) []int {
+	factors := []int{1}
+	for f := 1; width > iiifTileSize*f || height > iiifTileSize*f; {
+		f *= 2
+		factors = append(factors, f)
+	}
+	return factors
+}
+
+// serveIIIFImage serves an image request for req.  params are the region,
+// size, rotation, and quality.format path segments of the IIIF request.
+func (p *Proxy) serveIIIFImage(w http.ResponseWriter, req *Request, params []string) {
+	width, height, _, ok := p.iiifImageSize(w, req)
+	if !ok {
+		return
+	}
+
+	opt, err := parseIIIFOptions(params[0], params[1], params[2], params[3], width, height, p.ScaleUp)
+	if err != nil {
+		code := http.StatusBadRequest
+		if e, ok := err.(iiifError); ok {
+			code = e.code
+		}
+		msg := fmt.Sprintf("invalid IIIF request: %v", err)
+		p.log(msg)
+		http.Error(w, msg, code)
+		return
+	}
+	if err := p.presetOptions(opt); err != nil {
+		msg := fmt.Sprintf("invalid IIIF request: %v", err)
+		p.log(msg)
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	req.Options = opt
+
+	w.Header().Set("Link", fmt.Sprintf("<%s>;rel=\"profile\"", iiifProfile))
+	p.serveRequest(w, req)
+}
+
+// parseIIIFOptions returns the Options equivalent to the IIIF region, size,
+// rotation, and quality.format parameters for an image of the provided
+// width and height.  scaleUp reports whether the image may be scaled beyond
+// the size of the requested region.
+//
+// IIIF sizes that change the aspect ratio of the region (such as "w,h")
+// are served by cropping the scaled region to fill the requested size,
+// rather than distorting the image.
+func parseIIIFOptions(region, size, rotation, qualityFormat string, width, height int, scaleUp bool) (Options, error) {
+	var opt Options
+
+	rect, err := iiifRegion(region, width, height)
+	if err != nil {
+		return opt, err
+	}
+	if rect != image.Rect(0, 0, width, height) {
+		opt.CropX = float64(rect.Min.X)
+		opt.CropY = float64(rect.Min.Y)
+		opt.CropWidth = float64(rect.Dx())
+		opt.CropHeight = float64(rect.Dy())
+	}
+
+	w, h, err := iiifSize(size, rect.Dx(), rect.Dy(), scaleUp)
+	if err != nil {
+		return opt, err
+	}
+	if w != rect.Dx() || h != rect.Dy() {
+		opt.Width = float64(w)
+		opt.Height = float64(h)
+	}
+
+	rotation, mirror := strings.CutPrefix(rotation, "!")
+	deg, err := strconv.ParseFloat(rotation, 64)
+	if err != nil || deg < 0 || deg > 360 {
+		return opt, errIIIFBadRequest("invalid rotation %q", rotation)
+	}
+	if deg != math.Trunc(deg) || int(deg)%90 != 0 {
+		return opt, errIIIFNotImplemented("rotation %q not supported", rotation)
+	}
+	// IIIF rotates clockwise after mirroring, while Options rotates
+	// counter-clockwise before flipping.  A clockwise rotation of a
+	// mirrored image is equivalent to mirroring an image rotated by the
+	// same amount counter-clockwise.
+	if mirror {
+		opt.FlipHorizontal = true
+		opt.Rotate = int(deg) % 360
+	} else {
+		opt.Rotate = (360 - int(deg)) % 360
+	}
+
+	quality, format, ok := strings.Cut(qualityFormat, ".")
+	if !ok {
+		return opt, errIIIFBadRequest("missing format")
+	}
+	switch quality {
+	case "default", "color":
+	case "gray", "bitonal":
+		return opt, errIIIFNotImplemented("quality %q not supported", quality)
+	default:
+		return opt, errIIIFBadRequest("invalid quality %q", quality)
+	}
+	if opt.Format, ok = iiifFormats[format]; !ok {
+		return opt, errIIIFNotImplemented("format %q not supported", format)
+	}
+
+	return opt, nil
+}
+
+// iiifRegion returns the rectangle of an image of the provided width and
+// height identified by the IIIF region parameter s.
+func iiifRegion(s string, width, height int) (image.Rectangle, error) {
+	bounds := image.Rect(0, 0, width, height)
+	switch s {
+	case "full":
+		return bounds, nil
+	case "square":
+		d := min(width, height)
+		x, y := (width-d)/2, (height-d)/2
+		return image.Rect(x, y, x+d, y+d), nil
+	}
+
+	v, pct := strings.CutPrefix(s, "pct:")
+	parts := strings.Split(v, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, errIIIFBadRequest("invalid region %q", s)
+	}
+	var f [4]float64
+	for i, part := range parts {
+		var err error
+		if f[i], err = strconv.ParseFloat(part, 64); err != nil || f[i] < 0 {
+			return image.Rectangle{}, errIIIFBadRequest("invalid region %q", s)
+		}
+	}
+	if pct {
+		f[0] *= float64(width) / 100
+		f[1] *= float64(height) / 100
+		f[2] *= float64(width) / 100
+		f[3] *= float64(height) / 100
+	}
+
+	x0, y0 := int(math.Round(f[0])), int(math.Round(f[1]))
+	x1, y1 := int(math.Round(f[0]+f[2])), int(math.Round(f[1]+f[3]))
+	r := image.Rect(x0, y0, x1, y1).Intersect(bounds)
+	if r.Empty() {
+		return image.Rectangle{}, errIIIFBadRequest("region %q is empty or outside of the image", s)
+	}
+	return r, nil
+}
+
+// iiifSize returns the dimensions identified by the IIIF size parameter s,
+// for a region of the provided width and height.  Sizes larger than the
+// region are only allowed if s has the "^" prefix and scaleUp is true.
+func iiifSize(s string, width, height int, scaleUp bool) (w, h int, err error) {
+	v, upscale := strings.CutPrefix(s, "^")
+	v, confined := strings.CutPrefix(v, "!")
+	rw, rh := float64(width), float64(height)
+
+	switch {
+	case v == "max" && !confined:
+		w, h = width, height
+	case strings.HasPrefix(v, "pct:") && !confined:
+		n, err := strconv.ParseFloat(v[len("pct:"):], 64)
+		if err != nil || n <= 0 {
+			return 0, 0, errIIIFBadRequest("invalid size %q", s)
+		}
+		w, h = int(math.Round(rw*n/100)), int(math.Round(rh*n/100))
+	default:
+		ws, hs, ok := strings.Cut(v, ",")
+		if !ok || (ws == "" && hs == "") || (confined && (ws == "" || hs == "")) {
+			return 0, 0, errIIIFBadRequest("invalid size %q", s)
+		}
+		var fw, fh int
+		if ws != "" {
+			if fw, err = strconv.Atoi(ws); err != nil || fw <= 0 {
+				return 0, 0, errIIIFBadRequest("invalid size %q", s)
+			}
+		}
+		if hs != "" {
+			if fh, err = strconv.Atoi(hs); err != nil || fh <= 0 {
+				return 0, 0, errIIIFBadRequest("invalid size %q", s)
+			}
+		}
+
+		switch {
+		case confined:
+			scale := math.Min(float64(fw)/rw, float64(fh)/rh)
+			if !upscale {
+				scale = math.Min(scale, 1)
+			}
+			w, h = int(math.Round(rw*scale)), int(math.Round(rh*scale))
+		case ws == "":
+			w, h = int(math.Round(rw*float64(fh)/rh)), fh
+		case hs == "":
+			w, h = fw, int(math.Round(rh*float64(fw)/rw))
+		default:
+			w, h = fw, fh
+		}
+	}
+
+	if w <= 0 || h <= 0 {
+		return 0, 0, errIIIFBadRequest("size %q results in an empty image", s)
+	}
+	if w > width || h > height {
+		if !upscale {
+			return 0, 0, errIIIFBadRequest("size %q is larger than the region", s)
+		}
+		if !scaleUp {
+			return 0, 0, errIIIFNotImplemented("upscaling not supported")
+		}
+	}
+	return w, h, nil
+}
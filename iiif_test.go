@@ -0,0 +1,264 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gregjones/httpcache"
+)
+
+func TestParseIIIFOptions(t *testing.T) {
+	tests := []struct {
+		params  [4]string // region, size, rotation, quality.format
+		scaleUp bool
+		want    Options
+		code    int // expected error status code, if any
+	}{
+		{[4]string{"full", "max", "0", "default.jpg"}, false, Options{Format: "jpeg"}, 0},
+		{[4]string{"full", "max", "0", "color.png"}, false, Options{Format: "png"}, 0},
+		{[4]string{"full", "max", "0", "default.tif"}, false, Options{Format: "tiff"}, 0},
+		{[4]string{"full", "max", "0", "default.webp"}, false, Options{Format: "webp"}, 0},
+
+		// regions of a 400x200 image
+		{[4]string{"square", "max", "0", "default.jpg"}, false, Options{CropX: 100, CropWidth: 200, CropHeight: 200, Format: "jpeg"}, 0},
+		{[4]string{"10,20,30,40", "max", "0", "default.jpg"}, false, Options{CropX: 10, CropY: 20, CropWidth: 30, CropHeight: 40, Format: "jpeg"}, 0},
+		{[4]string{"300,100,200,200", "max", "0", "default.jpg"}, false, Options{CropX: 300, CropY: 100, CropWidth: 100, CropHeight: 100, Format: "jpeg"}, 0},
+		{[4]string{"pct:50,50,50,50", "max", "0", "default.jpg"}, false, Options{CropX: 200, CropY: 100, CropWidth: 200, CropHeight: 100, Format: "jpeg"}, 0},
+		{[4]string{"pct:0,0,100,100", "max", "0", "default.jpg"}, false, Options{Format: "jpeg"}, 0},
+		{[4]string{"400,0,10,10", "max", "0", "default.jpg"}, false, Options{}, http.StatusBadRequest},
+		{[4]string{"0,0,0,10", "max", "0", "default.jpg"}, false, Options{}, http.StatusBadRequest},
+		{[4]string{"0,0,10", "max", "0", "default.jpg"}, false, Options{}, http.StatusBadRequest},
+		{[4]string{"foo", "max", "0", "default.jpg"}, false, Options{}, http.StatusBadRequest},
+
+		// sizes
+		{[4]string{"full", "100,", "0", "default.jpg"}, false, Options{Width: 100, Height: 50, Format: "jpeg"}, 0},
+		{[4]string{"full", ",100", "0", "default.jpg"}, false, Options{Width: 200, Height: 100, Format: "jpeg"}, 0},
+		{[4]string{"full", "pct:25", "0", "default.jpg"}, false, Options{Width: 100, Height: 50, Format: "jpeg"}, 0},
+		{[4]string{"full", "100,100", "0", "default.jpg"}, false, Options{Width: 100, Height: 100, Format: "jpeg"}, 0},
+		{[4]string{"full", "!100,100", "0", "default.jpg"}, false, Options{Width: 100, Height: 50, Format: "jpeg"}, 0},
+		{[4]string{"full", "!1000,1000", "0", "default.jpg"}, false, Options{Format: "jpeg"}, 0},
+		{[4]string{"square", "100,", "0", "default.jpg"}, false, Options{CropX: 100, CropWidth: 200, CropHeight: 200, Width: 100, Height: 100, Format: "jpeg"}, 0},
+		{[4]string{"full", "^800,", "0", "default.jpg"}, true, Options{Width: 800, Height: 400, Format: "jpeg"}, 0},
+		{[4]string{"full", "^!800,800", "0", "default.jpg"}, true, Options{Width: 800, Height: 400, Format: "jpeg"}, 0},
+		{[4]string{"full", "^max", "0", "default.jpg"}, false, Options{Format: "jpeg"}, 0},
+		{[4]string{"full", "800,", "0", "default.jpg"}, true, Options{}, http.StatusBadRequest},
+		{[4]string{"full", "pct:200", "0", "default.jpg"}, true, Options{}, http.StatusBadRequest},
+		{[4]string{"full", "^800,", "0", "default.jpg"}, false, Options{}, http.StatusNotImplemented},
+		{[4]string{"full", "!100,", "0", "default.jpg"}, false, Options{}, http.StatusBadRequest},
+		{[4]string{"full", ",", "0", "default.jpg"}, false, Options{}, http.StatusBadRequest},
+		{[4]string{"full", "0,", "0", "default.jpg"}, false, Options{}, http.StatusBadRequest},
+		{[4]string{"full", "foo", "0", "default.jpg"}, false, Options{}, http.StatusBadRequest},
+
+		// rotation and mirroring
+		{[4]string{"full", "max", "90", "default.jpg"}, false, Options{Rotate: 270, Format: "jpeg"}, 0},
+		{[4]string{"full", "max", "180", "default.jpg"}, false, Options{Rotate: 180, Format: "jpeg"}, 0},
+		{[4]string{"full", "max", "360", "default.jpg"}, false, Options{Format: "jpeg"}, 0},
+		{[4]string{"full", "max", "!0", "default.jpg"}, false, Options{FlipHorizontal: true, Format: "jpeg"}, 0},
+		{[4]string{"full", "max", "!90", "default.jpg"}, false, Options{Rotate: 90, FlipHorizontal: true, Format: "jpeg"}, 0},
+		{[4]string{"full", "max", "45", "default.jpg"}, false, Options{}, http.StatusNotImplemented},
+		{[4]string{"full", "max", "-90", "default.jpg"}, false, Options{}, http.StatusBadRequest},
+		{[4]string{"full", "max", "foo", "default.jpg"}, false, Options{}, http.StatusBadRequest},
+
+		// quality and format
+		{[4]string{"full", "max", "0", "gray.jpg"}, false, Options{}, http.StatusNotImplemented},
+		{[4]string{"full", "max", "0", "foo.jpg"}, false, Options{}, http.StatusBadRequest},
+		{[4]string{"full", "max", "0", "default.jp2"}, false, Options{}, http.StatusNotImplemented},
+		{[4]string{"full", "max", "0", "default"}, false, Options{}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		got, err := parseIIIFOptions(tt.params[0], tt.params[1], tt.params[2], tt.params[3], 400, 200, tt.scaleUp)
+		if tt.code != 0 {
+			if e, ok := err.(iiifError); !ok || e.code != tt.code {
+				t.Errorf("parseIIIFOptions(%v) returned error %v, want status %d", tt.params, err, tt.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseIIIFOptions(%v) returned unexpected error: %v", tt.params, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseIIIFOptions(%v) returned %#v, want %#v", tt.params, got, tt.want)
+		}
+	}
+}
+
+func TestIIIFScaleFactors(t *testing.T) {
+	tests := []struct {
+		width, height int
+		want          []int
+	}{
+		{100, 100, []int{1}},
+		{512, 512, []int{1}},
+		{513, 100, []int{1, 2}},
+		{1000, 3000, []int{1, 2, 4, 8}},
+	}
+
+	for _, tt := range tests {
+		if got := iiifScaleFactors(tt.width, tt.height); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("iiifScaleFactors(%d, %d) returned %v, want %v", tt.width, tt.height, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_ServeIIIF(t *testing.T) {
+	p := &Proxy{
+		Client: &http.Client{
+			Transport: &testTransport{},
+		},
+		AllowHosts: []string{"good.test"},
+		IIIFPrefix: "/iiif",
+	}
+
+	tests := []struct {
+		url  string // request URL
+		code int    // expected response status code
+	}{
+		{"/iiif/http%3A%2F%2Fgood.test%2Fpng", http.StatusSeeOther},
+		{"/iiif/http%3A%2F%2Fgood.test%2Fpng/info.json", http.StatusOK},
+		{"/iiif/http%3A%2F%2Fgood.test%2Fpng/full/max/0/default.png", http.StatusOK},
+		{"/iiif/http%3A%2F%2Fgood.test%2Fpng/full/2,/0/default.png", http.StatusBadRequest},
+		{"/iiif/http%3A%2F%2Fgood.test%2Fpng/full/max/0/gray.png", http.StatusNotImplemented},
+		{"/iiif/http%3A%2F%2Fgood.test%2Fpng/full/max/0", http.StatusBadRequest},
+		{"/iiif/http%3A%2F%2Fgood.test%2Fmissing/info.json", http.StatusNotFound},
+		{"/iiif/http%3A%2F%2Fbad.test%2Fpng/info.json", http.StatusForbidden},
+		{"/iiif/png/info.json", http.StatusBadRequest}, // relative URL without base URL
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://localhost"+tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%v) returned status %d, want %d", tt.url, got, want)
+		}
+	}
+}
+
+func TestProxy_ServeIIIF_Redirect(t *testing.T) {
+	p := &Proxy{
+		Client: &http.Client{
+			Transport: &testTransport{},
+		},
+		IIIFPrefix: "/iiif",
+	}
+
+	// the signature is preserved when redirecting to info.json
+	req := httptest.NewRequest("GET", "http://localhost/iiif/http%3A%2F%2Fgood.test%2Fpng?sig=abc", nil)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	if got, want := resp.Header().Get("Location"), "/iiif/http%3A%2F%2Fgood.test%2Fpng/info.json?sig=abc"; got != want {
+		t.Errorf("ServeHTTP returned Location %q, want %q", got, want)
+	}
+}
+
+func TestProxy_ServeIIIF_FetchError(t *testing.T) {
+	buf := new(bytes.Buffer)
+	_ = png.Encode(buf, image.NewNRGBA(image.Rect(0, 0, 4, 4)))
+
+	et := &errorTransport{err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	p := NewProxy(et, httpcache.NewMemoryCache())
+	p.IIIFPrefix = "/iiif"
+	p.NegativeCacheDuration = time.Minute
+	p.Fallbacks = []Fallback{{Status: "5xx", Image: buf.Bytes()}}
+
+	for range 2 {
+		req := httptest.NewRequest("GET", "http://localhost/iiif/http%3A%2F%2Fbad.test%2Fimage/info.json", nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, http.StatusBadGateway; got != want {
+			t.Errorf("ServeHTTP returned status %d, want %d", got, want)
+		}
+		if got, want := resp.Header().Get("Content-Type"), "image/png"; got != want {
+			t.Errorf("ServeHTTP returned Content-Type %q, want fallback image %q", got, want)
+		}
+	}
+	if et.count != 1 {
+		t.Errorf("remote server received %d requests, want 1", et.count)
+	}
+}
+
+func TestProxy_ServeIIIF_PresetsOnly(t *testing.T) {
+	p := &Proxy{
+		Client: &http.Client{
+			Transport: &testTransport{},
+		},
+		IIIFPrefix:  "/iiif",
+		Presets:     map[string]string{"png": "png"},
+		PresetsOnly: true,
+	}
+
+	tests := []struct {
+		url  string // request URL
+		code int    // expected response status code
+	}{
+		{"/iiif/http%3A%2F%2Fgood.test%2Fpng/info.json", http.StatusOK},
+		{"/iiif/http%3A%2F%2Fgood.test%2Fpng/full/max/0/default.png", http.StatusOK},
+		{"/iiif/http%3A%2F%2Fgood.test%2Fpng/full/max/0/default.jpg", http.StatusBadRequest},
+		{"/iiif/http%3A%2F%2Fgood.test%2Fpng/full/max/90/default.png", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://localhost"+tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%v) returned status %d, want %d", tt.url, got, want)
+		}
+	}
+}
+
+func TestProxy_ServeIIIF_Info(t *testing.T) {
+	p := &Proxy{
+		Client: &http.Client{
+			Transport: &testTransport{},
+		},
+		IIIFPrefix: "/iiif/",
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/iiif/http%3A%2F%2Fgood.test%2Fpng/info.json", nil)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	if got, want := resp.Header().Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("ServeHTTP returned Content-Type %q, want %q", got, want)
+	}
+
+	var info iiifInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatalf("error decoding info.json: %v", err)
+	}
+	want := iiifInfo{
+		Context:        iiifContext,
+		ID:             "http://localhost/iiif/http%3A%2F%2Fgood.test%2Fpng",
+		Type:           "ImageService3",
+		Protocol:       iiifProtocol,
+		Profile:        "level2",
+		Width:          1,
+		Height:         1,
+		Tiles:          []iiifTiles{{Width: iiifTileSize, ScaleFactors: []int{1}}},
+		ExtraFormats:   []string{"tif", "webp"},
+		ExtraQualities: []string{"color"},
+		ExtraFeatures:  []string{"mirroring"},
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("ServeHTTP returned info %+v, want %+v", info, want)
+	}
+}
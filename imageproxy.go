@@ -8,6 +8,7 @@ package imageproxy // import "willnorris.com/go/imageproxy"
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -21,13 +22,14 @@ import (
 	"net/url"
 	"path"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/fcjr/aia-transport-go"
 	"github.com/gregjones/httpcache"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/sync/singleflight"
 	tphttp "willnorris.com/go/imageproxy/third_party/http"
 	tphc "willnorris.com/go/imageproxy/third_party/httpcache"
 )
@@ -48,6 +50,40 @@ type Proxy struct {
 	// proxied from.
 	DenyHosts []string
 
+	// DenyNetworks specifies a list of IP networks in CIDR notation, or
+	// individual IP addresses, that remote images cannot be fetched from.
+	// Unlike DenyHosts, it is checked against the resolved address of
+	// each connection, including after redirects.  If empty, private,
+	// loopback, link-local, and other special-purpose networks are
+	// denied.  Only the transport created by NewProxy when none is
+	// provided checks these networks.  If any network is invalid, all
+	// addresses are denied; use ParseNetworks to validate them.
+	DenyNetworks []string
+
+	// AllowNetworks specifies a list of IP networks in CIDR notation, or
+	// individual IP addresses, that remote images can be fetched from even
+	// if they are in DenyNetworks, such as for internal origins.  If any
+	// network is invalid, all addresses are denied.
+	AllowNetworks []string
+
+	// ClientRateLimit limits the rate of requests from each client IP
+	// address.
+	ClientRateLimit RateLimit
+
+	// KeyRateLimit limits the rate of requests signed with each of
+	// SignatureKeys.
+	KeyRateLimit RateLimit
+
+	// OriginRateLimit limits the rate of requests for remote images on
+	// each host.
+	OriginRateLimit RateLimit
+
+	// TrustedProxies specifies a list of IP networks in CIDR notation, or
+	// individual IP addresses, of reverse proxies whose X-Forwarded-For
+	// header is used to determine the client IP address.  If any network
+	// is invalid, no proxies are trusted.
+	TrustedProxies []string
+
 	// Referrers, when given, requires that requests to the image
 	// proxy come from a referring host. An empty list means all
 	// hosts are allowed.
@@ -75,6 +111,69 @@ type Proxy struct {
 	// Allow images to scale beyond their original dimensions.
 	ScaleUp bool
 
+	// ProgressiveJPEG, when true, encodes all transformed JPEG images as
+	// progressive JPEGs, as if the "progressive" option were specified.
+	ProgressiveJPEG bool
+
+	// MaxInputBytes is the maximum size in bytes of remote images that
+	// will be transformed.  Zero means no limit.
+	MaxInputBytes int64
+
+	// MaxPixels is the maximum number of pixels in images, or in each
+	// frame of animated images, that will be transformed.  If zero, 100
+	// megapixels is used.
+	MaxPixels int
+
+	// MaxAnimationPixels is the maximum total number of pixels in all
+	// frames of animated images that will be transformed, including the
+	// full-size frames drawn when animations are resized or converted to
+	// other formats.  If zero, 100 megapixels is used.
+	MaxAnimationPixels int
+
+	// MaxOutputWidth and MaxOutputHeight are the maximum dimensions of
+	// transformed images.  Zero means no limit.
+	MaxOutputWidth  int
+	MaxOutputHeight int
+
+	// TransformErrorPolicy specifies how remote images that cannot be
+	// transformed are handled.  It is one of TransformErrorOriginal, which
+	// is used if empty, TransformErrorStatus, or TransformErrorFallback.
+	// Images that exceed the configured limits are never served
+	// untransformed.
+	TransformErrorPolicy string
+
+	// TransformErrorImage is the image served in place of images that
+	// cannot be transformed when TransformErrorPolicy is
+	// TransformErrorFallback.  It is transformed using the requested
+	// options.
+	TransformErrorImage []byte
+
+	// Fallbacks are images served in place of remote images that could
+	// not be fetched or returned an error status.  The first matching
+	// fallback is used.  If none match, the error is returned as is.
+	Fallbacks []Fallback
+
+	// FallbackMaxAge is the duration that clients may cache fallback
+	// images.  If zero, one minute is used.
+	FallbackMaxAge time.Duration
+
+	// MaxTransformQueue is the maximum number of requests that wait for
+	// images to be transformed when as many images as there are CPUs are
+	// already being transformed.  Further requests receive a 503 Service
+	// Unavailable response.  Zero means no limit.
+	MaxTransformQueue int
+
+	// MaxTransformWait is the maximum time that requests wait for images
+	// to be transformed, after which they receive a 503 Service
+	// Unavailable response.  Zero means no limit.
+	MaxTransformWait time.Duration
+
+	// MaxTransformMemory is the maximum number of bytes of decoded images
+	// being transformed at once, as estimated from their dimensions.
+	// Requests wait for memory to be available, up to MaxTransformWait.
+	// Zero means no limit.
+	MaxTransformMemory int64
+
 	// Timeout specifies a time limit for requests served by this Proxy.
 	// If a call runs for longer than its time limit, a 504 Gateway Timeout
 	// response is returned.  A Timeout of zero means no timeout.
@@ -102,31 +201,133 @@ type Proxy struct {
 	// This will override cache duration from the remote server.
 	MinimumCacheDuration time.Duration
 
+	// StaleWhileRevalidate is the minimum duration after cached images
+	// become stale that they are still served, while being revalidated
+	// with the remote server in the background.  This will override
+	// shorter stale-while-revalidate durations from the remote server.
+	StaleWhileRevalidate time.Duration
+
+	// StaleIfError is the minimum duration after cached images become
+	// stale that they are still served if the remote server cannot be
+	// reached or returns an error.  This will override shorter
+	// stale-if-error durations from the remote server.
+	StaleIfError time.Duration
+
+	// NegativeCacheDuration is the duration to cache failed requests,
+	// so that requests for missing or broken images don't reach the
+	// remote server each time.  Remote responses with a 404, 410, or 5xx
+	// status, and connection errors, DNS errors, and timeouts fetching
+	// the remote image, are cached for all transformation options.
+	// Images that cannot be transformed are cached for the requested
+	// options.  Zero means failures are not cached.
+	NegativeCacheDuration time.Duration
+
 	// ForceCache, when true, forces caching of all images, even if the
 	// remote server specifies 'private' or 'no-store' in the cache-control
 	// header.
 	ForceCache bool
 
+	// QueryOptions, when true, allows transformation options to be
+	// specified using reserved query parameters such as "w", "h", and
+	// "sig" in addition to the first path segment.  Reserved parameters
+	// are removed from the remote URL.  See NewRequest.
+	QueryOptions bool
+
+	// Presets maps preset names to options strings.  Requests can use a
+	// preset by including the "p:{name}" option, which is expanded to the
+	// options of the preset.  See ParseOptions.
+	Presets map[string]string
+
+	// PresetsOnly, when true, only allows requests to specify options
+	// using presets, so that clients cannot request arbitrary
+	// transformations.  Signature and valid until options are still
+	// allowed.  Requests without any options are unaffected.
+	PresetsOnly bool
+
+	// IIIFPrefix, when non-empty, is the path prefix at which an IIIF
+	// Image API 3.0 compatible endpoint is served, such as "/iiif".
+	// Requests for paths under this prefix are handled as IIIF requests.
+	IIIFPrefix string
+
+	// ThumborPrefix, when non-empty, is the path prefix at which requests
+	// using Thumbor URL syntax are served, such as "/thumbor".  A prefix
+	// of "/" serves all image requests using Thumbor URL syntax.
+	// Signed Thumbor URLs are verified using SignatureKeys.
+	ThumborPrefix string
+
+	// ImgixPrefix, when non-empty, is the path prefix at which requests
+	// using imgix URL syntax are served, such as "/imgix".  A prefix of
+	// "/" serves all image requests using imgix URL syntax, with remote
+	// images typically resolved relative to DefaultBaseURL.  Signed imgix
+	// URLs are verified using SignatureKeys.
+	ImgixPrefix string
+
+	// AdminToken, when non-empty, enables the admin endpoint at PurgePath,
+	// which purges remote images and their transformed variants from the
+	// cache.  Requests must include the token as a bearer token in the
+	// Authorization header.
+	AdminToken string
+
+	// PurgeWebhook, when non-empty, is a URL to which purges made using
+	// the admin endpoint are forwarded, such as to purge a CDN.  It
+	// receives a POST request with a JSON body containing the purged
+	// "url" and its "surrogate_key", which is also included in the
+	// Surrogate-Key header.
+	PurgeWebhook string
+
+	// SurrogateKeys, when true, includes the Surrogate-Key and Cache-Tag
+	// headers in responses, which identify the remote host, remote URL,
+	// and transformation options of images so that CDNs can purge related
+	// images together.
+	SurrogateKeys bool
+
 	timeNow time.Time // current time, used for testing
+
+	// token buckets for ClientRateLimit, KeyRateLimit, and OriginRateLimit
+	clientLimiter, keyLimiter, originLimiter rateLimiter
+
+	// parsed DenyNetworks, AllowNetworks, and TrustedProxies
+	denyNetworks, allowNetworks, trustedProxies networkList
+
+	// transformed Fallbacks and TransformErrorImage
+	errorImages errorImageCache
 }
 
+// Policies for handling images that cannot be transformed.  See
+// Proxy.TransformErrorPolicy.
+const (
+	// TransformErrorOriginal serves the original untransformed image.
+	TransformErrorOriginal = "original"
+
+	// TransformErrorStatus returns an error response, with a 422 status
+	// for images that cannot be decoded and 500 for other errors.  The
+	// reason is included in the X-Imageproxy-Error response header.
+	TransformErrorStatus = "error"
+
+	// TransformErrorFallback serves Proxy.TransformErrorImage with the
+	// same status code and header as TransformErrorStatus.
+	TransformErrorFallback = "fallback"
+)
+
 // NewProxy constructs a new proxy.  The provided http RoundTripper will be
-// used to fetch remote URLs.  If nil is provided, http.DefaultTransport will
-// be used.
+// used to fetch remote URLs.  If nil is provided, a transport is used that
+// does not connect to addresses in Proxy.DenyNetworks.  The provided cache
+// also stores an index of the transformed variants of each remote image, so
+// that they can be purged together (see Proxy.Purge).
 func NewProxy(transport http.RoundTripper, cache Cache) *Proxy {
-	if transport == nil {
-		transport, _ = aia.NewTransport()
-	}
 	if cache == nil {
 		cache = NopCache
 	}
 
 	proxy := &Proxy{
-		Cache: cache,
+		Cache: &variantCache{Cache: cache},
+	}
+	if transport == nil {
+		transport = proxy.newTransport()
 	}
 
 	client := new(http.Client)
-	client.Transport = &httpcache.Transport{
+	cacheTransport := &httpcache.Transport{
 		Transport: &TransformingTransport{
 			Transport:     transport,
 			CachingClient: client,
@@ -137,16 +338,39 @@ func NewProxy(transport http.RoundTripper, cache Cache) *Proxy {
 				}
 			},
 			updateCacheHeaders: proxy.updateCacheHeaders,
+			limits:             proxy.limits,
+			errorPolicy: func() string {
+				return proxy.TransformErrorPolicy
+			},
+			queueLimits: proxy.queueLimits,
+			timeout: func() time.Duration {
+				return proxy.Timeout
+			},
 		},
-		Cache:               cache,
+		Cache:               proxy.Cache,
 		MarkCachedResponses: true,
 	}
+	client.Transport = &staleTransport{
+		Transport: cacheTransport,
+		now:       proxy.now,
+	}
 
 	proxy.Client = client
 
 	return proxy
 }
 
+// limits returns the Limits on images transformed by p.
+func (p *Proxy) limits() Limits {
+	return Limits{
+		MaxInputBytes:      p.MaxInputBytes,
+		MaxPixels:          p.MaxPixels,
+		MaxAnimationPixels: p.MaxAnimationPixels,
+		MaxOutputWidth:     p.MaxOutputWidth,
+		MaxOutputHeight:    p.MaxOutputHeight,
+	}
+}
+
 // updateCacheHeaders updates the cache-control headers in the provided headers.
 //
 // If the cache-control header includes the 'private' directive,
@@ -156,6 +380,9 @@ func NewProxy(transport http.RoundTripper, cache Cache) *Proxy {
 // This method also sets the cache-control max-age value to the maximum of the minimum cache
 // duration, the expires header, and the max-age header. It also removes the
 // expires header.
+//
+// The stale-while-revalidate and stale-if-error values are likewise set to at
+// least p.StaleWhileRevalidate and p.StaleIfError.
 func (p *Proxy) updateCacheHeaders(hdr http.Header) {
 	cc := tphc.ParseCacheControl(hdr)
 
@@ -179,7 +406,13 @@ func (p *Proxy) updateCacheHeaders(hdr http.Header) {
 		}
 	}
 
+	staleChanged := setMinDirective(cc, "stale-while-revalidate", p.StaleWhileRevalidate)
+	staleChanged = setMinDirective(cc, "stale-if-error", p.StaleIfError) || staleChanged
+
 	if p.MinimumCacheDuration == 0 {
+		if staleChanged {
+			hdr.Set("Cache-Control", cc.String())
+		}
 		return
 	}
 
@@ -204,6 +437,16 @@ func (p *Proxy) updateCacheHeaders(hdr http.Header) {
 	hdr.Del("Expires")
 }
 
+// setMinDirective sets the cache-control directive in cc to d in seconds if
+// it is currently less than d, and reports whether it was changed.
+func setMinDirective(cc tphc.CacheControl, directive string, d time.Duration) bool {
+	if d <= 0 || directiveSeconds(cc, directive) >= d {
+		return false
+	}
+	cc[directive] = fmt.Sprintf("%d", int(d.Seconds()))
+	return true
+}
+
 // ServeHTTP handles incoming requests.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/favicon.ico" {
@@ -221,7 +464,15 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if p.AdminToken != "" && r.URL.Path == PurgePath {
+		p.servePurge(w, r)
+		return
+	}
+
 	var h http.Handler = http.HandlerFunc(p.serveImage)
+	if _, ok := cutPathPrefix(r, p.IIIFPrefix); ok {
+		h = http.HandlerFunc(p.serveIIIF)
+	}
 	if p.Timeout > 0 {
 		h = tphttp.TimeoutHandler(h, p.Timeout, "Gateway timeout waiting for remote resource.")
 	}
@@ -236,9 +487,20 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.ServeHTTP(w, r)
 }
 
+// cutPathPrefix returns the escaped path of r relative to prefix, and whether
+// the path of r is under prefix.  An empty prefix matches no paths, and the
+// prefix "/" matches all paths.
+func cutPathPrefix(r *http.Request, prefix string) (string, bool) {
+	if prefix == "" {
+		return "", false
+	}
+	prefix = strings.TrimSuffix("/"+strings.Trim(prefix, "/"), "/") + "/"
+	return strings.CutPrefix(r.URL.EscapedPath(), prefix)
+}
+
 // serveImage handles incoming requests for proxied images.
 func (p *Proxy) serveImage(w http.ResponseWriter, r *http.Request) {
-	req, err := NewRequest(r, p.DefaultBaseURL)
+	req, err := p.newRequest(r)
 	if err != nil {
 		msg := fmt.Sprintf("invalid request URL: %v", err)
 		p.log(msg)
@@ -247,72 +509,74 @@ func (p *Proxy) serveImage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := p.allowed(req); err != nil {
-		p.logf("%s: %v", err, req)
-		http.Error(w, msgNotAllowed, http.StatusForbidden)
+		p.serveNotAllowed(w, req, err)
 		return
 	}
 
+	p.serveRequest(w, req)
+}
+
+// serveRequest serves the image request req, which must have already been
+// authorized.
+func (p *Proxy) serveRequest(w http.ResponseWriter, req *Request) {
+	r := req.Original
+
 	// assign static settings from proxy to req.Options
 	req.Options.ScaleUp = p.ScaleUp
-
-	actualReq, _ := http.NewRequest("GET", req.String(), nil)
-	if p.UserAgent != "" {
-		actualReq.Header.Set("User-Agent", p.UserAgent)
+	if p.ProgressiveJPEG && req.Options.transform() {
+		// only images that are already being transformed are
+		// re-encoded, so that original images are served unmodified.
+		req.Options.Progressive = true
 	}
-	if len(p.ContentTypes) != 0 {
-		actualReq.Header.Set("Accept", strings.Join(p.ContentTypes, ", "))
+
+	if req.Options.AutoFormat {
+		// The negotiated format is included in req.Options, and
+		// therefore in the cache key of the transformed image.
+		req.Options.Format = negotiateFormat(r.Header.Get("Accept"))
+		w.Header().Add("Vary", "Accept")
 	}
-	if p.IncludeReferer {
-		// pass along the referer header from the original request
-		copyHeader(actualReq.Header, r.Header, "referer")
+
+	if p.serveCachedFailure(w, req) {
+		return
 	}
-	if len(p.PassRequestHeaders) != 0 {
-		copyHeader(actualReq.Header, r.Header, p.PassRequestHeaders...)
+
+	resp, err := p.fetch(w, req, req.String())
+	var terr *transformError
+	if errors.As(err, &terr) {
+		p.log(terr)
+		p.cacheFailure(req.String(), terr.status(), terr.err.Error())
+		p.serveTransformError(w, req, terr)
+		return
 	}
-	if p.FollowRedirects {
-		// FollowRedirects is true (default), ensure that the redirected host is allowed
-		p.Client.CheckRedirect = func(newreq *http.Request, via []*http.Request) error {
-			if len(via) > maxRedirects {
-				if p.Verbose {
-					p.logf("followed too many redirects (%d).", len(via))
-				}
-				return errTooManyRedirects
-			}
-			if hostMatches(p.DenyHosts, newreq.URL) {
-				http.Error(w, msgNotAllowedInRedirect, http.StatusForbidden)
-				return errNotAllowed
-			}
-			return nil
-		}
-	} else {
-		// FollowRedirects is false, don't follow redirects
-		p.Client.CheckRedirect = func(newreq *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
+	if errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout) {
+		p.logf("error transforming image: %v", err)
+		if errors.Is(err, errQueueFull) {
+			metricTransformRejected.WithLabelValues("queue_full").Inc()
+		} else {
+			metricTransformRejected.WithLabelValues("timeout").Inc()
 		}
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "server is too busy, try again later", http.StatusServiceUnavailable)
+		return
 	}
-	resp, err := p.Client.Do(actualReq)
 	if err != nil {
-		msg := fmt.Sprintf("error fetching remote image: %v", err)
-		p.log(msg)
-		http.Error(w, msg, http.StatusInternalServerError)
-		metricRemoteErrors.Inc()
+		p.serveFetchError(w, req, err)
 		return
 	}
 	// close the original resp.Body, even if we wrap it in a NopCloser below
 	defer resp.Body.Close()
 
+	if p.serveRemoteError(w, req, resp) {
+		return
+	}
+
 	// return early on 404s.  Perhaps handle additional status codes here?
 	if resp.StatusCode == http.StatusNotFound {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
 
-	cached := resp.Header.Get(httpcache.XFromCache) == "1"
-	if p.Verbose {
-		p.logf("request: %+v (served from cache: %t)", *actualReq, cached)
-	}
-
-	if cached {
+	if resp.Header.Get(httpcache.XFromCache) == "1" {
 		metricServedFromCache.Inc()
 	}
 
@@ -323,24 +587,21 @@ func (p *Proxy) serveImage(w http.ResponseWriter, r *http.Request) {
 		copyHeader(w.Header(), resp.Header, p.PassResponseHeaders...)
 	}
 
+	if p.SurrogateKeys {
+		setSurrogateKeys(w.Header(), req)
+	}
+
 	if should304(r, resp) {
 		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
-	if contentType == "" || contentType == "application/octet-stream" || contentType == "binary/octet-stream" {
-		// try to detect content type
-		b := bufio.NewReader(resp.Body)
-		resp.Body = io.NopCloser(b)
-		contentType = peekContentType(b)
-	}
-	if resp.ContentLength != 0 && !contentTypeMatches(p.ContentTypes, contentType) {
-		p.logf("content-type not allowed: %q", contentType)
+	if err := p.authorizeResponse(req, resp); err != nil {
+		p.log(err)
 		http.Error(w, msgNotAllowed, http.StatusForbidden)
 		return
 	}
-	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
 
 	copyHeader(w.Header(), resp.Header, "Content-Length")
 
@@ -362,6 +623,126 @@ func (p *Proxy) serveImage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// serveFetchError responds to req with the error err returned when
+// fetching the remote image, or with a matching fallback image.  Connection
+// errors are cached as failures.
+func (p *Proxy) serveFetchError(w http.ResponseWriter, req *Request, err error) {
+	msg := fmt.Sprintf("error fetching remote image: %v", err)
+	p.log(msg)
+	metricRemoteErrors.Inc()
+	if negativeFetchError(err) {
+		p.cacheFetchError(req.URL.String(), msg)
+	}
+	// denied redirects have already been responded to by fetch
+	if errors.Is(err, errNotAllowed) || !p.serveFallback(w, req, http.StatusBadGateway) {
+		http.Error(w, msg, http.StatusInternalServerError)
+	}
+}
+
+// serveRemoteError caches the remote response resp as a failure if its
+// status code calls for it, and serves a matching fallback image for error
+// responses.  It reports whether a fallback was served.
+func (p *Proxy) serveRemoteError(w http.ResponseWriter, req *Request, resp *http.Response) bool {
+	if negativeStatus(resp.StatusCode) {
+		p.cacheFailure(req.URL.String(), resp.StatusCode, "")
+	}
+	return resp.StatusCode >= 400 && p.serveFallback(w, req, resp.StatusCode)
+}
+
+// serveTransformError responds to req with the error err, or with
+// p.TransformErrorImage if the TransformErrorFallback policy is used.
+func (p *Proxy) serveTransformError(w http.ResponseWriter, req *Request, err *transformError) {
+	code := err.status()
+	w.Header().Set("X-Imageproxy-Error", err.err.Error())
+
+	if p.TransformErrorPolicy == TransformErrorFallback && p.TransformErrorImage != nil {
+		ferr := p.serveErrorImage(w, req, p.TransformErrorImage, code, "no-store")
+		if ferr == nil {
+			metricTransformErrors.WithLabelValues(TransformErrorFallback).Inc()
+			return
+		}
+		p.logf("error transforming fallback image: %v", ferr)
+	}
+
+	metricTransformErrors.WithLabelValues(TransformErrorStatus).Inc()
+	http.Error(w, err.Error(), code)
+}
+
+// fetch requests the remote URL u on behalf of req using p.Client.  If a
+// redirect to a denied host is encountered, an error response is written to
+// w.
+func (p *Proxy) fetch(w http.ResponseWriter, req *Request, u string) (*http.Response, error) {
+	r := req.Original
+
+	actualReq, _ := http.NewRequest("GET", u, nil)
+	if p.UserAgent != "" {
+		actualReq.Header.Set("User-Agent", p.UserAgent)
+	}
+	if len(p.ContentTypes) != 0 {
+		actualReq.Header.Set("Accept", strings.Join(p.ContentTypes, ", "))
+	}
+	if p.IncludeReferer {
+		// pass along the referer header from the original request
+		copyHeader(actualReq.Header, r.Header, "referer")
+	}
+	if len(p.PassRequestHeaders) != 0 {
+		copyHeader(actualReq.Header, r.Header, p.PassRequestHeaders...)
+	}
+	if p.FollowRedirects {
+		// FollowRedirects is true (default), ensure that the redirected host is allowed
+		p.Client.CheckRedirect = func(newreq *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				if p.Verbose {
+					p.logf("followed too many redirects (%d).", len(via))
+				}
+				return errTooManyRedirects
+			}
+			if hostMatches(p.DenyHosts, newreq.URL) {
+				http.Error(w, msgNotAllowedInRedirect, http.StatusForbidden)
+				return errNotAllowed
+			}
+			return nil
+		}
+	} else {
+		// FollowRedirects is false, don't follow redirects
+		p.Client.CheckRedirect = func(newreq *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	resp, err := p.Client.Do(actualReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Verbose {
+		cached := resp.Header.Get(httpcache.XFromCache) == "1"
+		p.logf("request: %+v (served from cache: %t)", *actualReq, cached)
+	}
+	return resp, nil
+}
+
+// authorizeResponse returns an error if resp should not be returned to the
+// client, as determined by the registered ResponseAuthorizer plugins.  If
+// the remote server did not provide a meaningful Content-Type header, the
+// content type is first detected from resp.Body and the header updated.
+func (p *Proxy) authorizeResponse(req *Request, resp *http.Response) error {
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if contentType == "" || contentType == "application/octet-stream" || contentType == "binary/octet-stream" {
+		// try to detect content type
+		b := bufio.NewReader(resp.Body)
+		resp.Body = io.NopCloser(b)
+		contentType = peekContentType(b)
+	}
+	resp.Header.Set("Content-Type", contentType)
+
+	for _, a := range pluginsImplementing[ResponseAuthorizer]() {
+		if err := a.AuthorizeResponse(p, req, resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // peekContentType peeks at the first 512 bytes of p, and attempts to detect
 // the content type.  Returns empty string if error occurs.
 func peekContentType(p *bufio.Reader) string {
@@ -369,9 +750,31 @@ func peekContentType(p *bufio.Reader) string {
 	if err != nil && !errors.Is(err, bufio.ErrBufferFull) && !errors.Is(err, io.EOF) {
 		return ""
 	}
+	// http.DetectContentType only detects avif images with the "avif"
+	// major brand, and not heic
+	brand := heifBrand(byt)
+	if brand == "avif" || brand == "avis" {
+		return "image/avif"
+	}
+	if typ, ok := heifBrands[brand]; ok {
+		return typ
+	}
 	return http.DetectContentType(byt)
 }
 
+// reencodedContentTypes are the content types of remote images that are
+// encoded in a different format by default when transformed.
+var reencodedContentTypes = map[string]bool{
+	"image/avif":          true,
+	"image/heic":          true,
+	"image/heic-sequence": true,
+	"image/heif":          true,
+	"image/heif-sequence": true,
+	"image/svg+xml":       true,
+	"image/tiff":          true,
+	"image/webp":          true,
+}
+
 // copyHeader copies values for specified headers from src to dst, adding to
 // any existing values with the same header name.
 func copyHeader(dst, src http.Header, headerNames ...string) {
@@ -403,22 +806,57 @@ func (p *Proxy) now() time.Time {
 
 // allowed determines whether the specified request contains an allowed
 // referrer, host, and signature.  It returns an error if the request is not
-// allowed or not valid any longer.
+// allowed or not valid any longer.  Each registered RequestAuthorizer is
+// consulted in turn, and the first error returned is used.
 func (p *Proxy) allowed(r *Request) error {
+	for _, a := range pluginsImplementing[RequestAuthorizer]() {
+		if err := a.AuthorizeRequest(p, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validUntilAuthorizer rejects requests whose ValidUntil option has passed.
+type validUntilAuthorizer struct{}
+
+func (validUntilAuthorizer) AuthorizeRequest(p *Proxy, r *Request) error {
 	if !r.Options.ValidUntil.IsZero() {
 		if !p.now().Before(r.Options.ValidUntil) {
 			return errNotValid
 		}
 	}
+	return nil
+}
 
+// referrerAuthorizer rejects requests that do not come from one of
+// p.Referrers, if any are specified.
+type referrerAuthorizer struct{}
+
+func (referrerAuthorizer) AuthorizeRequest(p *Proxy, r *Request) error {
 	if len(p.Referrers) > 0 && !referrerMatches(p.Referrers, r.Original) {
 		return errReferrer
 	}
+	return nil
+}
+
+// denyHostsAuthorizer rejects requests for remote URLs on one of
+// p.DenyHosts.
+type denyHostsAuthorizer struct{}
 
+func (denyHostsAuthorizer) AuthorizeRequest(p *Proxy, r *Request) error {
 	if hostMatches(p.DenyHosts, r.URL) {
 		return errDeniedHost
 	}
+	return nil
+}
+
+// allowHostsAuthorizer rejects requests that are neither for a remote URL on
+// one of p.AllowHosts nor signed with one of p.SignatureKeys.  If neither
+// are specified, all requests are allowed.
+type allowHostsAuthorizer struct{}
 
+func (allowHostsAuthorizer) AuthorizeRequest(p *Proxy, r *Request) error {
 	if len(p.AllowHosts) == 0 && len(p.SignatureKeys) == 0 {
 		return nil // no allowed hosts or signature key, all requests accepted
 	}
@@ -436,6 +874,81 @@ func (p *Proxy) allowed(r *Request) error {
 	return errNotAllowed
 }
 
+// contentTypeAuthorizer rejects non-empty responses whose content type does
+// not match one of p.ContentTypes, if any are specified.
+type contentTypeAuthorizer struct{}
+
+func (contentTypeAuthorizer) AuthorizeResponse(p *Proxy, _ *Request, resp *http.Response) error {
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.ContentLength != 0 && !contentTypeMatches(p.ContentTypes, contentType) {
+		return fmt.Errorf("content-type not allowed: %q", contentType)
+	}
+	return nil
+}
+
+// autoFormats lists the formats that may be chosen for requests with the
+// AutoFormat option, in order of preference, along with their content types.
+var autoFormats = []struct{ format, contentType string }{
+	{optFormatWEBP, "image/webp"},
+	{optFormatJPEG, "image/jpeg"},
+	{optFormatPNG, "image/png"},
+}
+
+// negotiateFormat returns the most preferred format in autoFormats that is
+// acceptable according to the Accept header value accept.  If accept is
+// empty or none of the formats are acceptable, an empty string is returned.
+func negotiateFormat(accept string) string {
+	if accept == "" {
+		return ""
+	}
+
+	var best string
+	var bestQ float64
+	for _, f := range autoFormats {
+		if q := acceptQuality(accept, f.contentType); q > bestQ {
+			best, bestQ = f.format, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the quality value given to contentType by the Accept
+// header value accept, using the most specific matching media range.
+func acceptQuality(accept, contentType string) float64 {
+	typ, _, _ := strings.Cut(contentType, "/")
+
+	var q float64
+	specificity := 0
+	for _, r := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(r)
+		if err != nil {
+			continue
+		}
+
+		var s int
+		switch mediaRange {
+		case contentType:
+			s = 3
+		case typ + "/*":
+			s = 2
+		case "*/*":
+			s = 1
+		default:
+			continue
+		}
+		if s <= specificity {
+			continue
+		}
+
+		specificity = s
+		q = 1
+		if v, ok := params["q"]; ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+	}
+	return q
+}
+
 // contentTypeMatches returns whether contentType matches one of the allowed patterns.
 func contentTypeMatches(patterns []string, contentType string) bool {
 	if len(patterns) == 0 {
@@ -517,6 +1030,14 @@ func validSignature(key []byte, r *Request) bool {
 	return hmac.Equal(got, want)
 }
 
+// urlSignature returns the signature of the remote URL u using key, which
+// is accepted by validSignature for requests for u with any options.
+func urlSignature(key []byte, u *url.URL) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(u.String()))
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
 // should304 returns whether we should send a 304 Not Modified in response to
 // req, based on the response resp.  This is determined using the last modified
 // time and the entity tag of resp.
@@ -579,63 +1100,330 @@ type TransformingTransport struct {
 	log func(format string, v ...any)
 
 	updateCacheHeaders func(hdr http.Header)
+
+	// limits returns the limits on images being transformed.  If nil,
+	// the default Limits are used.
+	limits func() Limits
+
+	// errorPolicy returns the policy for handling images that cannot be
+	// transformed.  If nil, TransformErrorOriginal is used.
+	errorPolicy func() string
+
+	// queueLimits returns the limits on requests waiting for images to be
+	// transformed.  If nil, there are no limits.
+	queueLimits func() queueLimits
+
+	// timeout returns the time limit for fetches and transformations
+	// shared by coalesced requests.  If nil or zero,
+	// defaultCoalesceTimeout is used.
+	timeout func() time.Duration
+
+	queue transformQueue
+
+	// fetches and transforms coalesce concurrent identical requests
+	fetches, transforms singleflight.Group
+}
+
+// transformError is returned by TransformingTransport for images that could
+// not be transformed and should not be served untransformed.
+type transformError struct {
+	err error
+}
+
+func (e *transformError) Error() string {
+	return "error transforming image: " + e.err.Error()
+}
+
+func (e *transformError) Unwrap() error {
+	return e.err
+}
+
+// status returns the HTTP status code of responses for e.
+func (e *transformError) status() int {
+	if code := cachedFailureStatus(e.err); code != 0 {
+		return code
+	}
+	if code := limitStatus(e.err); code != 0 {
+		return code
+	}
+	if errors.Is(e.err, errDecodeImage) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
 }
 
+// defaultCoalesceTimeout is the default time limit for fetches and
+// transformations shared by coalesced requests.
+const defaultCoalesceTimeout = time.Minute
+
 // RoundTrip implements the http.RoundTripper interface.
 func (t *TransformingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Concurrent identical requests are coalesced, so that only one of
+	// them fetches the remote image or transforms it.
 	if req.URL.Fragment == "" {
-		// normal requests pass through
-		if t.log != nil {
-			t.log("fetching remote URL: %v", req.URL)
+		// Only fetches of images to be transformed are buffered and
+		// shared, since they are read in full anyway.  Other requests
+		// pass through.
+		maxBytes, ok := req.Context().Value(transformFetchKey{}).(int64)
+		if !ok {
+			return t.fetch(req)
 		}
-		resp, err := t.Transport.RoundTrip(req)
-		if err == nil && t.updateCacheHeaders != nil {
-			t.updateCacheHeaders(resp.Header)
+		v, err := t.coalesce(&t.fetches, "fetch", req, func(req *http.Request) (any, error) {
+			return t.fetchBuffered(req, maxBytes)
+		})
+		if err != nil {
+			return nil, err
 		}
-		return resp, err
+		return v.(*fetchedResponse).response(req), nil
 	}
 
-	f := req.URL.Fragment
-	req.URL.Fragment = ""
-	resp, err := t.CachingClient.Do(req)
-	req.URL.Fragment = f
+	if !ParseOptions(req.URL.Fragment).transform() {
+		return t.passthrough(req)
+	}
+
+	v, err := t.coalesce(&t.transforms, "transform", req, func(req *http.Request) (any, error) {
+		return t.transform(req)
+	})
 	if err != nil {
 		return nil, err
 	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(v.([]byte))), req)
+}
+
+// coalesce calls fn for req in g, unless an identical request is already in
+// progress, in which case it waits for the result of that call instead.  fn
+// is called with a copy of req that is not canceled along with req, so that
+// the shared result is not lost if the first request goes away, and that is
+// instead limited by t.timeout.  Each request stops waiting when its own
+// context is done.
+func (t *TransformingTransport) coalesce(g *singleflight.Group, layer string, req *http.Request, fn func(*http.Request) (any, error)) (any, error) {
+	timeout := defaultCoalesceTimeout
+	if t.timeout != nil && t.timeout() > 0 {
+		timeout = t.timeout()
+	}
 
+	var leader bool
+	ch := g.DoChan(coalesceKey(req), func() (any, error) {
+		leader = true
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), timeout)
+		defer cancel()
+		return fn(req.WithContext(ctx))
+	})
+
+	select {
+	case res := <-ch:
+		if !leader {
+			metricCoalescedRequests.WithLabelValues(layer).Inc()
+		}
+		return res.Val, res.Err
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
+// coalesceKey returns the key identifying requests that are identical to
+// req, made up of its method, URL including any transformation options in the
+// fragment, and headers.
+func coalesceKey(req *http.Request) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s\n", req.Method, req.URL)
+	_ = req.Header.Write(&b)
+	return b.String()
+}
+
+// fetchedResponse is a remote response whose body has been read, so that it
+// can be shared by coalesced requests.
+type fetchedResponse struct {
+	resp *http.Response
+	body []byte
+}
+
+// response returns a copy of the fetched response for req.
+func (f *fetchedResponse) response(req *http.Request) *http.Response {
+	resp := *f.resp
+	resp.Header = f.resp.Header.Clone()
+	resp.Body = io.NopCloser(bytes.NewReader(f.body))
+	resp.Request = req
+	return &resp
+}
+
+// transformFetchKey is the context key of requests made by
+// TransformingTransport to fetch images to be transformed.  Its value is the
+// maximum number of bytes to read, or zero for no limit.
+type transformFetchKey struct{}
+
+// fetch fetches the remote resource for req using t.Transport.
+func (t *TransformingTransport) fetch(req *http.Request) (*http.Response, error) {
+	if t.log != nil {
+		t.log("fetching remote URL: %v", req.URL)
+	}
+	resp, err := t.Transport.RoundTrip(req)
+	if err == nil && t.updateCacheHeaders != nil {
+		t.updateCacheHeaders(resp.Header)
+	}
+	return resp, err
+}
+
+// fetchBuffered fetches the remote image for req using t.Transport and reads
+// its body, so that it can be shared.  If maxBytes is positive, images larger
+// than maxBytes are not read, and an error is returned.
+func (t *TransformingTransport) fetchBuffered(req *http.Request, maxBytes int64) (*fetchedResponse, error) {
+	resp, err := t.fetch(req)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 
+	var body io.Reader = resp.Body
+	if maxBytes > 0 {
+		if resp.ContentLength > maxBytes {
+			return nil, &transformError{fmt.Errorf("%w: %d bytes", errInputTooLarge, resp.ContentLength)}
+		}
+		body = io.LimitReader(resp.Body, maxBytes+1)
+	}
+
+	// count the body against the memory available for transformations
+	// while it is read, so that buffered images are bounded too.
+	size := resp.ContentLength
+	if size < 0 {
+		size = maxBytes
+	}
+	qlimits, timeout, stop := t.queueWait()
+	defer stop()
+	release, err := t.queue.reserveMemory(req.Context(), size, qlimits, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if maxBytes > 0 && int64(len(b)) > maxBytes {
+		return nil, &transformError{fmt.Errorf("%w: more than %d bytes", errInputTooLarge, maxBytes)}
+	}
+	return &fetchedResponse{resp: resp, body: b}, nil
+}
+
+// queueWait returns the limits on requests waiting for images to be
+// transformed, and a channel that fires once a request has waited for the
+// maximum time.  The returned function stops its timer.
+func (t *TransformingTransport) queueWait() (queueLimits, <-chan time.Time, func()) {
+	var qlimits queueLimits
+	if t.queueLimits != nil {
+		qlimits = t.queueLimits()
+	}
+	if qlimits.maxWait <= 0 {
+		return qlimits, nil, func() {}
+	}
+	timer := time.NewTimer(qlimits.maxWait)
+	return qlimits, timer.C, func() { timer.Stop() }
+}
+
+// passthrough fetches the remote image for req using t.CachingClient, and
+// returns it untransformed without reading its body.
+func (t *TransformingTransport) passthrough(req *http.Request) (*http.Response, error) {
+	freq := req.Clone(req.Context())
+	freq.URL.Fragment = ""
+	resp, err := t.CachingClient.Do(freq)
+	if err != nil {
+		return nil, err
+	}
+
 	if should304(req, resp) {
 		// bare 304 response, full response will be used from cache
+		resp.Body.Close()
 		return &http.Response{
 			Proto:      "HTTP/1.1",
 			ProtoMajor: 1,
 			ProtoMinor: 1,
 			Status:     fmt.Sprintf("%d %s", http.StatusNotModified, http.StatusText(http.StatusNotModified)),
 			StatusCode: http.StatusNotModified,
+			Header:     make(http.Header),
 			Body:       http.NoBody,
+			Request:    req,
 		}, nil
 	}
+	return resp, nil
+}
 
-	// enforce limiter after we've checked if we can early return a 304 response,
-	// but before we read the response body and perform transformations.
+// transform fetches the remote image for req using t.CachingClient and
+// transforms it using the options in the URL fragment of req.  It returns
+// the raw HTTP response for the transformed image.
+func (t *TransformingTransport) transform(req *http.Request) ([]byte, error) {
+	var limits Limits
+	if t.limits != nil {
+		limits = t.limits()
+	}
+	opt := ParseOptions(req.URL.Fragment)
+
+	qlimits, timeout, stop := t.queueWait()
+	defer stop()
+
+	// enforce limiter before the remote image is fetched and read, so that
+	// the images of requests waiting to be transformed are not buffered.
 	if t.limiter != nil {
-		t.limiter <- struct{}{}
-		defer func() {
-			<-t.limiter
-		}()
+		release, err := t.queue.acquireSlot(req.Context(), t.limiter, qlimits, timeout)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
 	}
 
-	b, err := io.ReadAll(resp.Body)
+	ctx := context.WithValue(req.Context(), transformFetchKey{}, limits.MaxInputBytes)
+	freq := req.Clone(ctx)
+	freq.URL.Fragment = ""
+	resp, err := t.CachingClient.Do(freq)
 	if err != nil {
 		return nil, err
 	}
 
-	opt := ParseOptions(req.URL.Fragment)
+	defer resp.Body.Close()
+
+	if should304(req, resp) {
+		// bare 304 response, full response will be used from cache
+		return []byte("HTTP/1.1 304 Not Modified\r\n\r\n"), nil
+	}
+
+	var body io.Reader = resp.Body
+	if limits.MaxInputBytes > 0 && opt.transform() {
+		if resp.ContentLength > limits.MaxInputBytes {
+			return nil, &transformError{fmt.Errorf("%w: %d bytes", errInputTooLarge, resp.ContentLength)}
+		}
+		// read one byte past the limit, so that TransformWithLimits can
+		// tell that the limit has been exceeded.
+		body = io.LimitReader(resp.Body, limits.MaxInputBytes+1)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
 
-	img, err := Transform(b, opt)
+	if opt.transform() {
+		release, err := t.queue.reserveMemory(req.Context(), decodedSize(b), qlimits, timeout)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	img, err := TransformWithLimits(b, opt, limits)
 	if err != nil {
+		var policy string
+		if t.errorPolicy != nil {
+			policy = t.errorPolicy()
+		}
+		// only successful responses are subject to the error policy,
+		// since other responses are not expected to be images.
+		if limitStatus(err) != 0 || resp.StatusCode == http.StatusOK &&
+			policy != "" && policy != TransformErrorOriginal {
+			return nil, &transformError{err}
+		}
 		log.Printf("error transforming image %s: %v", req.URL.String(), err)
+		if resp.StatusCode == http.StatusOK {
+			metricTransformErrors.WithLabelValues(TransformErrorOriginal).Inc()
+		}
 		img = b
 	}
 
@@ -645,12 +1433,12 @@ func (t *TransformingTransport) RoundTrip(req *http.Request) (*http.Response, er
 	if err := resp.Header.WriteSubset(buf, map[string]bool{
 		"Content-Length": true,
 		// exclude Content-Type header if the format may have changed during transformation
-		"Content-Type": opt.Format != "" || resp.Header.Get("Content-Type") == "image/webp" || resp.Header.Get("Content-Type") == "image/tiff",
+		"Content-Type": opt.Format != "" || reencodedContentTypes[resp.Header.Get("Content-Type")],
 	}); err != nil {
 		t.log("error copying headers: %v", err)
 	}
 	fmt.Fprintf(buf, "Content-Length: %d\n\n", len(img))
 	buf.Write(img)
 
-	return http.ReadResponse(bufio.NewReader(buf), req)
+	return buf.Bytes(), nil
 }
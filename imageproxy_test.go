@@ -6,11 +6,13 @@ package imageproxy
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"image"
 	"image/png"
+	"io"
 	"log"
 	"maps"
 	"net/http"
@@ -21,7 +23,10 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/synctest"
 	"time"
 
 	"github.com/die-net/lrucache"
@@ -42,6 +47,31 @@ func TestPeekContentType(t *testing.T) {
 	if want := "application/octet-stream"; got != want {
 		t.Errorf("peekContentType returned %v, want %v", got, want)
 	}
+
+	// heif file type boxes
+	for brand, want := range map[string]string{
+		"heic": "image/heic",
+		"heix": "image/heic",
+		"hevc": "image/heic-sequence",
+		"mif1": "image/heif",
+		"msf1": "image/heif-sequence",
+	} {
+		got = peekContentType(bufio.NewReader(bytes.NewReader([]byte("\x00\x00\x00\x18ftyp" + brand + "\x00\x00\x00\x00mif1heic"))))
+		if got != want {
+			t.Errorf("peekContentType of %q brand returned %v, want %v", brand, got, want)
+		}
+	}
+	// avif images with a generic major brand
+	for brand, want := range map[string]string{
+		"avif": "image/avif",
+		"avis": "image/avif",
+		"heic": "image/heif",
+	} {
+		got = peekContentType(bufio.NewReader(bytes.NewReader([]byte("\x00\x00\x00\x1cftypmif1\x00\x00\x00\x00mif1miaf" + brand))))
+		if got != want {
+			t.Errorf("peekContentType of %q compatible brand returned %v, want %v", brand, got, want)
+		}
+	}
 }
 
 func TestCopyHeader(t *testing.T) {
@@ -406,6 +436,7 @@ func TestProxy_UpdateCacheHeaders(t *testing.T) {
 		name        string
 		minDuration time.Duration
 		forceCache  bool
+		swr, sie    time.Duration // stale-while-revalidate and stale-if-error
 		headers     http.Header
 		want        http.Header
 	}{
@@ -533,6 +564,43 @@ func TestProxy_UpdateCacheHeaders(t *testing.T) {
 				"Cache-Control": {"max-age=3600"},
 			},
 		},
+		{
+			name: "stale durations",
+			swr:  time.Minute,
+			sie:  time.Hour,
+			headers: http.Header{
+				"Date":          {date},
+				"Expires":       {exp},
+				"Cache-Control": {"max-age=600"},
+			},
+			want: http.Header{
+				"Date":          {date},
+				"Expires":       {exp},
+				"Cache-Control": {"max-age=600, stale-if-error=3600, stale-while-revalidate=60"},
+			},
+		},
+		{
+			name:        "stale durations exceeded by header, min duration",
+			minDuration: 30 * time.Second,
+			swr:         time.Minute,
+			sie:         time.Hour,
+			headers: http.Header{
+				"Cache-Control": {"stale-while-revalidate=600"},
+			},
+			want: http.Header{
+				"Cache-Control": {"max-age=30, stale-if-error=3600, stale-while-revalidate=600"},
+			},
+		},
+		{
+			name: "stale durations, no-store",
+			swr:  time.Minute,
+			headers: http.Header{
+				"Cache-Control": {"no-store"},
+			},
+			want: http.Header{
+				"Cache-Control": {"no-store"},
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -540,6 +608,8 @@ func TestProxy_UpdateCacheHeaders(t *testing.T) {
 			p := &Proxy{
 				MinimumCacheDuration: tt.minDuration,
 				ForceCache:           tt.forceCache,
+				StaleWhileRevalidate: tt.swr,
+				StaleIfError:         tt.sie,
 			}
 			hdr := maps.Clone(tt.headers)
 			p.updateCacheHeaders(hdr)
@@ -769,6 +839,355 @@ func TestTransformingTransport(t *testing.T) {
 	}
 }
 
+// blockingTransport is a RoundTripper that counts requests and blocks them
+// until release is closed.
+type blockingTransport struct {
+	http.RoundTripper
+	release chan struct{}
+	count   atomic.Int32
+}
+
+func (t *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.count.Add(1)
+	<-t.release
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func TestTransformingTransport_Coalesce(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		bt := &blockingTransport{RoundTripper: &testTransport{}, release: make(chan struct{})}
+		client := new(http.Client)
+		tr := &TransformingTransport{
+			Transport:     bt,
+			CachingClient: client,
+			// one slot for each set of options, which are
+			// transformed concurrently
+			limiter: make(chan struct{}, 2),
+		}
+		client.Transport = tr
+
+		// requests for the same image with two different sets of options
+		urls := []string{
+			"http://good.test/png#1x2", "http://good.test/png#1x2", "http://good.test/png#1x2",
+			"http://good.test/png#2x1", "http://good.test/png#2x1",
+		}
+		var wg sync.WaitGroup
+		for _, u := range urls {
+			wg.Go(func() {
+				req, _ := http.NewRequest("GET", u, nil)
+				resp, err := tr.RoundTrip(req)
+				if err != nil {
+					t.Errorf("RoundTrip(%v) returned unexpected error: %v", u, err)
+					return
+				}
+				defer resp.Body.Close()
+				if _, err := png.DecodeConfig(resp.Body); err != nil {
+					t.Errorf("RoundTrip(%v) returned invalid image: %v", u, err)
+				}
+			})
+		}
+
+		// wait for all requests to be blocked before releasing them
+		synctest.Wait()
+		close(bt.release)
+		wg.Wait()
+
+		if got, want := bt.count.Load(), int32(1); got != want {
+			t.Errorf("remote image fetched %d times, want %d", got, want)
+		}
+	})
+}
+
+func TestTransformingTransport_CoalesceCanceled(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		bt := &blockingTransport{RoundTripper: &testTransport{}, release: make(chan struct{})}
+		client := new(http.Client)
+		tr := &TransformingTransport{
+			Transport:     bt,
+			CachingClient: client,
+			limiter:       make(chan struct{}, 1),
+		}
+		client.Transport = tr
+
+		const u = "http://good.test/png#1x2"
+		ctx, cancel := context.WithCancel(context.Background())
+		leaderErr := make(chan error)
+		go func() {
+			req, _ := http.NewRequestWithContext(ctx, "GET", u, nil)
+			_, err := tr.RoundTrip(req)
+			leaderErr <- err
+		}()
+		synctest.Wait()
+
+		var followerErr error
+		var follower sync.WaitGroup
+		follower.Go(func() {
+			req, _ := http.NewRequest("GET", u, nil)
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				followerErr = err
+				return
+			}
+			defer resp.Body.Close()
+			_, followerErr = png.DecodeConfig(resp.Body)
+		})
+		synctest.Wait()
+
+		// the first request goes away while the remote image is fetched
+		cancel()
+		if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+			t.Errorf("canceled RoundTrip returned error %v, want %v", err, context.Canceled)
+		}
+
+		close(bt.release)
+		follower.Wait()
+		if followerErr != nil {
+			t.Errorf("coalesced RoundTrip returned unexpected error: %v", followerErr)
+		}
+		if got, want := bt.count.Load(), int32(1); got != want {
+			t.Errorf("remote image fetched %d times, want %d", got, want)
+		}
+	})
+}
+
+func TestCoalesceKey(t *testing.T) {
+	req := func(u string, hdr ...string) *http.Request {
+		r, _ := http.NewRequest("GET", u, nil)
+		for i := 0; i < len(hdr); i += 2 {
+			r.Header.Add(hdr[i], hdr[i+1])
+		}
+		return r
+	}
+
+	tests := []struct {
+		a, b *http.Request
+		same bool
+	}{
+		{req("http://a.test/"), req("http://a.test/"), true},
+		{req("http://a.test/#1x2"), req("http://a.test/#1x2"), true},
+		{req("http://a.test/#1x2"), req("http://a.test/#2x1"), false},
+		{req("http://a.test/"), req("http://b.test/"), false},
+		{req("http://a.test/", "A", "1", "B", "2"), req("http://a.test/", "B", "2", "A", "1"), true},
+		{req("http://a.test/", "Referer", "x"), req("http://a.test/", "Referer", "y"), false},
+	}
+
+	for _, tt := range tests {
+		if got := coalesceKey(tt.a) == coalesceKey(tt.b); got != tt.same {
+			t.Errorf("coalesceKey(%v) == coalesceKey(%v) is %t, want %t", tt.a.URL, tt.b.URL, got, tt.same)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"text/html", ""},
+		{"*/*", "webp"},
+		{"image/*", "webp"},
+		{"image/png", "png"},
+		{"image/jpeg,image/png", "jpeg"},
+		{"image/jpeg;q=0.5,image/png", "png"},
+		{"image/*;q=0.8,image/webp;q=0,image/jpeg;q=0", "png"},
+		{"image/webp;q=0,image/jpeg;q=0,*/*", "png"},
+		{"image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", "webp"},
+		{"image/png,image/svg+xml,image/*;q=0.8,*/*;q=0.5", "png"},
+	}
+
+	for _, tt := range tests {
+		if got := negotiateFormat(tt.accept); got != tt.want {
+			t.Errorf("negotiateFormat(%q) returned %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_AutoFormat(t *testing.T) {
+	p := &Proxy{
+		Client: &http.Client{
+			Transport: &testTransport{},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/auto/http://good.test/png", nil)
+	req.Header.Set("Accept", "image/png")
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("ServeHTTP(%v) returned status %d, want %d", req, got, want)
+	}
+	if got, want := resp.Header().Get("Vary"), "Accept"; got != want {
+		t.Errorf("ServeHTTP(%v) returned Vary header %q, want %q", req, got, want)
+	}
+}
+
+// optionsTransport records the options of the last request it handles,
+// which are encoded in the request URL fragment.
+type optionsTransport struct {
+	testTransport
+	options string
+}
+
+func (t *optionsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.options = req.URL.Fragment
+	return t.testTransport.RoundTrip(req)
+}
+
+func TestProxy_ServeHTTP_ProgressiveJPEG(t *testing.T) {
+	transport := new(optionsTransport)
+	p := &Proxy{
+		Client:          &http.Client{Transport: transport},
+		ProgressiveJPEG: true,
+	}
+
+	tests := []struct {
+		url     string
+		options string // expected options of the remote request
+	}{
+		{"http://localhost/100/http://good.test/png", "100x100,progressive"},
+		{"http://localhost/http://good.test/png", "0x0"}, // not transformed
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := transport.options, tt.options; got != want {
+			t.Errorf("ServeHTTP(%v) requested options %q, want %q", tt.url, got, want)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_Limits(t *testing.T) {
+	tests := []struct {
+		url  string
+		init func(*Proxy)
+		code int // expected response status code
+	}{
+		{"/100/http://good.test/png", func(p *Proxy) { p.MaxInputBytes = 10 }, http.StatusRequestEntityTooLarge},
+		{"/http://good.test/png", func(p *Proxy) { p.MaxInputBytes = 10 }, http.StatusOK}, // not transformed
+		{"/100/http://good.test/png", func(p *Proxy) { p.MaxInputBytes = 1000 }, http.StatusOK},
+		{"/100/http://good.test/png", func(p *Proxy) { p.MaxOutputWidth = 50 }, http.StatusUnprocessableEntity},
+		{"/100/http://good.test/png", func(p *Proxy) { p.MaxOutputHeight = 100 }, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		p := NewProxy(&testTransport{}, nil)
+		p.AllowHosts = []string{"good.test"}
+		p.ScaleUp = true
+		tt.init(p)
+
+		req := httptest.NewRequest("GET", "http://localhost"+tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%v) returned status %d, want %d", tt.url, got, want)
+		}
+	}
+}
+
+// largeTransport responds to every request with a body of unknown length
+// larger than any limit, and records how many bytes of it were read.
+type largeTransport struct {
+	read atomic.Int64
+}
+
+func (t *largeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := &countingReader{r: io.LimitReader(zeroReader{}, 50<<20), n: &t.read}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"image/png"}},
+		ContentLength: -1,
+		Body:          io.NopCloser(body),
+	}, nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+func TestProxy_ServeHTTP_MaxInputBytes(t *testing.T) {
+	const max = 1 << 20
+	transport := new(largeTransport)
+	p := NewProxy(transport, nil)
+	p.MaxInputBytes = max
+
+	req := httptest.NewRequest("GET", "http://localhost/100/http://good.test/large", nil)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	if got, want := resp.Code, http.StatusRequestEntityTooLarge; got != want {
+		t.Errorf("ServeHTTP(%v) returned status %d, want %d", req.URL, got, want)
+	}
+	// allow for one extra buffer of reads past the limit
+	if got := transport.read.Load(); got > max+64<<10 {
+		t.Errorf("ServeHTTP(%v) read %d bytes of remote image, want at most %d", req.URL, got, max)
+	}
+}
+
+func TestProxy_ServeHTTP_TransformErrors(t *testing.T) {
+	fallback := new(bytes.Buffer)
+	_ = png.Encode(fallback, image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+
+	tests := []struct {
+		url         string
+		policy      string
+		image       []byte
+		code        int    // expected response status code
+		contentType string // expected content type
+	}{
+		{"/100/http://good.test/plain", "", nil, http.StatusOK, ""},
+		{"/100/http://good.test/plain", TransformErrorOriginal, nil, http.StatusOK, ""},
+		{"/100/http://good.test/plain", TransformErrorStatus, nil, http.StatusUnprocessableEntity, "text/plain; charset=utf-8"},
+		{"/100/http://good.test/plain", TransformErrorFallback, fallback.Bytes(), http.StatusUnprocessableEntity, "image/png"},
+		{"/100/http://good.test/plain", TransformErrorFallback, nil, http.StatusUnprocessableEntity, "text/plain; charset=utf-8"},
+		{"/http://good.test/plain", TransformErrorStatus, nil, http.StatusOK, ""},                // not transformed
+		{"/100/http://good.test/nocontent", TransformErrorStatus, nil, http.StatusNoContent, ""}, // not an image response
+		{"/100/http://good.test/png", TransformErrorStatus, nil, http.StatusOK, "image/png"},
+	}
+
+	for _, tt := range tests {
+		p := NewProxy(&testTransport{}, nil)
+		p.AllowHosts = []string{"good.test"}
+		p.TransformErrorPolicy = tt.policy
+		p.TransformErrorImage = tt.image
+
+		req := httptest.NewRequest("GET", "http://localhost"+tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%v) with policy %q returned status %d, want %d", tt.url, tt.policy, got, want)
+		}
+		if tt.contentType != "" {
+			if got, want := resp.Header().Get("Content-Type"), tt.contentType; got != want {
+				t.Errorf("ServeHTTP(%v) with policy %q returned content type %q, want %q", tt.url, tt.policy, got, want)
+			}
+		}
+		if got, want := resp.Header().Get("X-Imageproxy-Error") != "", resp.Code == http.StatusUnprocessableEntity; got != want {
+			t.Errorf("ServeHTTP(%v) with policy %q returned X-Imageproxy-Error header %q", tt.url, tt.policy, resp.Header().Get("X-Imageproxy-Error"))
+		}
+	}
+}
+
 func TestContentTypeMatches(t *testing.T) {
 	tests := []struct {
 		patterns    []string
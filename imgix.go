@@ -0,0 +1,146 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// newImgixRequest parses an http.Request that uses imgix URL syntax into an
+// imageproxy Request.  path is the escaped request path relative to
+// p.ImgixPrefix, which identifies the remote image relative to
+// p.DefaultBaseURL, or may be a percent-encoded absolute URL as used by
+// imgix web proxy sources.  Options are read from the following imgix query
+// parameters; all other parameters are ignored:
+//
+//	w, h      output width and height; values less than 1 are a fraction of the source
+//	dpr       device pixel ratio that w and h are multiplied by
+//	fit       "clip" (the default) and "max" resize to fit within w and h,
+//	          "crop" resizes and crops to fill w and h
+//	crop      "entropy" crops using smart crop when fit is "crop"
+//	rect      source region to crop to, as x,y,w,h
+//	q         output quality
+//	fm        output format: "jpg", "pjpg", "png", "tif", or "webp"
+//	s         imgix signature
+//
+// If present, the signature is verified using p.SignatureKeys as imgix
+// secure URL tokens.  Requests with a valid signature are allowed regardless
+// of p.AllowHosts, and requests with an invalid signature are rejected.  If
+// p.PresetsOnly is true, the options must match one of p.Presets.
+func (p *Proxy) newImgixRequest(r *http.Request, path string) (*Request, error) {
+	req := &Request{Original: r}
+
+	var err error
+	if req.URL, _, err = parseURL(path, p.DefaultBaseURL); err != nil {
+		return nil, URLError{fmt.Sprintf("unable to parse remote URL: %v", err), r.URL}
+	}
+	if p.DefaultBaseURL != nil {
+		req.URL = p.DefaultBaseURL.ResolveReference(req.URL)
+	}
+	if !req.URL.IsAbs() {
+		return nil, URLError{"must provide absolute remote URL", r.URL}
+	}
+	if !isHTTP(req.URL) {
+		return nil, URLError{"remote URL must have http or https scheme", r.URL}
+	}
+
+	query := r.URL.Query()
+	if sig := query.Get("s"); sig != "" {
+		key := imgixSignatureKey(p.SignatureKeys, sig, "/"+path, r.URL.RawQuery)
+		if key == nil {
+			return nil, URLError{"invalid imgix signature", r.URL}
+		}
+		// Translate the verified imgix signature into the equivalent
+		// imageproxy signature of the remote URL, so that the request
+		// is authorized like any other signed request.
+		req.Options.Signature = urlSignature(key, req.URL)
+	}
+
+	opt := &req.Options
+	opt.Width, _ = strconv.ParseFloat(query.Get("w"), 64)
+	opt.Height, _ = strconv.ParseFloat(query.Get("h"), 64)
+	if dpr, err := strconv.ParseFloat(query.Get("dpr"), 64); err == nil && dpr > 0 {
+		// only absolute sizes are multiplied
+		if opt.Width >= 1 {
+			opt.Width *= dpr
+		}
+		if opt.Height >= 1 {
+			opt.Height *= dpr
+		}
+	}
+
+	switch query.Get("fit") {
+	case "crop":
+		opt.SmartCrop = query.Get("crop") == "entropy"
+	default: // "clip" and "max"
+		opt.Fit = opt.Width != 0 && opt.Height != 0
+	}
+
+	if rect := strings.Split(query.Get("rect"), ","); len(rect) == 4 {
+		var f [4]float64
+		valid := true
+		for i, v := range rect {
+			var err error
+			if f[i], err = strconv.ParseFloat(v, 64); err != nil || f[i] < 0 {
+				valid = false
+			}
+		}
+		if valid {
+			opt.CropX, opt.CropY, opt.CropWidth, opt.CropHeight = f[0], f[1], f[2], f[3]
+		}
+	}
+
+	opt.Quality, _ = strconv.Atoi(query.Get("q"))
+	switch query.Get("fm") {
+	case "jpg":
+		opt.Format = optFormatJPEG
+	case "pjpg":
+		opt.Format = optFormatJPEG
+		opt.Progressive = true
+	case "png":
+		opt.Format = optFormatPNG
+	case "tif", "tiff":
+		opt.Format = optFormatTIFF
+	case "webp":
+		opt.Format = optFormatWEBP
+	}
+
+	if err := p.presetOptions(*opt); err != nil {
+		return nil, URLError{err.Error(), r.URL}
+	}
+	return req, nil
+}
+
+// imgixSignatureKey returns the key in keys with which sig is a valid imgix
+// signature of path and rawQuery, or nil if there is none.  imgix signatures
+// are the hex encoded MD5 hash of the key followed by the URL path and query
+// string, excluding the signature parameter itself.
+func imgixSignatureKey(keys [][]byte, sig, path, rawQuery string) []byte {
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param != "" && !strings.HasPrefix(param, "s=") {
+			params = append(params, param)
+		}
+	}
+	if len(params) > 0 {
+		path += "?" + strings.Join(params, "&")
+	}
+
+	for _, key := range keys {
+		if len(key) == 0 {
+			continue
+		}
+		sum := md5.Sum(append(key[:len(key):len(key)], path...))
+		if subtle.ConstantTimeCompare([]byte(sig), []byte(hex.EncodeToString(sum[:]))) == 1 {
+			return key
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNewImgixRequest(t *testing.T) {
+	base, _ := url.Parse("http://good.test/")
+
+	tests := []struct {
+		URL         string  // input URL to parse as an imageproxy request
+		RemoteURL   string  // expected URL of remote image parsed from input
+		Options     Options // expected options parsed from input
+		ExpectError bool    // whether an error is expected from newRequest
+	}{
+		// invalid URLs
+		{"http://localhost/http%3A%2F%2F%25zz", "", emptyOptions, true},
+
+		// valid URLs
+		{"http://localhost/images/foo.jpg", "http://good.test/images/foo.jpg", emptyOptions, false},
+		{"http://localhost/images/foo.jpg?foo=bar", "http://good.test/images/foo.jpg", emptyOptions, false},
+		{"http://localhost/https%3A%2F%2Fexample.com%2Ffoo.jpg", "https://example.com/foo.jpg", emptyOptions, false},
+		{"http://localhost/foo.jpg?w=100", "http://good.test/foo.jpg", Options{Width: 100}, false},
+		{"http://localhost/foo.jpg?w=0.5", "http://good.test/foo.jpg", Options{Width: 0.5}, false},
+		{"http://localhost/foo.jpg?w=100&h=200", "http://good.test/foo.jpg", Options{Width: 100, Height: 200, Fit: true}, false},
+		{"http://localhost/foo.jpg?w=100&h=200&fit=clip", "http://good.test/foo.jpg", Options{Width: 100, Height: 200, Fit: true}, false},
+		{"http://localhost/foo.jpg?w=100&h=200&fit=max", "http://good.test/foo.jpg", Options{Width: 100, Height: 200, Fit: true}, false},
+		{"http://localhost/foo.jpg?w=100&h=200&fit=crop", "http://good.test/foo.jpg", Options{Width: 100, Height: 200}, false},
+		{"http://localhost/foo.jpg?w=100&h=200&fit=crop&crop=entropy", "http://good.test/foo.jpg", Options{Width: 100, Height: 200, SmartCrop: true}, false},
+		{"http://localhost/foo.jpg?w=100&h=0.5&dpr=2", "http://good.test/foo.jpg", Options{Width: 200, Height: 0.5, Fit: true}, false},
+		{"http://localhost/foo.jpg?rect=10,20,100,200", "http://good.test/foo.jpg", Options{CropX: 10, CropY: 20, CropWidth: 100, CropHeight: 200}, false},
+		{"http://localhost/foo.jpg?rect=10,20,-100,200", "http://good.test/foo.jpg", emptyOptions, false},
+		{"http://localhost/foo.jpg?q=80&fm=png", "http://good.test/foo.jpg", Options{Quality: 80, Format: "png"}, false},
+		{"http://localhost/foo.jpg?fm=pjpg", "http://good.test/foo.jpg", Options{Format: "jpeg", Progressive: true}, false},
+		{"http://localhost/foo.jpg?fm=webp", "http://good.test/foo.jpg", Options{Format: "webp"}, false},
+		{"http://localhost/foo.jpg?fm=avif", "http://good.test/foo.jpg", emptyOptions, false},
+	}
+
+	p := &Proxy{ImgixPrefix: "/", DefaultBaseURL: base}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.URL, nil)
+		r, err := p.newRequest(req)
+		if tt.ExpectError {
+			if err == nil {
+				t.Errorf("newRequest(%v) did not return expected error", req)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("newRequest(%v) returned unexpected error: %v", req, err)
+			continue
+		}
+
+		if got, want := r.URL.String(), tt.RemoteURL; got != want {
+			t.Errorf("newRequest(%q) request URL = %v, want %v", tt.URL, got, want)
+		}
+		if got, want := r.Options, tt.Options; got != want {
+			t.Errorf("newRequest(%q) request options = %v, want %v", tt.URL, got, want)
+		}
+	}
+}
+
+func TestNewImgixRequest_PresetsOnly(t *testing.T) {
+	base, _ := url.Parse("http://good.test/")
+	p := &Proxy{
+		ImgixPrefix:    "/",
+		DefaultBaseURL: base,
+		Presets:        map[string]string{"thumb": "300x200,fit"},
+		PresetsOnly:    true,
+	}
+
+	tests := []struct {
+		url         string
+		expectError bool
+	}{
+		{"http://localhost/foo.jpg", false},
+		{"http://localhost/foo.jpg?w=300&h=200", false},
+		{"http://localhost/foo.jpg?w=300&h=200&fit=crop", true},
+		{"http://localhost/foo.jpg?w=300", true},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		_, err := p.newRequest(req)
+		if got, want := err != nil, tt.expectError; got != want {
+			t.Errorf("newRequest(%v) returned error %v, want error: %t", req, err, want)
+		}
+	}
+}
+
+func TestNewImgixRequest_Signature(t *testing.T) {
+	base, _ := url.Parse("http://good.test/")
+	p := &Proxy{
+		ImgixPrefix:    "/imgix",
+		DefaultBaseURL: base,
+		AllowHosts:     []string{"good.test"},
+		SignatureKeys:  [][]byte{[]byte("c0ffee")},
+	}
+
+	tests := []struct {
+		url     string
+		valid   bool // whether the signature is valid
+		allowed bool // whether the request is allowed
+	}{
+		{"http://localhost/imgix/images/foo.jpg?w=100&h=100&s=5544ba6caa234becef9e19542ef1e120", true, true},
+		{"http://localhost/imgix/images/foo.jpg?s=fad1659f658ba1df9b296da3501430f3", true, true},
+		{"http://localhost/imgix/images/foo.jpg?w=200&h=100&s=5544ba6caa234becef9e19542ef1e120", false, false},
+		{"http://localhost/imgix/http%3A%2F%2Fbad.test%2Ffoo.jpg?w=100&s=8b2ce4ca11ac9d9358860e22e67197c5", true, true},
+		{"http://localhost/imgix/http%3A%2F%2Fbad.test%2Ffoo.jpg?w=100", true, false},
+		{"http://localhost/imgix/images/foo.jpg?w=100", true, true},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		r, err := p.newRequest(req)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("newRequest(%q) did not return expected error", tt.url)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("newRequest(%q) returned unexpected error: %v", tt.url, err)
+			continue
+		}
+
+		if got, want := p.allowed(r), tt.allowed; (got == nil) != want {
+			t.Errorf("allowed(%q) returned %v, want %v", tt.url, got, want)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package apng implements an encoder for animated PNG images, as described
+// at https://wiki.mozilla.org/APNG_Specification.
+//
+// Frames are always encoded as 8-bit RGBA covering the full canvas, which
+// keeps the encoder simple at the cost of some file size.  The first frame
+// is also the default image shown by decoders that do not support APNG.
+package apng
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+)
+
+// APNG represents an animated PNG image.
+type APNG struct {
+	// Image is the successive frames of the animation, which must all be
+	// the same size.
+	Image []image.Image
+
+	// Delay is the successive delay times, one per frame, in 100ths of a
+	// second.
+	Delay []int
+
+	// LoopCount is the number of times the animation is played, with 0
+	// meaning to play forever.
+	LoopCount int
+}
+
+const pngHeader = "\x89PNG\r\n\x1a\n"
+
+// EncodeAll writes the frames of a to w in APNG format.
+func EncodeAll(w io.Writer, a *APNG) error {
+	if len(a.Image) == 0 {
+		return errors.New("apng: must provide at least one image")
+	}
+	if len(a.Image) != len(a.Delay) {
+		return errors.New("apng: mismatched image and delay lengths")
+	}
+	b := a.Image[0].Bounds()
+	if b.Dx() <= 0 || b.Dy() <= 0 {
+		return errors.New("apng: invalid image size")
+	}
+
+	e := &encoder{w: w}
+	e.write([]byte(pngHeader))
+
+	// IHDR: 8-bit RGBA, no interlacing
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(b.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(b.Dy()))
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 6 // color type: truecolor with alpha
+	e.writeChunk("IHDR", ihdr)
+
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:4], uint32(len(a.Image)))
+	binary.BigEndian.PutUint32(actl[4:8], uint32(max(a.LoopCount, 0)))
+	e.writeChunk("acTL", actl)
+
+	var seq uint32
+	for i, m := range a.Image {
+		if !m.Bounds().Size().Eq(b.Size()) {
+			return errors.New("apng: all images must be the same size")
+		}
+
+		// fcTL: full canvas frame that replaces the previous one
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:4], seq)
+		binary.BigEndian.PutUint32(fctl[4:8], uint32(b.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:12], uint32(b.Dy()))
+		binary.BigEndian.PutUint16(fctl[20:22], uint16(min(max(a.Delay[i], 0), 0xffff)))
+		binary.BigEndian.PutUint16(fctl[22:24], 100)
+		fctl[24] = 0 // dispose_op: none
+		fctl[25] = 0 // blend_op: source
+		e.writeChunk("fcTL", fctl)
+		seq++
+
+		data, err := imageData(m)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			e.writeChunk("IDAT", data)
+		} else {
+			fdat := make([]byte, 4, 4+len(data))
+			binary.BigEndian.PutUint32(fdat, seq)
+			e.writeChunk("fdAT", append(fdat, data...))
+			seq++
+		}
+	}
+
+	e.writeChunk("IEND", nil)
+	return e.err
+}
+
+// encoder writes PNG chunks to w, recording the first error encountered.
+type encoder struct {
+	w   io.Writer
+	err error
+}
+
+func (e *encoder) write(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *encoder) writeChunk(name string, data []byte) {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(data)))
+	copy(header[4:8], name)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:8])
+	crc.Write(data)
+
+	e.write(header)
+	e.write(data)
+	e.write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+}
+
+// imageData returns the compressed and filtered pixel data of m, as stored
+// in IDAT and fdAT chunks.  Each row uses the Paeth filter, which does well
+// on both photographic and flat images.
+func imageData(m image.Image) ([]byte, error) {
+	b := m.Bounds()
+	stride := 4 * b.Dx()
+	prev := make([]byte, stride)
+	cur := make([]byte, stride)
+	filtered := make([]byte, 1+stride)
+	filtered[0] = 4 // Paeth
+
+	buf := new(bytes.Buffer)
+	zw := zlib.NewWriter(buf)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			i := 4 * (x - b.Min.X)
+			cur[i], cur[i+1], cur[i+2], cur[i+3] = c.R, c.G, c.B, c.A
+		}
+		for i := range cur {
+			var a, c byte
+			if i >= 4 {
+				a, c = cur[i-4], prev[i-4]
+			}
+			filtered[1+i] = cur[i] - paeth(a, prev[i], c)
+		}
+		if _, err := zw.Write(filtered); err != nil {
+			return nil, err
+		}
+		prev, cur = cur, prev
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// paeth implements the Paeth predictor function from the PNG specification,
+// where a, b, and c are the left, above, and upper left bytes.
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	}
+	return c
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
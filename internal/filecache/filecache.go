@@ -0,0 +1,404 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+// Package filecache provides an httpcache.Cache implementation that stores
+// cached values on the local filesystem, up to a maximum total size.  When
+// the cache grows larger than its maximum size, the least recently used
+// values are removed.
+//
+// Values are stored in the same directory layout as the diskv-based cache
+// used by imageproxy for unbounded disk caches, so an existing cache
+// directory can be used.
+package filecache
+
+import (
+	"container/list"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tempPrefix is the filename prefix of values being written.
+const tempPrefix = ".tmp-"
+
+// touchInterval is how often the modification time of values is updated
+// when they are read, which records how recently they were used for when
+// the index is rebuilt.  Recency is otherwise only tracked in memory.
+const touchInterval = time.Hour
+
+// Cache is a size-bounded cache of values stored on the local filesystem.
+type Cache struct {
+	dir     string
+	maxSize int64
+	started time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // by filename
+	lru     *list.List               // entries, most recently used first
+	size    int64                    // total size of entries
+
+	// removing holds the files being removed, which are no longer
+	// indexed.  Each channel is closed once the file is removed.
+	removing map[string]chan struct{}
+
+	evict     chan struct{} // signals the janitor to remove entries
+	done      chan struct{} // closed by Close to stop the janitor
+	closeOnce sync.Once
+}
+
+type entry struct {
+	name string
+	size int64
+}
+
+// New constructs a Cache storing values in dir, up to a total of maxSize
+// bytes.  A maxSize of zero means no limit.  Values already in dir are
+// indexed in the background, using their modification times to determine
+// how recently they were used.  Close stops the background indexing and
+// eviction of values.
+func New(dir string, maxSize int64) *Cache {
+	c := &Cache{
+		dir:      dir,
+		maxSize:  maxSize,
+		started:  time.Now(),
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		removing: make(map[string]chan struct{}),
+		evict:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go c.janitor()
+	return c
+}
+
+// Get returns the value stored at key, marking it as recently used.
+func (c *Cache) Get(key string) ([]byte, bool) {
+	name := keyToFilename(key)
+	p := c.path(name)
+	value, err := os.ReadFile(p)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("error reading from file cache: %v", err)
+		}
+		return nil, false
+	}
+
+	c.mu.Lock()
+	if _, ok := c.removing[name]; ok {
+		// the value was read before it was removed, but is no longer
+		// indexed
+		c.mu.Unlock()
+		return value, true
+	}
+	// Values are only removed once they are in c.removing, so the value
+	// has not been removed since it was read if the file still exists.
+	info, err := os.Stat(p)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.add(name, info.Size())
+	c.mu.Unlock()
+
+	// occasionally record the access so that it survives rebuilding the
+	// index
+	if now := time.Now(); now.Sub(info.ModTime()) > touchInterval {
+		_ = os.Chtimes(p, now, now)
+	}
+	return value, true
+}
+
+// Set stores value at key, removing the least recently used values if the
+// cache grows larger than its maximum size.
+func (c *Cache) Set(key string, value []byte) {
+	name := keyToFilename(key)
+	p := c.path(name)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		log.Printf("error creating file cache directory: %v", err)
+		return
+	}
+
+	// write to a temporary file first, so that partial values are
+	// never read.
+	f, err := os.CreateTemp(filepath.Dir(p), tempPrefix+name+"-*")
+	if err != nil {
+		log.Printf("error writing to file cache: %v", err)
+		return
+	}
+	_, err = f.Write(value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Printf("error writing to file cache: %v", err)
+		os.Remove(f.Name())
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waitRemoved(name)
+	if err := os.Rename(f.Name(), p); err != nil {
+		log.Printf("error writing to file cache: %v", err)
+		os.Remove(f.Name())
+		return
+	}
+	c.add(name, int64(len(value)))
+}
+
+// Delete removes the value stored at key.
+func (c *Cache) Delete(key string) {
+	name := keyToFilename(key)
+
+	c.mu.Lock()
+	c.waitRemoved(name)
+	if el, ok := c.entries[name]; ok {
+		c.remove(el)
+	}
+	c.removing[name] = make(chan struct{})
+	c.mu.Unlock()
+
+	c.removeFiles([]string{name})
+}
+
+// add adds the file name of size bytes to the index as the most recently
+// used entry, and signals the janitor if the cache is too large.  c.mu must
+// be held.
+func (c *Cache) add(name string, size int64) {
+	if el, ok := c.entries[name]; ok {
+		e := el.Value.(*entry)
+		c.size += size - e.size
+		e.size = size
+		c.lru.MoveToFront(el)
+	} else {
+		c.entries[name] = c.lru.PushFront(&entry{name: name, size: size})
+		c.size += size
+	}
+
+	if c.maxSize > 0 && c.size > c.maxSize {
+		select {
+		case c.evict <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// remove removes el from the index.  c.mu must be held.
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*entry)
+	delete(c.entries, e.name)
+	c.size -= e.size
+}
+
+// waitRemoved waits until the file name is not being removed, so that a new
+// value stored there is not removed with it.  c.mu must be held, and is
+// released while waiting.
+func (c *Cache) waitRemoved(name string) {
+	for {
+		done, ok := c.removing[name]
+		if !ok {
+			return
+		}
+		c.mu.Unlock()
+		<-done
+		c.mu.Lock()
+	}
+}
+
+// removeFiles removes the files names, which must already be in c.removing,
+// and then signals that they were removed.  c.mu must not be held, so that
+// slow removals do not block other operations.
+func (c *Cache) removeFiles(names []string) {
+	for _, name := range names {
+		if err := os.Remove(c.path(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("error removing from file cache: %v", err)
+		}
+
+		c.mu.Lock()
+		close(c.removing[name])
+		delete(c.removing, name)
+		c.mu.Unlock()
+	}
+}
+
+// Close stops the background indexing and eviction of values.  Values can
+// still be read and written after Close, but the cache is no longer bounded
+// to its maximum size.
+func (c *Cache) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return nil
+}
+
+// janitor indexes the values already stored on disk, and then removes the
+// least recently used values whenever the cache is too large, until the
+// cache is closed.
+func (c *Cache) janitor() {
+	if err := c.rebuild(); err != nil {
+		log.Printf("error indexing file cache: %v", err)
+	}
+	for {
+		select {
+		case <-c.evict:
+			c.evictOverflow()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// rebuild adds the values stored on disk to the index, ordered by their
+// modification times.  Values that were used since the cache was created are
+// already indexed as more recently used.
+func (c *Cache) rebuild() error {
+	var found []entry
+	modTimes := make(map[string]time.Time)
+	err := filepath.WalkDir(c.dir, func(p string, d fs.DirEntry, err error) error {
+		select {
+		case <-c.done:
+			return filepath.SkipAll
+		default:
+		}
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil // nothing has been cached yet
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil // removed since the directory was read
+		}
+		if strings.HasPrefix(d.Name(), tempPrefix) {
+			// remove values left partially written by a previous
+			// process.
+			if info.ModTime().Before(c.started) {
+				os.Remove(p)
+			}
+			return nil
+		}
+		if !isFilename(d.Name()) {
+			return nil
+		}
+		found = append(found, entry{name: d.Name(), size: info.Size()})
+		modTimes[d.Name()] = info.ModTime()
+		return nil
+	})
+
+	// most recently modified first
+	slices.SortFunc(found, func(a, b entry) int {
+		return modTimes[b.name].Compare(modTimes[a.name])
+	})
+
+	c.mu.Lock()
+	for _, e := range found {
+		_, removing := c.removing[e.name]
+		if _, ok := c.entries[e.name]; !ok && !removing {
+			c.entries[e.name] = c.lru.PushBack(&entry{name: e.name, size: e.size})
+			c.size += e.size
+		}
+	}
+	c.mu.Unlock()
+
+	c.evictOverflow()
+	return err
+}
+
+// evictOverflow removes the least recently used values until the cache is no
+// larger than its maximum size.
+func (c *Cache) evictOverflow() {
+	if c.maxSize <= 0 {
+		return
+	}
+
+	// files are removed after releasing c.mu, so that a slow disk does
+	// not block reads and writes of other values.
+	var names []string
+	c.mu.Lock()
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		el := c.lru.Back()
+		name := el.Value.(*entry).name
+		c.remove(el)
+		c.removing[name] = make(chan struct{})
+		names = append(names, name)
+	}
+	c.mu.Unlock()
+
+	c.removeFiles(names)
+}
+
+// path returns the path of the file name, which is stored as
+// "c0/ff/c0ffee..." within c.dir.
+func (c *Cache) path(name string) string {
+	return filepath.Join(c.dir, name[0:2], name[2:4], name)
+}
+
+func keyToFilename(key string) string {
+	h := md5.New()
+	_, _ = io.WriteString(h, key)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isFilename reports whether name is a filename returned by keyToFilename.
+func isFilename(name string) bool {
+	if len(name) != 2*md5.Size {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// sizeUnits are the units supported by ParseSize.
+var sizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"KB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"TB":  1e12,
+	"KIB": 1 << 10,
+	"MIB": 1 << 20,
+	"GIB": 1 << 30,
+	"TIB": 1 << 40,
+}
+
+// ParseSize parses a positive size in bytes with an optional unit, such as
+// "50GB" or "512MiB".  Units are case-insensitive.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+
+	n, err := strconv.ParseFloat(s[:i], 64)
+	unit, ok := sizeUnits[strings.ToUpper(strings.TrimSpace(s[i:]))]
+	if err != nil || !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	// float64(math.MaxInt64) rounds up to 2^63, which is itself too large
+	size := n * float64(unit)
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	if int64(size) <= 0 {
+		return 0, fmt.Errorf("size %q must be positive", s)
+	}
+	return int64(size), nil
+}
@@ -0,0 +1,261 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package filecache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    int64
+		wantErr bool
+	}{
+		{"100", 100, false},
+		{"100B", 100, false},
+		{"1KB", 1000, false},
+		{"1.5 MB", 1500000, false},
+		{"50gb", 50e9, false},
+		{"1TB", 1e12, false},
+		{"1KiB", 1 << 10, false},
+		{"512MiB", 512 << 20, false},
+		{"2GiB", 2 << 30, false},
+		{"1TiB", 1 << 40, false},
+
+		{"", 0, true},
+		{"MB", 0, true},
+		{"10XB", 0, true},
+		{"-1MB", 0, true},
+		{"0", 0, true},
+		{"0.1", 0, true},
+		{"9223372036854775807", 0, true}, // rounds up to 2^63 as a float
+		{"10000000TB", 0, true},
+		{"1e30", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseSize(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseSize(%q) returned error %v, want error: %t", tt.s, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSize(%q) returned %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+// value returns a value of n bytes.
+func value(n int) []byte {
+	return []byte(strings.Repeat("x", n))
+}
+
+// diskSize returns the total size of the values stored in dir.
+func diskSize(t *testing.T, dir string) int64 {
+	var size int64
+	err := filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error reading cache directory: %v", err)
+	}
+	return size
+}
+
+func TestCache_Eviction(t *testing.T) {
+	dir := t.TempDir()
+	synctest.Test(t, func(t *testing.T) {
+		c := New(dir, 30)
+		defer c.Close()
+		synctest.Wait()
+
+		c.Set("a", value(10))
+		c.Set("b", value(10))
+		c.Set("c", value(10))
+		c.Get("a") // b is now the least recently used
+		c.Set("d", value(10))
+		synctest.Wait()
+
+		for key, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+			if _, ok := c.Get(key); ok != want {
+				t.Errorf("Get(%q) returned ok %t, want %t", key, ok, want)
+			}
+		}
+
+		// values larger than the cache are evicted
+		c.Set("e", value(40))
+		synctest.Wait()
+		if _, ok := c.Get("e"); ok {
+			t.Errorf("Get(%q) returned value larger than the cache", "e")
+		}
+	})
+}
+
+func TestCache_MaxSize(t *testing.T) {
+	dir := t.TempDir()
+	synctest.Test(t, func(t *testing.T) {
+		const maxSize = 100
+		c := New(dir, maxSize)
+		defer c.Close()
+		synctest.Wait()
+
+		for i := range 50 {
+			c.Set(strings.Repeat("k", i+1), value(i%20+1))
+			synctest.Wait()
+			if c.size > maxSize {
+				t.Fatalf("cache size is %d after Set, want at most %d", c.size, maxSize)
+			}
+		}
+		if got := diskSize(t, dir); got != c.size || got > maxSize {
+			t.Errorf("cache directory has %d bytes, want %d", got, c.size)
+		}
+
+		c.Delete(strings.Repeat("k", 50))
+		if got := diskSize(t, dir); got != c.size {
+			t.Errorf("cache directory has %d bytes after Delete, want %d", got, c.size)
+		}
+	})
+}
+
+func TestCache_Rebuild(t *testing.T) {
+	dir := t.TempDir()
+
+	c := New(dir, 0)
+	c.Set("a", value(10))
+	c.Set("b", value(10))
+	c.Set("c", value(10))
+	c.Close()
+
+	// a was used most recently, and c least recently
+	now := time.Now()
+	for i, key := range []string{"a", "b", "c"} {
+		mtime := now.Add(-time.Duration(i) * time.Hour)
+		if err := os.Chtimes(c.path(keyToFilename(key)), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// values partially written by a previous process are removed
+	tmp := filepath.Join(dir, tempPrefix+"partial")
+	if err := os.WriteFile(tmp, value(5), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// before the fake start time of the cache in the synctest bubble
+	old := time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(tmp, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	synctest.Test(t, func(t *testing.T) {
+		c := New(dir, 20)
+		defer c.Close()
+		synctest.Wait()
+
+		if got, want := c.size, int64(20); got != want {
+			t.Errorf("rebuilt cache has size %d, want %d", got, want)
+		}
+		for key, want := range map[string]bool{"a": true, "b": true, "c": false} {
+			if _, ok := c.Get(key); ok != want {
+				t.Errorf("Get(%q) returned ok %t, want %t", key, ok, want)
+			}
+		}
+		if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+			t.Errorf("partially written value was not removed: %v", err)
+		}
+	})
+}
+
+func TestCache_GetDeleted(t *testing.T) {
+	dir := t.TempDir()
+	synctest.Test(t, func(t *testing.T) {
+		c := New(dir, 100)
+		defer c.Close()
+		synctest.Wait()
+
+		c.Set("a", value(10))
+		c.Delete("a")
+		if _, ok := c.Get("a"); ok {
+			t.Errorf("Get(%q) returned deleted value", "a")
+		}
+		if len(c.entries) != 0 || c.size != 0 {
+			t.Errorf("cache has %d entries of %d bytes after Delete, want none", len(c.entries), c.size)
+		}
+	})
+}
+
+func TestCache_SetWhileRemoving(t *testing.T) {
+	dir := t.TempDir()
+	synctest.Test(t, func(t *testing.T) {
+		c := New(dir, 0)
+		defer c.Close()
+		synctest.Wait()
+
+		// start removing a, as if it were being evicted
+		c.Set("a", value(10))
+		name := keyToFilename("a")
+		c.mu.Lock()
+		c.remove(c.entries[name])
+		c.removing[name] = make(chan struct{})
+		c.mu.Unlock()
+
+		// a new value is not stored until the old one is removed
+		go c.Set("a", value(5))
+		synctest.Wait()
+		c.removeFiles([]string{name})
+		synctest.Wait()
+
+		if v, ok := c.Get("a"); !ok || len(v) != 5 {
+			t.Errorf("Get(%q) returned %d bytes, %t, want 5 bytes, true", "a", len(v), ok)
+		}
+	})
+}
+
+func TestCache_Touch(t *testing.T) {
+	dir := t.TempDir()
+	c := New(dir, 0)
+	defer c.Close()
+	c.Set("a", value(10))
+	c.Set("b", value(10))
+
+	mtime := func(key string) time.Time {
+		info, err := os.Stat(c.path(keyToFilename(key)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.ModTime()
+	}
+
+	// recently modified values are not touched when read
+	recent := time.Now().Add(-time.Minute)
+	old := time.Now().Add(-2 * touchInterval)
+	if err := os.Chtimes(c.path(keyToFilename("a")), recent, recent); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(c.path(keyToFilename("b")), old, old); err != nil {
+		t.Fatal(err)
+	}
+	c.Get("a")
+	c.Get("b")
+
+	if got := mtime("a"); !got.Equal(recent) {
+		t.Errorf("recently modified value has modification time %v after Get, want %v", got, recent)
+	}
+	if got := mtime("b"); !got.After(recent) {
+		t.Errorf("old value has modification time %v after Get, want after %v", got, recent)
+	}
+}
@@ -19,6 +19,51 @@ var (
 		Name:      "transformation_duration_seconds",
 		Help:      "Time taken for image transformations in seconds.",
 	})
+	metricTransformErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "imageproxy",
+		Name:      "transformation_errors_total",
+		Help:      "Total image transformation errors, by how the error was handled.",
+	}, []string{"outcome"})
+	metricRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "imageproxy",
+		Name:      "rate_limited_requests_total",
+		Help:      "Total requests rejected for exceeding a rate limit, by limit.",
+	}, []string{"limit"})
+	metricTransformQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "imageproxy",
+		Name:      "transform_queue_depth",
+		Help:      "Number of requests waiting for images to be transformed.",
+	})
+	metricTransformQueueWait = prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace: "imageproxy",
+		Name:      "transform_queue_wait_seconds",
+		Help:      "Time requests waited for images to be transformed in seconds.",
+	})
+	metricTransformMemory = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "imageproxy",
+		Name:      "transform_memory_bytes",
+		Help:      "Estimated bytes of decoded images being transformed.",
+	})
+	metricTransformRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "imageproxy",
+		Name:      "transform_rejected_total",
+		Help:      "Total requests rejected while waiting for images to be transformed, by reason.",
+	}, []string{"reason"})
+	metricCoalescedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "imageproxy",
+		Name:      "coalesced_requests_total",
+		Help:      "Total requests that shared the result of an identical concurrent request, by layer.",
+	}, []string{"layer"})
+	metricNegativeCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "imageproxy",
+		Name:      "negative_cache_hits_total",
+		Help:      "Total requests served a cached failure.",
+	})
+	metricStaleResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "imageproxy",
+		Name:      "stale_responses_total",
+		Help:      "Total stale cached responses served, by reason: revalidate or error.",
+	}, []string{"reason"})
 	metricRemoteErrors = prometheus.NewCounter(prometheus.CounterOpts{
 		Namespace: "imageproxy",
 		Name:      "remote_fetch_errors_total",
@@ -39,6 +84,15 @@ var (
 func init() {
 	prometheus.MustRegister(metricTransformationDuration)
 	prometheus.MustRegister(metricServedFromCache)
+	prometheus.MustRegister(metricTransformErrors)
+	prometheus.MustRegister(metricRateLimited)
+	prometheus.MustRegister(metricTransformQueueDepth)
+	prometheus.MustRegister(metricTransformQueueWait)
+	prometheus.MustRegister(metricTransformMemory)
+	prometheus.MustRegister(metricTransformRejected)
+	prometheus.MustRegister(metricCoalescedRequests)
+	prometheus.MustRegister(metricStaleResponses)
+	prometheus.MustRegister(metricNegativeCacheHits)
 	prometheus.MustRegister(metricRemoteErrors)
 	prometheus.MustRegister(metricRequestDuration)
 	prometheus.MustRegister(metricRequestsInFlight)
@@ -0,0 +1,159 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// failureCachePrefix is the prefix of the cache keys at which failed
+// requests are cached.  Remote failures are cached at the remote URL, and
+// transformation failures at the remote URL with the transformation options
+// in the fragment.
+const failureCachePrefix = "imageproxy-failure:"
+
+// cachedFailure is a failed request cached by Proxy.cacheFailure.
+type cachedFailure struct {
+	status int
+	msg    string
+	fetch  bool // the remote image could not be fetched at all
+}
+
+func (f *cachedFailure) Error() string {
+	return f.msg
+}
+
+// negativeStatus reports whether remote responses with status code are
+// cached as failures.
+func negativeStatus(code int) bool {
+	return code == http.StatusNotFound || code == http.StatusGone || code >= 500
+}
+
+// negativeFetchError reports whether err, returned when fetching a remote
+// image, is cached as a failure.  Connection and DNS errors and timeouts are
+// cached, but not requests canceled by the client.
+func negativeFetchError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	return errors.As(err, &dnsErr) ||
+		errors.As(err, &opErr) && opErr.Op == "dial" ||
+		errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// cacheFailure caches the failure of the request with cache key, which
+// resulted in status code and error message msg, for
+// p.NegativeCacheDuration.
+func (p *Proxy) cacheFailure(key string, code int, msg string) {
+	p.storeFailure(key, &cachedFailure{status: code, msg: msg})
+}
+
+// cacheFetchError caches the error fetching the remote image at remoteURL,
+// with error message msg, for p.NegativeCacheDuration.  Like uncached fetch
+// errors, it is matched against fallbacks as a 502 response.
+func (p *Proxy) cacheFetchError(remoteURL, msg string) {
+	p.storeFailure(remoteURL, &cachedFailure{status: http.StatusBadGateway, msg: msg, fetch: true})
+}
+
+// storeFailure stores f at cache key for p.NegativeCacheDuration.
+func (p *Proxy) storeFailure(key string, f *cachedFailure) {
+	if p.NegativeCacheDuration <= 0 || p.Cache == nil {
+		return
+	}
+
+	// failures are stored as raw HTTP responses, like the responses
+	// cached by httpcache.
+	resp := &http.Response{
+		StatusCode: f.status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Expires":            {p.now().Add(p.NegativeCacheDuration).UTC().Format(http.TimeFormat)},
+			"X-Imageproxy-Error": {f.msg},
+		},
+	}
+	if f.fetch {
+		resp.Header.Set("X-Imageproxy-Fetch-Error", "1")
+	}
+	var buf bytes.Buffer
+	if err := resp.Write(&buf); err != nil {
+		return
+	}
+	p.Cache.Set(failureCachePrefix+key, buf.Bytes())
+}
+
+// lookupFailure returns the failure cached for the request with cache key,
+// if it has not expired.
+func (p *Proxy) lookupFailure(key string) (*cachedFailure, bool) {
+	if p.NegativeCacheDuration <= 0 || p.Cache == nil {
+		return nil, false
+	}
+	b, ok := p.Cache.Get(failureCachePrefix + key)
+	if !ok {
+		return nil, false
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil {
+		return nil, false
+	}
+	resp.Body.Close()
+	expires, err := http.ParseTime(resp.Header.Get("Expires"))
+	if err != nil || !p.now().Before(expires) {
+		p.Cache.Delete(failureCachePrefix + key)
+		return nil, false
+	}
+	return &cachedFailure{
+		status: resp.StatusCode,
+		msg:    resp.Header.Get("X-Imageproxy-Error"),
+		fetch:  resp.Header.Get("X-Imageproxy-Fetch-Error") != "",
+	}, true
+}
+
+// serveCachedFailure responds to req with a cached failure, if there is one.
+// It reports whether a response was served.
+func (p *Proxy) serveCachedFailure(w http.ResponseWriter, req *Request) bool {
+	if f, ok := p.lookupFailure(req.URL.String()); ok {
+		metricNegativeCacheHits.Inc()
+		if p.serveFallback(w, req, f.status) {
+			return true
+		}
+		code := f.status
+		if f.fetch {
+			code = http.StatusInternalServerError
+		}
+		msg := strings.ToLower(http.StatusText(code))
+		if f.msg != "" {
+			msg = f.msg
+		}
+		http.Error(w, msg, code)
+		return true
+	}
+
+	if f, ok := p.lookupFailure(req.String()); ok {
+		metricNegativeCacheHits.Inc()
+		p.serveTransformError(w, req, &transformError{f})
+		return true
+	}
+	return false
+}
+
+// cachedFailureStatus returns the status code of err if it is a cached
+// failure, or zero otherwise.
+func cachedFailureStatus(err error) int {
+	var f *cachedFailure
+	if errors.As(err, &f) {
+		return f.status
+	}
+	return 0
+}
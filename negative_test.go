@@ -0,0 +1,130 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gregjones/httpcache"
+)
+
+func TestProxy_ServeHTTP_NegativeCache(t *testing.T) {
+	// a blockingTransport that is already released just counts requests
+	bt := &blockingTransport{RoundTripper: &testTransport{}, release: make(chan struct{})}
+	close(bt.release)
+
+	p := NewProxy(bt, httpcache.NewMemoryCache())
+	p.NegativeCacheDuration = time.Minute
+	p.TransformErrorPolicy = TransformErrorStatus
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		url       string
+		elapsed   time.Duration // time elapsed since the start of the test
+		purge     string        // remote URL to purge before the request
+		code      int           // expected response status code
+		wantCount int32         // expected remote requests
+	}{
+		{"/http://good.test/missing", 0, "", http.StatusNotFound, 1},
+		{"/http://good.test/missing", 0, "", http.StatusNotFound, 1},
+		{"/100/http://good.test/missing", 0, "", http.StatusNotFound, 1}, // cached for all options
+		{"/100/http://good.test/plain", 0, "", http.StatusUnprocessableEntity, 2},
+		{"/100/http://good.test/plain", 30 * time.Second, "", http.StatusUnprocessableEntity, 2},
+		{"/http://good.test/missing", 2 * time.Minute, "", http.StatusNotFound, 3}, // expired
+		{"/100/http://good.test/plain", 2 * time.Minute, "", http.StatusUnprocessableEntity, 4},
+		{"/100/http://good.test/plain", 2 * time.Minute, "http://good.test/plain", http.StatusUnprocessableEntity, 5},
+	}
+
+	for i, tt := range tests {
+		p.timeNow = start.Add(tt.elapsed)
+		if tt.purge != "" {
+			if _, err := p.Purge(tt.purge); err != nil {
+				t.Fatalf("Purge(%q) returned unexpected error: %v", tt.purge, err)
+			}
+		}
+
+		req := httptest.NewRequest("GET", "http://localhost"+tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("%d. ServeHTTP(%v) returned status %d, want %d", i, tt.url, got, want)
+		}
+		if got, want := bt.count.Load(), tt.wantCount; got != want {
+			t.Errorf("%d. remote server received %d requests, want %d", i, got, want)
+		}
+	}
+}
+
+// errorTransport fails requests with err, counting them.
+type errorTransport struct {
+	err   error
+	count int
+}
+
+func (t *errorTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	t.count++
+	return nil, t.err
+}
+
+func TestProxy_ServeHTTP_NegativeCacheFetchError(t *testing.T) {
+	tests := []struct {
+		err       error
+		wantCount int // expected remote requests for two proxy requests
+	}{
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, 1},
+		{&net.DNSError{Err: "no such host", Name: "bad.test", IsNotFound: true}, 1},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, 1},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, 2},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: context.Canceled}, 2},
+		{errors.New("unexpected error"), 2},
+	}
+
+	for _, tt := range tests {
+		et := &errorTransport{err: tt.err}
+		p := NewProxy(et, httpcache.NewMemoryCache())
+		p.NegativeCacheDuration = time.Minute
+
+		for range 2 {
+			req := httptest.NewRequest("GET", "http://localhost/100/http://bad.test/image", nil)
+			resp := httptest.NewRecorder()
+			p.ServeHTTP(resp, req)
+			if got, want := resp.Code, http.StatusInternalServerError; got != want {
+				t.Errorf("ServeHTTP with error %v returned status %d, want %d", tt.err, got, want)
+			}
+		}
+		if et.count != tt.wantCount {
+			t.Errorf("remote server received %d requests with error %v, want %d", et.count, tt.err, tt.wantCount)
+		}
+	}
+}
+
+func TestNegativeStatus(t *testing.T) {
+	tests := []struct {
+		code int
+		want bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNotModified, false},
+		{http.StatusForbidden, false},
+		{http.StatusNotFound, true},
+		{http.StatusGone, true},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, true},
+		{http.StatusBadGateway, true},
+	}
+
+	for _, tt := range tests {
+		if got := negativeStatus(tt.code); got != tt.want {
+			t.Errorf("negativeStatus(%d) returned %t, want %t", tt.code, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+	"sync"
+)
+
+// A Plugin extends imageproxy.  Plugins hook into the various extension
+// points of imageproxy by implementing one or more of the interfaces
+// RequestAuthorizer, ResponseAuthorizer, OptionParser, and
+// ImageTransformer.  A value that implements none of these interfaces can
+// still be registered, but will not have any effect.
+type Plugin any
+
+// A RequestAuthorizer determines if a request is authorized to be processed.
+// Requests are authorized before the remote resource is retrieved.
+type RequestAuthorizer interface {
+	// AuthorizeRequest returns an error if the request should not be
+	// processed further (for example, it doesn't have a valid signature,
+	// is not for an allowed host, etc).  p is the Proxy handling the
+	// request, and can be used to read its configuration.
+	AuthorizeRequest(p *Proxy, r *Request) error
+}
+
+// A ResponseAuthorizer determines if a response from a remote server is
+// authorized to be returned.
+type ResponseAuthorizer interface {
+	// AuthorizeResponse returns an error if a response should not be
+	// returned to a client (for example, it is not for an image resource,
+	// etc).  The Content-Type header of resp will have already been set
+	// to the detected content type if the remote server did not provide
+	// a meaningful one.  Implementations must not read from resp.Body.
+	AuthorizeResponse(p *Proxy, r *Request, resp *http.Response) error
+}
+
+// An OptionParser parses custom transformation options, allowing plugins to
+// register their own URL options.  Values parsed by an OptionParser plugin
+// can be retrieved using Options.PluginOption with the plugin's registered
+// name, typically by an ImageTransformer implemented by the same plugin.
+type OptionParser interface {
+	// ParseOption parses opt, which is a single option from a comma
+	// separated options string (see ParseOptions).  It returns the parsed
+	// value and whether opt was recognized by this parser.
+	//
+	// Option parsers are consulted before the built-in options, so
+	// implementations should take care to only recognize options that
+	// do not conflict with the built-in ones.
+	ParseOption(opt string) (value any, ok bool)
+
+	// FormatOption returns the canonical string form of value, which will
+	// have been returned by ParseOption or passed to
+	// Options.SetPluginOption.  The returned string must not contain
+	// commas, and must be recognized by ParseOption as an equivalent
+	// value.  This canonical form is included in Options.String, and is
+	// therefore covered by request signatures.
+	FormatOption(value any) string
+}
+
+// An ImageTransformer transforms an image.
+type ImageTransformer interface {
+	// TransformImage transforms m based on the provided options and
+	// returns the result.  If opt does not call for any change handled
+	// by this transformer, m should be returned unmodified.
+	TransformImage(m image.Image, opt Options) image.Image
+}
+
+type registeredPlugin struct {
+	name   string
+	plugin Plugin
+}
+
+var (
+	pluginsMu sync.RWMutex
+	plugins   []registeredPlugin
+)
+
+// RegisterPlugin makes a plugin available to imageproxy under the provided
+// name.  Plugins are typically registered from the init func of the package
+// that provides them, and are then loaded simply by importing that package.
+//
+// Plugins are applied in the order in which they were registered.  The
+// built-in plugins are always registered first, so request and response
+// authorizers registered by other packages are only consulted once the
+// built-in checks pass, and image transformers registered by other packages
+// are applied after the built-in transformations.
+//
+// If RegisterPlugin is called twice with the same name or if plugin is nil,
+// it panics.
+func RegisterPlugin(name string, plugin Plugin) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+
+	if plugin == nil {
+		panic("imageproxy: RegisterPlugin plugin is nil")
+	}
+	for _, rp := range plugins {
+		if rp.name == name {
+			panic(fmt.Sprintf("imageproxy: RegisterPlugin called twice for plugin %q", name))
+		}
+	}
+	plugins = append(plugins, registeredPlugin{name, plugin})
+}
+
+// Plugins returns the names of all registered plugins, in the order they
+// were registered.
+func Plugins() []string {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+
+	names := make([]string, len(plugins))
+	for i, rp := range plugins {
+		names[i] = rp.name
+	}
+	return names
+}
+
+// lookupPlugin returns the plugin registered with the provided name, or nil
+// if there is none.
+func lookupPlugin(name string) Plugin {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+
+	for _, rp := range plugins {
+		if rp.name == name {
+			return rp.plugin
+		}
+	}
+	return nil
+}
+
+// pluginsImplementing returns the registered plugins that implement T, in
+// the order they were registered.
+func pluginsImplementing[T any]() []T {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+
+	var ps []T
+	for _, rp := range plugins {
+		if p, ok := rp.plugin.(T); ok {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+func init() {
+	// Built-in plugins, in the order they are applied.
+
+	// request authorizers
+	RegisterPlugin("validuntil", validUntilAuthorizer{})
+	RegisterPlugin("referrer", referrerAuthorizer{})
+	RegisterPlugin("denyhosts", denyHostsAuthorizer{})
+	RegisterPlugin("allowhosts", allowHostsAuthorizer{})
+	RegisterPlugin("ratelimit", rateLimitAuthorizer{})
+
+	// response authorizers
+	RegisterPlugin("contenttype", contentTypeAuthorizer{})
+
+	// image transformers
+	RegisterPlugin("trim", trimTransformer{})
+	RegisterPlugin("resize", resizeTransformer{})
+	RegisterPlugin("rotate", rotateTransformer{})
+	RegisterPlugin("flip", flipTransformer{})
+}
@@ -0,0 +1,187 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// registerTestPlugin registers plugin for the duration of the test t.
+func registerTestPlugin(t *testing.T, name string, plugin Plugin) {
+	t.Helper()
+	RegisterPlugin(name, plugin)
+	t.Cleanup(func() {
+		pluginsMu.Lock()
+		defer pluginsMu.Unlock()
+		for i, rp := range plugins {
+			if rp.name == name {
+				plugins = append(plugins[:i:i], plugins[i+1:]...)
+				break
+			}
+		}
+	})
+}
+
+func TestPlugins(t *testing.T) {
+	want := []string{
+		"validuntil", "referrer", "denyhosts", "allowhosts", "ratelimit",
+		"contenttype",
+		"trim", "resize", "rotate", "flip",
+	}
+	if got := Plugins(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Plugins() returned %v, want %v", got, want)
+	}
+
+	registerTestPlugin(t, "test", struct{}{})
+	want = append(want, "test")
+	if got := Plugins(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Plugins() returned %v, want %v", got, want)
+	}
+}
+
+func TestRegisterPlugin_Panics(t *testing.T) {
+	tests := []struct {
+		name   string
+		plugin Plugin
+	}{
+		{"nil", nil},
+		{"resize", struct{}{}}, // duplicate name
+	}
+
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("RegisterPlugin(%q, %v) did not panic", tt.name, tt.plugin)
+				}
+			}()
+			RegisterPlugin(tt.name, tt.plugin)
+		}()
+	}
+}
+
+type testRequestAuthorizer struct{ err error }
+
+func (a testRequestAuthorizer) AuthorizeRequest(*Proxy, *Request) error { return a.err }
+
+func TestRequestAuthorizer(t *testing.T) {
+	errTest := errors.New("test error")
+	registerTestPlugin(t, "test", testRequestAuthorizer{errTest})
+
+	p := &Proxy{}
+	u, _ := url.Parse("http://test/image")
+	if got := p.allowed(&Request{URL: u}); !errors.Is(got, errTest) {
+		t.Errorf("allowed returned %v, want %v", got, errTest)
+	}
+
+	// built-in authorizers are consulted first
+	p.DenyHosts = []string{"test"}
+	if got := p.allowed(&Request{URL: u}); !errors.Is(got, errDeniedHost) {
+		t.Errorf("allowed returned %v, want %v", got, errDeniedHost)
+	}
+}
+
+type testResponseAuthorizer struct{}
+
+func (testResponseAuthorizer) AuthorizeResponse(_ *Proxy, _ *Request, resp *http.Response) error {
+	if resp.Header.Get("Content-Type") == "image/png" {
+		return errors.New("png not allowed")
+	}
+	return nil
+}
+
+func TestResponseAuthorizer(t *testing.T) {
+	registerTestPlugin(t, "test", testResponseAuthorizer{})
+
+	p := &Proxy{
+		Client: &http.Client{
+			Transport: &testTransport{},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/http://good.test/png", nil)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	if got, want := resp.Code, http.StatusForbidden; got != want {
+		t.Errorf("ServeHTTP(%v) returned status %d, want %d", req, got, want)
+	}
+}
+
+// testTransformer replaces any image with a 1x1 image.
+type testTransformer struct{}
+
+func (testTransformer) TransformImage(image.Image, Options) image.Image {
+	return image.NewNRGBA(image.Rect(0, 0, 1, 1))
+}
+
+func TestImageTransformer(t *testing.T) {
+	registerTestPlugin(t, "test", testTransformer{})
+
+	m := transformImage(newImage(4, 4, red), Options{Rotate: 90})
+	if got, want := m.Bounds(), image.Rect(0, 0, 1, 1); got != want {
+		t.Errorf("transformImage returned image with bounds %v, want %v", got, want)
+	}
+}
+
+// testOptionParser parses options of the form "blur{n}", where n is an
+// integer.  Leading zeros are accepted, but not part of the canonical form.
+type testOptionParser struct{}
+
+func (testOptionParser) ParseOption(opt string) (any, bool) {
+	v, ok := strings.CutPrefix(opt, "blur")
+	if !ok {
+		return nil, false
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, false
+	}
+	return n, true
+}
+
+func (testOptionParser) FormatOption(value any) string {
+	return fmt.Sprintf("blur%d", value)
+}
+
+// testBlurTransformer is an ImageTransformer that reads the option parsed by
+// testOptionParser, and records the value it received.
+type testBlurTransformer struct {
+	testOptionParser
+	got *any
+}
+
+func (t testBlurTransformer) TransformImage(m image.Image, opt Options) image.Image {
+	*t.got, _ = opt.PluginOption("blur")
+	return m
+}
+
+func TestOptionParser_Transform(t *testing.T) {
+	var got any
+	registerTestPlugin(t, "blur", testBlurTransformer{got: &got})
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, newImage(2, 2, red)); err != nil {
+		t.Fatalf("error encoding image: %v", err)
+	}
+
+	opt := ParseOptions("blur3")
+	if _, err := Transform(buf.Bytes(), opt); err != nil {
+		t.Fatalf("Transform returned error: %v", err)
+	}
+	if want := 3; got != want {
+		t.Errorf("blur transformer received option value %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// PurgePath is the path of the admin endpoint that purges cached images.
+// See Proxy.AdminToken.
+const PurgePath = "/admin/purge"
+
+// variantIndexPrefix is the prefix of the cache keys at which the index of
+// transformed variants of each remote image is stored.
+const variantIndexPrefix = "imageproxy-variants:"
+
+// maxIndexedVariants is the maximum number of transformed variants of each
+// remote image that are cached, so that its index stays small no matter how
+// many different options are requested.
+const maxIndexedVariants = 256
+
+// maxIndexAttempts is the number of times variantCache tries to add a
+// variant to an index that is concurrently updated by other servers.
+const maxIndexAttempts = 3
+
+// variantCache is a Cache that keeps an index of the cached transformed
+// variants of each remote image, so that they can be purged along with the
+// original.  Transformed variants are cached at the remote URL with the
+// transformation options in the fragment.  The index is stored in the
+// underlying cache itself, so that it works with any Cache implementation and
+// is shared by all servers using the same cache.
+//
+// Only storing a new variant reads and updates the index, so reading cached
+// variants costs nothing extra.  Variants are only stored once they are
+// listed in the index, so that purging deletes all of them: the index is read
+// back after each update to detect updates lost to other servers, and no more
+// than maxIndexedVariants variants of each image are stored.
+type variantCache struct {
+	Cache
+
+	mu sync.Mutex // serializes updates to the index by this server
+}
+
+// Set caches data at key, after adding key to the index of variants of its
+// remote image if it has transformation options.
+func (c *variantCache) Set(key string, data []byte) {
+	src, _, ok := strings.Cut(key, "#")
+	if ok && !c.index(src, key) {
+		return
+	}
+	c.Cache.Set(key, data)
+}
+
+// index adds key to the index of variants of the remote image cached at key
+// src, and reports whether it is listed there.
+func (c *variantCache) index(src, key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for range maxIndexAttempts {
+		variants := cachedVariants(c.Cache, src)
+		if slices.Contains(variants, key) {
+			return true
+		}
+		if len(variants) >= maxIndexedVariants {
+			return false
+		}
+		c.Cache.Set(variantIndexPrefix+src, []byte(strings.Join(append(variants, key), "\n")))
+	}
+	return slices.Contains(cachedVariants(c.Cache, src), key)
+}
+
+// purge deletes the transformed variants of the remote image cached at key
+// src, along with their index, and returns the number of variants deleted.
+func (c *variantCache) purge(src string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	variants := cachedVariants(c.Cache, src)
+	for _, key := range variants {
+		c.Cache.Delete(key)
+	}
+	c.Cache.Delete(variantIndexPrefix + src)
+	return len(variants)
+}
+
+// cachedVariants returns the cache keys of the transformed variants of the
+// remote image cached at key src.
+func cachedVariants(c Cache, src string) []string {
+	index, ok := c.Get(variantIndexPrefix + src)
+	if !ok || len(index) == 0 {
+		return nil
+	}
+	return strings.Split(string(index), "\n")
+}
+
+// Purge deletes the remote image at remoteURL from p.Cache, along with all of
+// its transformed variants.  Relative URLs are resolved using
+// p.DefaultBaseURL.  It returns the number of transformed variants that were
+// deleted.
+func (p *Proxy) Purge(remoteURL string) (int, error) {
+	u, err := p.parsePurgeURL(remoteURL)
+	if err != nil {
+		return 0, err
+	}
+	return p.purge(u), nil
+}
+
+// parsePurgeURL parses the remote URL of an image to be purged, resolving
+// relative URLs using p.DefaultBaseURL.
+func (p *Proxy) parsePurgeURL(remoteURL string) (*url.URL, error) {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+	if p.DefaultBaseURL != nil {
+		u = p.DefaultBaseURL.ResolveReference(u)
+	}
+	if !u.IsAbs() || !isHTTP(u) {
+		return nil, fmt.Errorf("remote URL must be an absolute http or https URL: %q", remoteURL)
+	}
+	u.Fragment = ""
+	return u, nil
+}
+
+// purge deletes the remote image at u from p.Cache, along with all of its
+// transformed variants and cached failures, and returns the number of
+// variants deleted.
+func (p *Proxy) purge(u *url.URL) int {
+	if p.Cache == nil {
+		return 0
+	}
+	// cached failures are indexed like other cache entries, under the
+	// remote URL with failureCachePrefix.
+	var n int
+	for _, src := range []string{u.String(), failureCachePrefix + u.String()} {
+		p.Cache.Delete(src)
+		if vc, ok := p.Cache.(*variantCache); ok {
+			n += vc.purge(src)
+		}
+	}
+	return n
+}
+
+// servePurge handles admin requests to purge a remote image from the cache.
+// Requests must use the POST method, authenticate with p.AdminToken as a
+// bearer token, and specify the remote URL in the "url" parameter.  If
+// p.PurgeWebhook is set, the purge is then forwarded to it.
+func (p *Proxy) servePurge(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(p.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	remoteURL := r.FormValue("url")
+	if remoteURL == "" {
+		http.Error(w, "missing url parameter", http.StatusBadRequest)
+		return
+	}
+	u, err := p.parsePurgeURL(remoteURL)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid url parameter: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	n := p.purge(u)
+	p.logf("purged %s and %d transformed variants from cache", remoteURL, n)
+
+	if p.PurgeWebhook != "" {
+		if err := p.notifyPurge(r.Context(), u); err != nil {
+			msg := fmt.Sprintf("error sending purge to webhook: %v", err)
+			p.log(msg)
+			http.Error(w, msg, http.StatusBadGateway)
+			return
+		}
+	}
+	fmt.Fprintf(w, "purged %s and %d transformed variants\n", remoteURL, n)
+}
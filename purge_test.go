@@ -0,0 +1,161 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gregjones/httpcache"
+)
+
+func TestVariantCache(t *testing.T) {
+	c := &variantCache{Cache: httpcache.NewMemoryCache()}
+	c.Set("http://a.test/img", []byte("original"))
+	c.Set("http://a.test/img#100", []byte("100"))
+	c.Set("http://a.test/img#200", []byte("200"))
+	c.Set("http://a.test/img#100", []byte("100"))
+	c.Set("http://b.test/img#100", []byte("100"))
+
+	tests := []struct {
+		src  string
+		want []string
+	}{
+		{"http://a.test/img", []string{"http://a.test/img#100", "http://a.test/img#200"}},
+		{"http://b.test/img", []string{"http://b.test/img#100"}},
+		{"http://c.test/img", nil},
+	}
+
+	for _, tt := range tests {
+		if got := cachedVariants(c, tt.src); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("cachedVariants(%q) returned %q, want %q", tt.src, got, tt.want)
+		}
+	}
+
+	if got, want := c.purge("http://a.test/img"), 2; got != want {
+		t.Errorf("purge returned %d, want %d", got, want)
+	}
+	for _, key := range []string{"http://a.test/img#100", "http://a.test/img#200", variantIndexPrefix + "http://a.test/img"} {
+		if _, ok := c.Get(key); ok {
+			t.Errorf("cache has %q after purge", key)
+		}
+	}
+	for _, key := range []string{"http://a.test/img", "http://b.test/img#100"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("cache missing %q after purge", key)
+		}
+	}
+}
+
+func TestVariantCache_MaxVariants(t *testing.T) {
+	c := &variantCache{Cache: httpcache.NewMemoryCache()}
+	for i := range maxIndexedVariants + 1 {
+		c.Set(fmt.Sprintf("http://a.test/img#%d", i), []byte("variant"))
+	}
+
+	// variants beyond the maximum are not cached, since they would not
+	// be purged
+	last := fmt.Sprintf("http://a.test/img#%d", maxIndexedVariants)
+	if _, ok := c.Get(last); ok {
+		t.Errorf("cache has %q beyond the maximum number of variants", last)
+	}
+	if got, want := c.purge("http://a.test/img"), maxIndexedVariants; got != want {
+		t.Errorf("purge returned %d, want %d", got, want)
+	}
+}
+
+// lossyCache is a Cache that loses the first writes of variant indexes, as if
+// they were overwritten by other servers updating them concurrently.
+type lossyCache struct {
+	Cache
+	lose int // number of index writes to lose
+}
+
+func (c *lossyCache) Set(key string, data []byte) {
+	if strings.HasPrefix(key, variantIndexPrefix) && c.lose > 0 {
+		c.lose--
+		return
+	}
+	c.Cache.Set(key, data)
+}
+
+func TestVariantCache_LostIndexUpdate(t *testing.T) {
+	tests := []struct {
+		lose   int
+		cached bool // whether the variant is cached
+	}{
+		{0, true},
+		{maxIndexAttempts - 1, true},
+		{maxIndexAttempts, false},
+	}
+
+	for _, tt := range tests {
+		c := &variantCache{Cache: &lossyCache{Cache: httpcache.NewMemoryCache(), lose: tt.lose}}
+		c.Set("http://a.test/img#100", []byte("100"))
+		if _, ok := c.Get("http://a.test/img#100"); ok != tt.cached {
+			t.Errorf("with %d lost index writes, variant cached is %t, want %t", tt.lose, ok, tt.cached)
+		}
+		if got, want := len(cachedVariants(c, "http://a.test/img")) == 1, tt.cached; got != want {
+			t.Errorf("with %d lost index writes, variant indexed is %t, want %t", tt.lose, got, want)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_Purge(t *testing.T) {
+	cache := httpcache.NewMemoryCache()
+	p := NewProxy(&testTransport{}, cache)
+	p.AdminToken = "token"
+
+	// cache the original image and two transformed variants
+	for _, u := range []string{"/100/http://good.test/png", "/200/http://good.test/png"} {
+		req := httptest.NewRequest("GET", "http://localhost"+u, nil)
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	keys := []string{"http://good.test/png", "http://good.test/png#100x100", "http://good.test/png#200x200"}
+	for _, key := range keys {
+		if _, ok := cache.Get(key); !ok {
+			t.Fatalf("cache missing %q before purge", key)
+		}
+	}
+
+	tests := []struct {
+		method string
+		token  string
+		url    string
+		code   int
+	}{
+		{"POST", "", "http://good.test/png", http.StatusUnauthorized},
+		{"POST", "wrong", "http://good.test/png", http.StatusUnauthorized},
+		{"GET", "token", "http://good.test/png", http.StatusMethodNotAllowed},
+		{"POST", "token", "", http.StatusBadRequest},
+		{"POST", "token", "/png", http.StatusBadRequest}, // relative URL
+		{"POST", "token", "http://good.test/png", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		body := url.Values{"url": {tt.url}}.Encode()
+		req := httptest.NewRequest(tt.method, "http://localhost"+PurgePath, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("%s %s with token %q and url %q returned status %d, want %d", tt.method, PurgePath, tt.token, tt.url, got, want)
+		}
+	}
+
+	for _, key := range append(keys, variantIndexPrefix+"http://good.test/png") {
+		if _, ok := cache.Get(key); ok {
+			t.Errorf("cache has %q after purge", key)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// queueLimits are the limits on requests waiting for images to be
+// transformed by TransformingTransport.  Zero values mean no limit.
+type queueLimits struct {
+	maxQueue  int           // maximum number of waiting requests
+	maxWait   time.Duration // maximum time a request waits
+	maxMemory int64         // maximum bytes of images being transformed
+}
+
+// queueLimits returns the limits on requests waiting for images to be
+// transformed by p.
+func (p *Proxy) queueLimits() queueLimits {
+	return queueLimits{
+		maxQueue:  p.MaxTransformQueue,
+		maxWait:   p.MaxTransformWait,
+		maxMemory: p.MaxTransformMemory,
+	}
+}
+
+var (
+	errQueueFull    = errors.New("too many requests waiting to be transformed")
+	errQueueTimeout = errors.New("timed out waiting to be transformed")
+)
+
+// transformQueue tracks requests waiting for images to be transformed, and
+// the memory used by images being transformed.
+type transformQueue struct {
+	mu      sync.Mutex
+	waiting int
+	memory  int64         // estimated bytes of images being transformed
+	freed   chan struct{} // closed when memory is released
+}
+
+// acquireSlot waits for one of the concurrent transformations allowed by
+// limiter, and returns a function to release it.  If the request would need
+// to wait and limits.maxQueue requests are already waiting, errQueueFull is
+// returned.  If timeout fires first, errQueueTimeout is returned.
+func (q *transformQueue) acquireSlot(ctx context.Context, limiter chan struct{}, limits queueLimits, timeout <-chan time.Time) (func(), error) {
+	release := func() { <-limiter }
+
+	start := time.Now()
+	defer func() {
+		metricTransformQueueWait.Observe(time.Since(start).Seconds())
+	}()
+
+	select {
+	case limiter <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	q.mu.Lock()
+	if limits.maxQueue > 0 && q.waiting >= limits.maxQueue {
+		q.mu.Unlock()
+		return nil, errQueueFull
+	}
+	q.waiting++
+	q.mu.Unlock()
+	metricTransformQueueDepth.Inc()
+	defer func() {
+		q.mu.Lock()
+		q.waiting--
+		q.mu.Unlock()
+		metricTransformQueueDepth.Dec()
+	}()
+
+	select {
+	case limiter <- struct{}{}:
+		return release, nil
+	case <-timeout:
+		return nil, errQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// reserveMemory waits until n bytes are available within limits.maxMemory,
+// and returns a function to release them.  Images larger than
+// limits.maxMemory can be transformed when no other images are.  If timeout
+// fires first, errQueueTimeout is returned.
+func (q *transformQueue) reserveMemory(ctx context.Context, n int64, limits queueLimits, timeout <-chan time.Time) (func(), error) {
+	if limits.maxMemory <= 0 || n <= 0 {
+		return func() {}, nil
+	}
+
+	for {
+		q.mu.Lock()
+		if q.memory == 0 || q.memory+n <= limits.maxMemory {
+			q.memory += n
+			q.mu.Unlock()
+			metricTransformMemory.Add(float64(n))
+			return func() { q.releaseMemory(n) }, nil
+		}
+		if q.freed == nil {
+			q.freed = make(chan struct{})
+		}
+		freed := q.freed
+		q.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-timeout:
+			return nil, errQueueTimeout
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (q *transformQueue) releaseMemory(n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.memory -= n
+	metricTransformMemory.Sub(float64(n))
+	if q.freed != nil {
+		close(q.freed)
+		q.freed = nil
+	}
+}
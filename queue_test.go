@@ -0,0 +1,188 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+// waitFor waits until f returns true, failing the test if it takes too long.
+func waitFor(t *testing.T, f func() bool) {
+	t.Helper()
+	for range 1000 {
+		if f() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("timed out waiting for condition")
+}
+
+func TestTransformQueue_AcquireSlot(t *testing.T) {
+	var q transformQueue
+	limiter := make(chan struct{}, 1)
+	limits := queueLimits{maxQueue: 1}
+	ctx := context.Background()
+
+	release, err := q.acquireSlot(ctx, limiter, limits, nil)
+	if err != nil {
+		t.Fatalf("acquireSlot returned unexpected error: %v", err)
+	}
+
+	// second request waits in the queue until it times out
+	timeout := make(chan time.Time)
+	errc := make(chan error)
+	go func() {
+		_, err := q.acquireSlot(ctx, limiter, limits, timeout)
+		errc <- err
+	}()
+	waitFor(t, func() bool {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return q.waiting == 1
+	})
+
+	// third request is rejected since the queue is full
+	if _, err := q.acquireSlot(ctx, limiter, limits, nil); !errors.Is(err, errQueueFull) {
+		t.Errorf("acquireSlot with full queue returned error %v, want %v", err, errQueueFull)
+	}
+
+	close(timeout)
+	if err := <-errc; !errors.Is(err, errQueueTimeout) {
+		t.Errorf("acquireSlot returned error %v, want %v", err, errQueueTimeout)
+	}
+
+	// fourth request gets the slot once it is released
+	go func() {
+		_, err := q.acquireSlot(ctx, limiter, limits, nil)
+		errc <- err
+	}()
+	release()
+	if err := <-errc; err != nil {
+		t.Errorf("acquireSlot returned unexpected error: %v", err)
+	}
+}
+
+func TestTransformQueue_ReserveMemory(t *testing.T) {
+	var q transformQueue
+	limits := queueLimits{maxMemory: 100}
+	ctx := context.Background()
+
+	release, err := q.reserveMemory(ctx, 60, limits, nil)
+	if err != nil {
+		t.Fatalf("reserveMemory returned unexpected error: %v", err)
+	}
+
+	timeout := make(chan time.Time)
+	close(timeout)
+	if _, err := q.reserveMemory(ctx, 60, limits, timeout); !errors.Is(err, errQueueTimeout) {
+		t.Errorf("reserveMemory over limit returned error %v, want %v", err, errQueueTimeout)
+	}
+
+	errc := make(chan error)
+	go func() {
+		release, err := q.reserveMemory(ctx, 60, limits, nil)
+		if err == nil {
+			release()
+		}
+		errc <- err
+	}()
+	release()
+	if err := <-errc; err != nil {
+		t.Errorf("reserveMemory returned unexpected error: %v", err)
+	}
+
+	// images larger than the limit are allowed when nothing else is in flight
+	release, err = q.reserveMemory(ctx, 200, limits, timeout)
+	if err != nil {
+		t.Errorf("reserveMemory with no memory in use returned unexpected error: %v", err)
+	} else {
+		release()
+	}
+	if q.memory != 0 {
+		t.Errorf("transformQueue has %d bytes reserved after release, want 0", q.memory)
+	}
+}
+
+func TestDecodedSize(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, newImage(4, 2, red)); err != nil {
+		t.Fatalf("error encoding reference image: %v", err)
+	}
+
+	tests := []struct {
+		img  []byte
+		want int64
+	}{
+		{buf.Bytes(), 4 * 2 * 4},
+		{newAnimatedGIF(t), 3 * 4 * 4 * 4},
+		{[]byte("not an image"), 0},
+	}
+
+	for i, tt := range tests {
+		if got := decodedSize(tt.img); got != tt.want {
+			t.Errorf("%d. decodedSize returned %d, want %d", i, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_QueueTimeout(t *testing.T) {
+	// a blockingTransport that is already released just counts requests
+	bt := &blockingTransport{RoundTripper: &testTransport{}, release: make(chan struct{})}
+	close(bt.release)
+	p := NewProxy(bt, nil)
+	p.MaxTransformWait = time.Millisecond
+
+	// fill all transformation slots
+	tt := p.Client.Transport.(*staleTransport).Transport.Transport.(*TransformingTransport)
+	for range cap(tt.limiter) {
+		tt.limiter <- struct{}{}
+	}
+
+	req := httptest.NewRequest("GET", "http://localhost/100/http://good.test/png", nil)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	if got, want := resp.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("ServeHTTP returned status %d, want %d", got, want)
+	}
+	if resp.Header().Get("Retry-After") == "" {
+		t.Errorf("ServeHTTP did not return Retry-After header")
+	}
+	// the remote image is not fetched while waiting to be transformed
+	if got := bt.count.Load(); got != 0 {
+		t.Errorf("remote server received %d requests, want 0", got)
+	}
+}
+
+func TestTransformingTransport_FetchMemory(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		tr := &TransformingTransport{
+			Transport: &testTransport{},
+			queueLimits: func() queueLimits {
+				return queueLimits{maxWait: time.Second, maxMemory: 100}
+			},
+		}
+		// memory is in use by another image being transformed
+		release, err := tr.queue.reserveMemory(context.Background(), 100, tr.queueLimits(), nil)
+		if err != nil {
+			t.Fatalf("reserveMemory returned unexpected error: %v", err)
+		}
+		defer release()
+
+		ctx := context.WithValue(context.Background(), transformFetchKey{}, int64(1000))
+		req, _ := http.NewRequestWithContext(ctx, "GET", "http://good.test/png", nil)
+		if _, err := tr.RoundTrip(req); !errors.Is(err, errQueueTimeout) {
+			t.Errorf("RoundTrip returned error %v, want %v", err, errQueueTimeout)
+		}
+	})
+}
@@ -0,0 +1,208 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimit is a token bucket rate limit.
+type RateLimit struct {
+	// Rate is the number of requests allowed per second.  Zero means no
+	// limit.
+	Rate float64
+
+	// Burst is the maximum number of requests allowed at once.  If zero,
+	// Rate rounded up to a whole number is used.
+	Burst int
+}
+
+func (l RateLimit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return max(int(math.Ceil(l.Rate)), 1)
+}
+
+// ParseRateLimit parses a rate limit of the form "rate[/unit][:burst]", where
+// unit is one of "s", "m", or "h", and defaults to "s".  For example, "10/s"
+// allows 10 requests per second, and "600/m:100" allows 600 requests per
+// minute with bursts of up to 100 requests.
+func ParseRateLimit(s string) (RateLimit, error) {
+	var l RateLimit
+	s, burst, ok := strings.Cut(s, ":")
+	if ok {
+		var err error
+		if l.Burst, err = strconv.Atoi(burst); err != nil || l.Burst < 0 {
+			return l, fmt.Errorf("invalid rate limit burst %q", burst)
+		}
+	}
+
+	s, unit, _ := strings.Cut(s, "/")
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return l, fmt.Errorf("invalid rate limit %q", s)
+	}
+	switch unit {
+	case "", "s":
+		l.Rate = n
+	case "m":
+		l.Rate = n / 60
+	case "h":
+		l.Rate = n / 3600
+	default:
+		return l, fmt.Errorf("invalid rate limit unit %q", unit)
+	}
+	return l, nil
+}
+
+// rateLimiter tracks the token buckets of a rate limit applied separately to
+// each of a set of keys.
+type rateLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*keyLimiter
+	pruned   time.Time // last time idle limiters were removed
+}
+
+type keyLimiter struct {
+	limit   RateLimit
+	limiter *rate.Limiter
+	last    time.Time // last time the limiter was used
+}
+
+// allow reports whether a request for key is allowed by limit at time now.
+// If not, it also returns how long until the request would be allowed.
+func (rl *rateLimiter) allow(key string, limit RateLimit, now time.Time) (bool, time.Duration) {
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.limiters == nil {
+		rl.limiters = make(map[string]*keyLimiter)
+	}
+	if now.Sub(rl.pruned) > time.Minute {
+		// limiters that have been idle long enough to refill are no
+		// different from new ones, so can be removed.
+		for k, l := range rl.limiters {
+			refill := time.Duration(float64(l.limit.burst()) / l.limit.Rate * float64(time.Second))
+			if now.Sub(l.last) > refill {
+				delete(rl.limiters, k)
+			}
+		}
+		rl.pruned = now
+	}
+
+	l := rl.limiters[key]
+	if l == nil || l.limit != limit {
+		l = &keyLimiter{limit: limit, limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.burst())}
+		rl.limiters[key] = l
+	}
+	l.last = now
+
+	r := l.limiter.ReserveN(now, 1)
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return false, d
+	}
+	return true, 0
+}
+
+// rateLimitError is returned for requests that exceed a rate limit.
+type rateLimitError struct {
+	limit      string // name of the exceeded limit: client, key, or origin
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("%s rate limit exceeded", e.limit)
+}
+
+// rateLimitAuthorizer rejects requests that exceed p.ClientRateLimit,
+// p.KeyRateLimit, or p.OriginRateLimit.
+type rateLimitAuthorizer struct{}
+
+func (rateLimitAuthorizer) AuthorizeRequest(p *Proxy, r *Request) error {
+	now := p.now()
+
+	if r.Original != nil {
+		if ok, d := p.clientLimiter.allow(p.clientIP(r.Original), p.ClientRateLimit, now); !ok {
+			return &rateLimitError{"client", d}
+		}
+	}
+
+	if p.KeyRateLimit.Rate > 0 && r.Options.Signature != "" {
+		for _, key := range p.SignatureKeys {
+			if len(key) > 0 && validSignature(key, r) {
+				if ok, d := p.keyLimiter.allow(string(key), p.KeyRateLimit, now); !ok {
+					return &rateLimitError{"key", d}
+				}
+				break
+			}
+		}
+	}
+
+	if ok, d := p.originLimiter.allow(r.URL.Hostname(), p.OriginRateLimit, now); !ok {
+		return &rateLimitError{"origin", d}
+	}
+	return nil
+}
+
+// clientIP returns the IP address of the client that made r.  If r was
+// made by one of p.TrustedProxies, the last address in the X-Forwarded-For
+// header that is not a trusted proxy is used.
+func (p *Proxy) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	trusted, err := p.trustedProxies.parse(p.TrustedProxies)
+	if err != nil || !networksContain(trusted, ip) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		host = ip.String()
+		if !networksContain(trusted, ip) {
+			break
+		}
+	}
+	return host
+}
+
+// serveNotAllowed responds to req, which was not authorized because of err.
+func (p *Proxy) serveNotAllowed(w http.ResponseWriter, req *Request, err error) {
+	p.logf("%s: %v", err, req)
+
+	var rerr *rateLimitError
+	if errors.As(err, &rerr) {
+		metricRateLimited.WithLabelValues(rerr.limit).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rerr.retryAfter.Seconds()))))
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	http.Error(w, msgNotAllowed, http.StatusForbidden)
+}
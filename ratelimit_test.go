@@ -0,0 +1,159 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    RateLimit
+		wantErr bool
+	}{
+		{"10", RateLimit{Rate: 10}, false},
+		{"10/s", RateLimit{Rate: 10}, false},
+		{"0.5/s", RateLimit{Rate: 0.5}, false},
+		{"600/m", RateLimit{Rate: 10}, false},
+		{"7200/h:5", RateLimit{Rate: 2, Burst: 5}, false},
+		{"10:20", RateLimit{Rate: 10, Burst: 20}, false},
+		{"", RateLimit{}, true},
+		{"a/s", RateLimit{}, true},
+		{"-1/s", RateLimit{}, true},
+		{"10/d", RateLimit{}, true},
+		{"10/s:a", RateLimit{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRateLimit(tt.input)
+		if gotErr := err != nil; gotErr != tt.wantErr {
+			t.Errorf("ParseRateLimit(%q) returned error %v, want error: %t", tt.input, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("ParseRateLimit(%q) returned %+v, want %+v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var rl rateLimiter
+	limit := RateLimit{Rate: 1, Burst: 2}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		key       string
+		elapsed   time.Duration // time elapsed since the start of the test
+		want      bool
+		wantRetry time.Duration
+	}{
+		{"a", 0, true, 0},
+		{"a", 0, true, 0},
+		{"a", 0, false, time.Second},
+		{"b", 0, true, 0}, // keys are limited separately
+		{"a", 500 * time.Millisecond, false, 500 * time.Millisecond},
+		{"a", time.Second, true, 0},
+		{"a", time.Second, false, time.Second},
+		{"a", 10 * time.Minute, true, 0}, // after pruning
+		{"a", 10 * time.Minute, true, 0},
+		{"a", 10 * time.Minute, false, time.Second},
+	}
+
+	for i, tt := range tests {
+		ok, retry := rl.allow(tt.key, limit, now.Add(tt.elapsed))
+		if ok != tt.want || retry != tt.wantRetry {
+			t.Errorf("%d. allow(%q) returned %t, %v, want %t, %v", i, tt.key, ok, retry, tt.want, tt.wantRetry)
+		}
+	}
+	if got := len(rl.limiters); got != 1 {
+		t.Errorf("rateLimiter has %d limiters after pruning, want 1", got)
+	}
+
+	// zero rate means no limit
+	for range 10 {
+		if ok, _ := rl.allow("c", RateLimit{}, now); !ok {
+			t.Errorf("allow with zero rate limit returned false")
+		}
+	}
+}
+
+func TestProxy_ClientIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		forwarded  []string
+		trusted    []string
+		want       string
+	}{
+		{"1.2.3.4:1234", nil, nil, "1.2.3.4"},
+		{"1.2.3.4:1234", []string{"5.6.7.8"}, nil, "1.2.3.4"},
+		{"10.0.0.1:1234", []string{"5.6.7.8"}, []string{"10.0.0.0/8"}, "5.6.7.8"},
+		{"10.0.0.1:1234", []string{"9.9.9.9, 5.6.7.8"}, []string{"10.0.0.0/8"}, "5.6.7.8"},
+		{"10.0.0.1:1234", []string{"9.9.9.9, 5.6.7.8, 10.0.0.2"}, []string{"10.0.0.0/8"}, "5.6.7.8"},
+		{"10.0.0.1:1234", []string{"9.9.9.9", "5.6.7.8"}, []string{"10.0.0.0/8"}, "5.6.7.8"},
+		{"10.0.0.1:1234", []string{"10.0.0.2"}, []string{"10.0.0.0/8"}, "10.0.0.2"},
+		{"10.0.0.1:1234", []string{"invalid"}, []string{"10.0.0.0/8"}, "10.0.0.1"},
+		{"10.0.0.1:1234", nil, []string{"10.0.0.0/8"}, "10.0.0.1"},
+		{"[2001:db8::1]:1234", nil, nil, "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		p := &Proxy{TrustedProxies: tt.trusted}
+		r := httptest.NewRequest("GET", "http://localhost/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for _, f := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", f)
+		}
+		if got := p.clientIP(r); got != tt.want {
+			t.Errorf("clientIP(%q, %q) returned %q, want %q", tt.remoteAddr, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_RateLimit(t *testing.T) {
+	p := &Proxy{
+		Client:          &http.Client{Transport: &testTransport{}},
+		ClientRateLimit: RateLimit{Rate: 1},
+		OriginRateLimit: RateLimit{Rate: 1, Burst: 2},
+		AllowHosts:      []string{"a.test", "b.test"},
+		SignatureKeys:   [][]byte{[]byte("key")},
+		KeyRateLimit:    RateLimit{Rate: 1},
+		timeNow:         time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	tests := []struct {
+		url        string
+		remoteAddr string
+		code       int // expected response status code
+	}{
+		{"/http://a.test/png", "1.1.1.1:1234", http.StatusOK},
+		{"/http://b.test/png", "1.1.1.1:1234", http.StatusTooManyRequests}, // client limit
+		{"/http://a.test/png", "2.2.2.2:1234", http.StatusOK},
+		{"/http://a.test/png", "3.3.3.3:1234", http.StatusTooManyRequests}, // origin limit
+
+		// signed requests for the remote URL http://c.test/png
+		{"/sbn3UAu0jQbU1_kHPUIROBCPkQ3cewfBA7rZUbimW8oU=/http://c.test/png", "4.4.4.4:1234", http.StatusOK},
+		{"/sbn3UAu0jQbU1_kHPUIROBCPkQ3cewfBA7rZUbimW8oU=/http://c.test/png", "5.5.5.5:1234", http.StatusTooManyRequests}, // key limit
+		{"/http://d.test/png", "5.5.5.5:1234", http.StatusForbidden},                                                     // not signed
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://localhost"+tt.url, nil)
+		req.RemoteAddr = tt.remoteAddr
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("ServeHTTP(%v) from %v returned status %d, want %d", tt.url, tt.remoteAddr, got, want)
+		}
+		if resp.Code == http.StatusTooManyRequests {
+			if got, want := resp.Header().Get("Retry-After"), "1"; got != want {
+				t.Errorf("ServeHTTP(%v) from %v returned Retry-After %q, want %q", tt.url, tt.remoteAddr, got, want)
+			}
+		}
+	}
+}
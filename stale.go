@@ -0,0 +1,250 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gregjones/httpcache"
+	tphc "willnorris.com/go/imageproxy/third_party/httpcache"
+)
+
+// staleTransport is an http.RoundTripper that serves stale responses from
+// the cache of an httpcache.Transport, as allowed by the
+// stale-while-revalidate and stale-if-error cache-control directives of the
+// cached responses (RFC 5861).
+type staleTransport struct {
+	// Transport is the caching transport whose responses are served
+	// stale.
+	Transport *httpcache.Transport
+
+	// now returns the current time.  If nil, time.Now is used.
+	now func() time.Time
+
+	// refreshing holds the cache keys of responses being refreshed in the
+	// background.
+	refreshing sync.Map
+}
+
+// refreshTimeout is the maximum duration of background revalidations of
+// stale responses.
+const refreshTimeout = time.Minute
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *staleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" || req.Header.Get("Range") != "" {
+		return t.Transport.RoundTrip(req)
+	}
+
+	// the cached response is looked up once, and reused by t.Transport
+	key := req.URL.String()
+	b, ok := t.Transport.Cache.Get(key)
+	transport := t.withCached(key, b, ok)
+	if !ok {
+		return transport.RoundTrip(req)
+	}
+	cached, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), req)
+	if err != nil {
+		return transport.RoundTrip(req)
+	}
+
+	// httpcache handles matching the request headers of varied responses
+	if cached.Header.Get("Vary") == "" {
+		now := time.Now()
+		if t.now != nil {
+			now = t.now()
+		}
+		cc := tphc.ParseCacheControl(cached.Header)
+		if stale, ok := staleness(cached.Header, cc, now); ok && stale > 0 {
+			switch {
+			case stale < directiveSeconds(cc, "stale-while-revalidate"):
+				t.refresh(req, t.withCached(key, b, true))
+				if t.Transport.MarkCachedResponses {
+					cached.Header.Set(httpcache.XFromCache, "1")
+				}
+				metricStaleResponses.WithLabelValues("revalidate").Inc()
+				return cached, nil
+			case stale < directiveSeconds(cc, "stale-if-error"):
+				cached.Body.Close()
+				return roundTripStaleIfError(transport, req, now)
+			}
+		}
+	}
+
+	cached.Body.Close()
+	return transport.RoundTrip(req)
+}
+
+// withCached returns a copy of t.Transport that uses value, which was
+// already looked up in its cache at key, rather than looking it up again.
+func (t *staleTransport) withCached(key string, value []byte, ok bool) *httpcache.Transport {
+	transport := *t.Transport
+	transport.Cache = &lookupCache{Cache: t.Transport.Cache, key: key, value: value, ok: ok}
+	return &transport
+}
+
+// lookupCache is a Cache whose value at key has already been looked up.  The
+// first Get of key returns that value, and subsequent calls use Cache.
+type lookupCache struct {
+	httpcache.Cache
+
+	mu    sync.Mutex
+	key   string
+	value []byte
+	ok    bool
+	used  bool
+}
+
+func (c *lookupCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	if key == c.key && !c.used {
+		c.used = true
+		c.mu.Unlock()
+		return c.value, c.ok
+	}
+	c.mu.Unlock()
+	return c.Cache.Get(key)
+}
+
+func (c *lookupCache) Set(key string, value []byte) {
+	c.forget(key)
+	c.Cache.Set(key, value)
+}
+
+func (c *lookupCache) Delete(key string) {
+	c.forget(key)
+	c.Cache.Delete(key)
+}
+
+// forget stops using the value looked up at key, which is being changed.
+func (c *lookupCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key == c.key {
+		c.used = true
+	}
+}
+
+// roundTripStaleIfError sends req using transport, which serves the stale
+// cached response if the remote server cannot be reached or returns an
+// error.
+func roundTripStaleIfError(transport *httpcache.Transport, req *http.Request, now time.Time) (*http.Response, error) {
+	// Rather than removing the cached response when revalidating it
+	// fails, httpcache serves it if the request includes the
+	// stale-if-error directive.  The directive is only added for
+	// httpcache, and the original header is restored before the request
+	// is sent upstream.
+	ctx := context.WithValue(req.Context(), staleIfErrorKey{}, req.Header.Values("Cache-Control"))
+	req = req.Clone(ctx)
+	req.Header.Add("Cache-Control", "stale-if-error")
+	t := *transport
+	t.Transport = upstreamTransport{transport.Transport}
+
+	resp, err := t.RoundTrip(req)
+	if err == nil && resp.Header.Get(httpcache.XFromCache) != "" {
+		if stale, ok := staleness(resp.Header, tphc.ParseCacheControl(resp.Header), now); ok && stale > 0 {
+			metricStaleResponses.WithLabelValues("error").Inc()
+		}
+	}
+	return resp, err
+}
+
+// staleIfErrorKey is the context key of requests that roundTripStaleIfError
+// added the stale-if-error directive to.  Its value is the original
+// Cache-Control header of the request.
+type staleIfErrorKey struct{}
+
+// upstreamTransport is an http.RoundTripper that restores the original
+// Cache-Control header of requests sent by roundTripStaleIfError, so that
+// the stale-if-error directive added for httpcache is not sent to the
+// remote server.
+type upstreamTransport struct {
+	http.RoundTripper
+}
+
+func (t upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if cc, ok := req.Context().Value(staleIfErrorKey{}).([]string); ok {
+		req = req.Clone(req.Context())
+		req.Header.Del("Cache-Control")
+		for _, v := range cc {
+			req.Header.Add("Cache-Control", v)
+		}
+	}
+
+	transport := t.RoundTripper
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	return transport.RoundTrip(req)
+}
+
+// refresh revalidates the cached response for req in the background using
+// transport, unless it is already being refreshed.  Revalidation is
+// abandoned after refreshTimeout.
+func (t *staleTransport) refresh(req *http.Request, transport *httpcache.Transport) {
+	key := req.URL.String()
+	if _, loaded := t.refreshing.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), refreshTimeout)
+	req = req.Clone(ctx)
+	go func() {
+		defer t.refreshing.Delete(key)
+		defer cancel()
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			return
+		}
+		// httpcache stores the response once its body is read
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// staleness returns how long ago the response with header hdr became stale,
+// which is negative if it is still fresh.  It returns false if the response
+// must be revalidated before being served, or its freshness lifetime is
+// unknown.
+func staleness(hdr http.Header, cc tphc.CacheControl, now time.Time) (time.Duration, bool) {
+	for _, directive := range []string{"no-cache", "must-revalidate", "proxy-revalidate"} {
+		if _, ok := cc[directive]; ok {
+			return 0, false
+		}
+	}
+
+	date, err := httpcache.Date(hdr)
+	if err != nil {
+		return 0, false
+	}
+
+	var lifetime time.Duration
+	if maxAge, ok := cc["max-age"]; ok {
+		if lifetime, err = time.ParseDuration(maxAge + "s"); err != nil {
+			return 0, false
+		}
+	} else if expires, err := time.Parse(time.RFC1123, hdr.Get("Expires")); err == nil {
+		lifetime = expires.Sub(date)
+	} else {
+		return 0, false
+	}
+
+	return now.Sub(date) - lifetime, true
+}
+
+// directiveSeconds returns the duration of a cache-control directive with a
+// value in seconds, or zero if it is missing or invalid.
+func directiveSeconds(cc tphc.CacheControl, directive string) time.Duration {
+	d, err := time.ParseDuration(cc[directive] + "s")
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
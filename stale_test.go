@@ -0,0 +1,177 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/gregjones/httpcache"
+	tphc "willnorris.com/go/imageproxy/third_party/httpcache"
+)
+
+func TestStaleness(t *testing.T) {
+	date := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := date.Add(time.Hour)
+
+	tests := []struct {
+		header http.Header
+		want   time.Duration
+		wantOK bool
+	}{
+		{http.Header{"Cache-Control": {"max-age=600"}}, 0, false}, // no date
+		{http.Header{"Date": {date.Format(http.TimeFormat)}}, 0, false},
+		{http.Header{"Date": {date.Format(http.TimeFormat)}, "Cache-Control": {"max-age=600"}}, 50 * time.Minute, true},
+		{http.Header{"Date": {date.Format(http.TimeFormat)}, "Cache-Control": {"max-age=7200"}}, -time.Hour, true},
+		{http.Header{"Date": {date.Format(http.TimeFormat)}, "Expires": {date.Add(30 * time.Minute).Format(http.TimeFormat)}}, 30 * time.Minute, true},
+		{http.Header{"Date": {date.Format(http.TimeFormat)}, "Cache-Control": {"max-age=600, must-revalidate"}}, 0, false},
+		{http.Header{"Date": {date.Format(http.TimeFormat)}, "Cache-Control": {"no-cache"}}, 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := staleness(tt.header, tphc.ParseCacheControl(tt.header), now)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("staleness(%v) returned %v, %t, want %v, %t", tt.header, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// originTransport is a RoundTripper that counts requests, and serves
+// testTransport responses after a second with the current date and a one
+// minute max-age, or an error if fail is set.
+type originTransport struct {
+	count        atomic.Int32
+	fail         atomic.Bool
+	cacheControl atomic.Bool // whether any request had a Cache-Control header
+}
+
+func (t *originTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.count.Add(1)
+	if req.Header.Get("Cache-Control") != "" {
+		t.cacheControl.Store(true)
+	}
+	if t.fail.Load() {
+		return nil, errors.New("remote server unavailable")
+	}
+	time.Sleep(time.Second)
+	resp, err := new(testTransport).RoundTrip(req)
+	if err == nil {
+		resp.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		resp.Header.Set("Cache-Control", "max-age=60")
+	}
+	return resp, err
+}
+
+func TestProxy_ServeHTTP_Stale(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		origin := new(originTransport)
+		p := NewProxy(origin, httpcache.NewMemoryCache())
+		p.StaleWhileRevalidate = time.Minute
+		p.StaleIfError = time.Hour
+
+		tests := []struct {
+			elapsed   time.Duration // time elapsed since the previous request
+			fail      bool          // whether the remote server fails
+			code      int           // expected response status code
+			wantWait  bool          // whether the response waits for the remote server
+			wantCount int32         // expected remote requests, including background ones
+		}{
+			{0, false, http.StatusOK, true, 1},
+			{30 * time.Second, false, http.StatusOK, false, 1},              // fresh
+			{60 * time.Second, false, http.StatusOK, false, 2},              // stale, revalidated in the background
+			{150 * time.Second, true, http.StatusOK, false, 3},              // stale, remote error
+			{2 * time.Hour, true, http.StatusInternalServerError, false, 4}, // too stale
+		}
+
+		for i, tt := range tests {
+			time.Sleep(tt.elapsed)
+			origin.fail.Store(tt.fail)
+
+			req := httptest.NewRequest("GET", "http://localhost/http://good.test/png", nil)
+			resp := httptest.NewRecorder()
+			start := time.Now()
+			p.ServeHTTP(resp, req)
+			waited := time.Since(start) > 0
+			synctest.Wait()
+
+			if got, want := resp.Code, tt.code; got != want {
+				t.Errorf("%d. ServeHTTP returned status %d, want %d", i, got, want)
+			}
+			if waited != tt.wantWait {
+				t.Errorf("%d. ServeHTTP waited for remote server: %t, want %t", i, waited, tt.wantWait)
+			}
+			if got, want := origin.count.Load(), tt.wantCount; got != want {
+				t.Errorf("%d. remote server received %d requests, want %d", i, got, want)
+			}
+		}
+		if origin.cacheControl.Load() {
+			t.Errorf("remote server received request with Cache-Control header")
+		}
+	})
+}
+
+// countingCache is a Cache that counts the lookups of each key.
+type countingCache struct {
+	httpcache.Cache
+
+	mu   sync.Mutex
+	gets map[string]int
+}
+
+func (c *countingCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	c.gets[key]++
+	c.mu.Unlock()
+	return c.Cache.Get(key)
+}
+
+func TestStaleTransport_CacheLookups(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		cache := &countingCache{Cache: httpcache.NewMemoryCache(), gets: make(map[string]int)}
+		transport := &staleTransport{
+			Transport: &httpcache.Transport{Transport: new(originTransport), Cache: cache},
+		}
+		const u = "http://good.test/png"
+
+		tests := []struct {
+			elapsed time.Duration // time elapsed since the previous request
+			cc      string        // Cache-Control of the cached response
+		}{
+			{0, ""},                // not cached
+			{30 * time.Second, ""}, // fresh
+			{90 * time.Second, "stale-if-error=3600"}, // stale, revalidated
+		}
+
+		for i, tt := range tests {
+			time.Sleep(tt.elapsed)
+			if tt.cc != "" {
+				b, _ := cache.Cache.Get(u)
+				b = []byte(strings.Replace(string(b), "max-age=60", "max-age=60, "+tt.cc, 1))
+				cache.Cache.Set(u, b)
+			}
+			clear(cache.gets)
+
+			req := httptest.NewRequest("GET", u, nil)
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("%d. RoundTrip returned unexpected error: %v", i, err)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			synctest.Wait()
+
+			if got, want := cache.gets[u], 1; got != want {
+				t.Errorf("%d. RoundTrip looked up cached response %d times, want %d", i, got, want)
+			}
+		}
+	})
+}
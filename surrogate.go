@@ -0,0 +1,95 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// surrogateKeys returns the surrogate keys of the response to req, which
+// CDNs can use to purge related images together:
+//
+//   - "host-{host}" identifies all images from a remote host
+//   - "url-{hash}" identifies all variants of a remote image
+//   - "opts-{hash}" identifies all images transformed with the same options,
+//     after any presets are expanded, however the requests were signed
+func surrogateKeys(req *Request) []string {
+	return []string{
+		"host-" + req.URL.Hostname(),
+		urlSurrogateKey(req.URL),
+		"opts-" + hashKey(req.Options.unsigned().String()),
+	}
+}
+
+// urlSurrogateKey returns the surrogate key identifying all variants of the
+// remote image at u.
+func urlSurrogateKey(u *url.URL) string {
+	u = &url.URL{
+		Scheme:   u.Scheme,
+		User:     u.User,
+		Host:     u.Host,
+		Path:     u.Path,
+		RawPath:  u.RawPath,
+		RawQuery: u.RawQuery,
+	}
+	return "url-" + hashKey(u.String())
+}
+
+// hashKey returns a short hash of s, for use in surrogate keys.
+func hashKey(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+// setSurrogateKeys sets the Surrogate-Key and Cache-Tag headers of h to the
+// surrogate keys of req.
+func setSurrogateKeys(h http.Header, req *Request) {
+	keys := surrogateKeys(req)
+	h.Set("Surrogate-Key", strings.Join(keys, " "))
+	h.Set("Cache-Tag", strings.Join(keys, ","))
+}
+
+// purgeEvent is the body of requests sent to Proxy.PurgeWebhook.
+type purgeEvent struct {
+	URL          string `json:"url"`
+	SurrogateKey string `json:"surrogate_key"`
+}
+
+// notifyPurge sends a purge event for the remote image at u to
+// p.PurgeWebhook.
+func (p *Proxy) notifyPurge(ctx context.Context, u *url.URL) error {
+	key := urlSurrogateKey(u)
+	body, err := json.Marshal(purgeEvent{URL: u.String(), SurrogateKey: key})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", p.PurgeWebhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Surrogate-Key", key)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("purge webhook returned status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSurrogateKeys(t *testing.T) {
+	req := func(u, opts string) *Request {
+		parsed, _ := url.Parse(u)
+		return &Request{URL: parsed, Options: ParseOptions(opts)}
+	}
+
+	a := surrogateKeys(req("http://a.test/img.png", "100"))
+	tests := []struct {
+		req  *Request
+		want []bool // whether each key matches the corresponding key of a
+	}{
+		{req("http://a.test/img.png", "100"), []bool{true, true, true}},
+		{req("http://a.test/img.png", "200"), []bool{true, true, false}},
+		{req("http://a.test/img.png#frag", "100"), []bool{true, true, true}},
+		{req("http://a.test/other.png", "100"), []bool{true, false, true}},
+		{req("http://b.test/img.png", "100x100"), []bool{false, false, true}},
+		{req("http://a.test/img.png", "100,sc2lnbmF0dXJlMQ=="), []bool{true, true, true}},
+		{req("http://a.test/img.png", "100,sc2lnbmF0dXJlMg==,vu1893456000"), []bool{true, true, true}},
+	}
+
+	for _, tt := range tests {
+		got := surrogateKeys(tt.req)
+		for i := range got {
+			if match := got[i] == a[i]; match != tt.want[i] {
+				t.Errorf("surrogateKeys(%v) key %d is %q, want match with %q: %t", tt.req, i, got[i], a[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestProxy_ServeHTTP_SurrogateKeys(t *testing.T) {
+	p := NewProxy(&testTransport{}, nil)
+	p.SurrogateKeys = true
+
+	req := httptest.NewRequest("GET", "http://localhost/100/http://good.test/png", nil)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	r, _ := p.newRequest(req)
+	r.Options.ScaleUp = p.ScaleUp
+	keys := surrogateKeys(r)
+	if got, want := resp.Header().Get("Surrogate-Key"), strings.Join(keys, " "); got != want {
+		t.Errorf("ServeHTTP returned Surrogate-Key %q, want %q", got, want)
+	}
+	if got, want := resp.Header().Get("Cache-Tag"), strings.Join(keys, ","); got != want {
+		t.Errorf("ServeHTTP returned Cache-Tag %q, want %q", got, want)
+	}
+}
+
+func TestProxy_ServeHTTP_PurgeWebhook(t *testing.T) {
+	var event purgeEvent
+	var header string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		}
+		header = r.Header.Get("Surrogate-Key")
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("error decoding purge event: %v", err)
+		}
+	}))
+	defer webhook.Close()
+
+	p := NewProxy(&testTransport{}, nil)
+	p.AdminToken = "token"
+	p.PurgeWebhook = webhook.URL
+
+	req := httptest.NewRequest("POST", "http://localhost"+PurgePath, strings.NewReader("url=http://good.test/png"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer token")
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("ServeHTTP returned status %d, want %d", got, want)
+	}
+	u, _ := url.Parse("http://good.test/png")
+	want := purgeEvent{URL: u.String(), SurrogateKey: urlSurrogateKey(u)}
+	if event != want {
+		t.Errorf("webhook received purge event %+v, want %+v", event, want)
+	}
+	if header != want.SurrogateKey {
+		t.Errorf("webhook received Surrogate-Key %q, want %q", header, want.SurrogateKey)
+	}
+
+	// webhook errors are reported
+	p.PurgeWebhook = webhook.URL + "/error"
+	resp = httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "http://localhost"+PurgePath, strings.NewReader("url=http://good.test/png"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer token")
+	p.ServeHTTP(resp, req)
+	if got, want := resp.Code, http.StatusBadGateway; got != want {
+		t.Errorf("ServeHTTP with invalid webhook returned status %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,831 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package jpeg implements a JPEG image encoder.  It is based on the encoder
+// in the standard library's image/jpeg package, with the addition of support
+// for writing progressive JPEGs and for choosing the chroma subsampling ratio.
+package jpeg
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// div returns a/b rounded to the nearest integer, instead of rounded to zero.
+func div(a, b int32) int32 {
+	if a >= 0 {
+		return (a + (b >> 1)) / b
+	}
+	return -((-a + (b >> 1)) / b)
+}
+
+// bitCount counts the number of bits needed to hold an integer.
+var bitCount = [256]byte{
+	0, 1, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 4, 4, 4, 4,
+	5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5,
+	6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6,
+	6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6,
+	7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7,
+	7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7,
+	7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7,
+	7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7,
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8,
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8,
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8,
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8,
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8,
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8,
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8,
+	8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8,
+}
+
+type quantIndex int
+
+const (
+	quantIndexLuminance quantIndex = iota
+	quantIndexChrominance
+	nQuantIndex
+)
+
+// unscaledQuant are the unscaled quantization tables in zig-zag order. Each
+// encoder copies and scales the tables according to its quality parameter.
+// The values are derived from section K.1 of the spec, after converting from
+// natural to zig-zag order.
+var unscaledQuant = [nQuantIndex][blockSize]byte{
+	// Luminance.
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	// Chrominance.
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+type huffIndex int
+
+const (
+	huffIndexLuminanceDC huffIndex = iota
+	huffIndexLuminanceAC
+	huffIndexChrominanceDC
+	huffIndexChrominanceAC
+	nHuffIndex
+)
+
+// huffmanSpec specifies a Huffman encoding.
+type huffmanSpec struct {
+	// count[i] is the number of codes of length i+1 bits.
+	count [16]byte
+	// value[i] is the decoded value of the i'th codeword.
+	value []byte
+}
+
+// theHuffmanSpec is the Huffman encoding specifications.
+//
+// This encoder uses the same Huffman encoding for all images. It is also the
+// same Huffman encoding used by section K.3 of the spec.
+//
+// The DC tables have 12 decoded values, called categories.
+//
+// The AC tables have 162 decoded values: bytes that pack a 4-bit Run and a
+// 4-bit Size. There are 16 valid Runs and 10 valid Sizes, plus two special R|S
+// cases: 0|0 (meaning EOB) and F|0 (meaning ZRL).
+var theHuffmanSpec = [nHuffIndex]huffmanSpec{
+	// Luminance DC.
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	// Luminance AC.
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	// Chrominance DC.
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	// Chrominance AC.
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// huffmanLUT is a compiled look-up table representation of a huffmanSpec.
+// Each value maps to a uint32 of which the 8 most significant bits hold the
+// codeword size in bits and the 24 least significant bits hold the codeword.
+// The maximum codeword size is 16 bits.
+type huffmanLUT []uint32
+
+func (h *huffmanLUT) init(s huffmanSpec) {
+	maxValue := 0
+	for _, v := range s.value {
+		if int(v) > maxValue {
+			maxValue = int(v)
+		}
+	}
+	*h = make([]uint32, maxValue+1)
+	code, k := uint32(0), 0
+	for i := 0; i < len(s.count); i++ {
+		nBits := uint32(i+1) << 24
+		for j := uint8(0); j < s.count[i]; j++ {
+			(*h)[s.value[k]] = nBits | code
+			code++
+			k++
+		}
+		code <<= 1
+	}
+}
+
+// theHuffmanLUT are compiled representations of theHuffmanSpec.
+var theHuffmanLUT [4]huffmanLUT
+
+func init() {
+	for i, s := range theHuffmanSpec {
+		theHuffmanLUT[i].init(s)
+	}
+}
+
+// writer is a buffered writer.
+type writer interface {
+	Flush() error
+	io.Writer
+	io.ByteWriter
+}
+
+// encoder encodes an image to the JPEG format.
+type encoder struct {
+	// w is the writer to write to. err is the first error encountered during
+	// writing. All attempted writes after the first error become no-ops.
+	w   writer
+	err error
+	// buf is a scratch buffer.
+	buf [16]byte
+	// bits and nBits are accumulated bits to write to w.
+	bits, nBits uint32
+	// quant is the scaled quantization tables, in zig-zag order.
+	quant [nQuantIndex][blockSize]byte
+	// size is the size of the image being encoded.
+	size image.Point
+	// comp is the components of the image being encoded.
+	comp []component
+}
+
+func (e *encoder) flush() {
+	if e.err != nil {
+		return
+	}
+	e.err = e.w.Flush()
+}
+
+func (e *encoder) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(p)
+}
+
+func (e *encoder) writeByte(b byte) {
+	if e.err != nil {
+		return
+	}
+	e.err = e.w.WriteByte(b)
+}
+
+// emit emits the least significant nBits bits of bits to the bit-stream.
+// The precondition is bits < 1<<nBits && nBits <= 16.
+func (e *encoder) emit(bits, nBits uint32) {
+	nBits += e.nBits
+	bits <<= 32 - nBits
+	bits |= e.bits
+	for nBits >= 8 {
+		b := uint8(bits >> 24)
+		e.writeByte(b)
+		if b == 0xff {
+			e.writeByte(0x00)
+		}
+		bits <<= 8
+		nBits -= 8
+	}
+	e.bits, e.nBits = bits, nBits
+}
+
+// emitHuff emits the given value with the given Huffman encoder.
+func (e *encoder) emitHuff(h huffIndex, value int32) {
+	x := theHuffmanLUT[h][value]
+	e.emit(x&(1<<24-1), x>>24)
+}
+
+// emitHuffRLE emits a run of runLength copies of value encoded with the given
+// Huffman encoder.
+func (e *encoder) emitHuffRLE(h huffIndex, runLength, value int32) {
+	a, b := value, value
+	if a < 0 {
+		a, b = -value, value-1
+	}
+	var nBits uint32
+	if a < 0x100 {
+		nBits = uint32(bitCount[a])
+	} else {
+		nBits = 8 + uint32(bitCount[a>>8])
+	}
+	e.emitHuff(h, runLength<<4|int32(nBits))
+	if nBits > 0 {
+		e.emit(uint32(b)&(1<<nBits-1), nBits)
+	}
+}
+
+// writeMarkerHeader writes the header for a marker with the given length.
+func (e *encoder) writeMarkerHeader(marker uint8, markerlen int) {
+	e.buf[0] = 0xff
+	e.buf[1] = marker
+	e.buf[2] = uint8(markerlen >> 8)
+	e.buf[3] = uint8(markerlen & 0xff)
+	e.write(e.buf[:4])
+}
+
+// writeDQT writes the Define Quantization Table marker.
+func (e *encoder) writeDQT() {
+	const markerlen = 2 + int(nQuantIndex)*(1+blockSize)
+	e.writeMarkerHeader(dqtMarker, markerlen)
+	for i := range e.quant {
+		e.writeByte(uint8(i))
+		e.write(e.quant[i][:])
+	}
+}
+
+// toYCbCr converts the 8x8 region of m whose top-left corner is p to its
+// YCbCr values.
+func toYCbCr(m image.Image, p image.Point, yBlock, cbBlock, crBlock *block) {
+	b := m.Bounds()
+	xmax := b.Max.X - 1
+	ymax := b.Max.Y - 1
+	for j := 0; j < 8; j++ {
+		for i := 0; i < 8; i++ {
+			r, g, b, _ := m.At(min(p.X+i, xmax), min(p.Y+j, ymax)).RGBA()
+			yy, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			yBlock[8*j+i] = int32(yy)
+			cbBlock[8*j+i] = int32(cb)
+			crBlock[8*j+i] = int32(cr)
+		}
+	}
+}
+
+// grayToY stores the 8x8 region of m whose top-left corner is p in yBlock.
+func grayToY(m *image.Gray, p image.Point, yBlock *block) {
+	b := m.Bounds()
+	xmax := b.Max.X - 1
+	ymax := b.Max.Y - 1
+	pix := m.Pix
+	for j := 0; j < 8; j++ {
+		for i := 0; i < 8; i++ {
+			idx := m.PixOffset(min(p.X+i, xmax), min(p.Y+j, ymax))
+			yBlock[8*j+i] = int32(pix[idx])
+		}
+	}
+}
+
+// rgbaToYCbCr is a specialized version of toYCbCr for image.RGBA images.
+func rgbaToYCbCr(m *image.RGBA, p image.Point, yBlock, cbBlock, crBlock *block) {
+	b := m.Bounds()
+	xmax := b.Max.X - 1
+	ymax := b.Max.Y - 1
+	for j := 0; j < 8; j++ {
+		sj := p.Y + j
+		if sj > ymax {
+			sj = ymax
+		}
+		offset := (sj-b.Min.Y)*m.Stride - b.Min.X*4
+		for i := 0; i < 8; i++ {
+			sx := p.X + i
+			if sx > xmax {
+				sx = xmax
+			}
+			pix := m.Pix[offset+sx*4:]
+			yy, cb, cr := color.RGBToYCbCr(pix[0], pix[1], pix[2])
+			yBlock[8*j+i] = int32(yy)
+			cbBlock[8*j+i] = int32(cb)
+			crBlock[8*j+i] = int32(cr)
+		}
+	}
+}
+
+// yCbCrToYCbCr is a specialized version of toYCbCr for image.YCbCr images.
+func yCbCrToYCbCr(m *image.YCbCr, p image.Point, yBlock, cbBlock, crBlock *block) {
+	b := m.Bounds()
+	xmax := b.Max.X - 1
+	ymax := b.Max.Y - 1
+	for j := 0; j < 8; j++ {
+		sy := p.Y + j
+		if sy > ymax {
+			sy = ymax
+		}
+		for i := 0; i < 8; i++ {
+			sx := p.X + i
+			if sx > xmax {
+				sx = xmax
+			}
+			yi := m.YOffset(sx, sy)
+			ci := m.COffset(sx, sy)
+			yBlock[8*j+i] = int32(m.Y[yi])
+			cbBlock[8*j+i] = int32(m.Cb[ci])
+			crBlock[8*j+i] = int32(m.Cr[ci])
+		}
+	}
+}
+
+// Markers used by the encoder.  See Section B.1.1.3 of the spec.
+const (
+	sof0Marker = 0xc0 // Start Of Frame (Baseline Sequential).
+	sof2Marker = 0xc2 // Start Of Frame (Progressive).
+	dhtMarker  = 0xc4 // Define Huffman Table.
+	sosMarker  = 0xda // Start Of Scan.
+	dqtMarker  = 0xdb // Define Quantization Table.
+)
+
+// unzig maps from the zig-zag ordering to the natural ordering. For example,
+// unzig[3] is the column and row of the fourth element in zig-zag order. The
+// value is 16, which means first column (16%8 == 0) and third row (16/8 == 2).
+var unzig = [blockSize]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// component is a color component of the image being encoded.
+type component struct {
+	// h and v are the horizontal and vertical sampling factors.
+	h, v int
+	// q is the quantization table, which also identifies the Huffman tables.
+	q quantIndex
+	// bw and bh are the width and height of the component in blocks, padded
+	// to a whole number of MCUs.
+	bw, bh int
+	// coeffs are the quantized DCT coefficients of each block, in zig-zag
+	// order.  Blocks are stored in row-major order.
+	coeffs [][blockSize]int16
+}
+
+// scan is a scan of the coefficients from ss to se, inclusive, of the listed
+// components.
+type scan struct {
+	comps  []int
+	ss, se int
+}
+
+// progressiveScans is the sequence of scans used to encode progressive
+// images with three components: the DC coefficients of all components first,
+// then the lowest frequency AC coefficients of the luminance, the AC
+// coefficients of the chrominance, and finally the remaining AC coefficients
+// of the luminance.  Only spectral selection is used, not successive
+// approximation.
+var progressiveScans = []scan{
+	{[]int{0, 1, 2}, 0, 0},
+	{[]int{0}, 1, 5},
+	{[]int{1}, 1, 63},
+	{[]int{2}, 1, 63},
+	{[]int{0}, 6, 63},
+}
+
+// progressiveScansGray is the sequence of scans used to encode progressive
+// grayscale images.
+var progressiveScansGray = []scan{
+	{[]int{0}, 0, 0},
+	{[]int{0}, 1, 5},
+	{[]int{0}, 6, 63},
+}
+
+// writeSOF writes the Start Of Frame marker.
+func (e *encoder) writeSOF(marker uint8) {
+	markerlen := 8 + 3*len(e.comp)
+	e.writeMarkerHeader(marker, markerlen)
+	e.buf[0] = 8 // 8-bit color.
+	e.buf[1] = uint8(e.size.Y >> 8)
+	e.buf[2] = uint8(e.size.Y & 0xff)
+	e.buf[3] = uint8(e.size.X >> 8)
+	e.buf[4] = uint8(e.size.X & 0xff)
+	e.buf[5] = uint8(len(e.comp))
+	for i, c := range e.comp {
+		e.buf[3*i+6] = uint8(i + 1)
+		e.buf[3*i+7] = uint8(c.h<<4 | c.v)
+		e.buf[3*i+8] = uint8(c.q)
+	}
+	e.write(e.buf[:3*len(e.comp)+6])
+}
+
+// writeDHT writes the Define Huffman Table marker.
+func (e *encoder) writeDHT() {
+	markerlen := 2
+	specs := theHuffmanSpec[:]
+	if len(e.comp) == 1 {
+		// Drop the Chrominance tables.
+		specs = specs[:2]
+	}
+	for _, s := range specs {
+		markerlen += 1 + 16 + len(s.value)
+	}
+	e.writeMarkerHeader(dhtMarker, markerlen)
+	for i, s := range specs {
+		e.writeByte("\x00\x10\x01\x11"[i])
+		e.write(s.count[:])
+		e.write(s.value)
+	}
+}
+
+// scale scales the region represented by the h*v src blocks, in row-major
+// order, to the 8x8 dst block.
+func scale(dst *block, src *[4]block, h, v int) {
+	n := int32(h * v)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			var sum int32
+			for dy := 0; dy < v; dy++ {
+				for dx := 0; dx < h; dx++ {
+					sx, sy := h*x+dx, v*y+dy
+					sum += src[(sy/8)*h+sx/8][8*(sy%8)+sx%8]
+				}
+			}
+			dst[8*y+x] = (sum + n/2) / n
+		}
+	}
+}
+
+// quantize transforms b, which is in natural (not zig-zag) order, and stores
+// its quantized DCT coefficients as the block at (x, y) of c.
+func (e *encoder) quantize(b *block, c *component, x, y int) {
+	fdct(b)
+	dst := &c.coeffs[y*c.bw+x]
+	for zig := 0; zig < blockSize; zig++ {
+		dst[zig] = int16(div(b[unzig[zig]], 8*int32(e.quant[c.q][zig])))
+	}
+}
+
+// transform computes the quantized DCT coefficients of every block of m.  If
+// baseline is not nil, the coefficients of each MCU are written as part of
+// that scan as soon as they are computed, and only the coefficients of one
+// MCU are stored at a time.  Otherwise, the coefficients of the whole image
+// are stored, to be written by writeScan.
+func (e *encoder) transform(m image.Image, baseline *scan) {
+	bounds := m.Bounds()
+	// The luminance component has the largest sampling factors.
+	hmax, vmax := e.comp[0].h, e.comp[0].v
+	mcusX := (e.size.X + 8*hmax - 1) / (8 * hmax)
+	mcusY := (e.size.Y + 8*vmax - 1) / (8 * vmax)
+	for i := range e.comp {
+		c := &e.comp[i]
+		c.bw, c.bh = mcusX*c.h, mcusY*c.v
+		if baseline != nil {
+			c.bw, c.bh = c.h, c.v
+		}
+		c.coeffs = make([][blockSize]int16, c.bw*c.bh)
+	}
+
+	var (
+		// Scratch buffers to hold the YCbCr values.
+		// The blocks are in natural (not zig-zag) order.
+		b      block
+		cb, cr [4]block
+	)
+	var prevDC [3]int32
+	gray, _ := m.(*image.Gray)
+	rgba, _ := m.(*image.RGBA)
+	ycbcr, _ := m.(*image.YCbCr)
+	for my := 0; my < mcusY; my++ {
+		for mx := 0; mx < mcusX; mx++ {
+			// (ox, oy) is the position of the MCU in the stored
+			// coefficients.
+			ox, oy := mx, my
+			if baseline != nil {
+				ox, oy = 0, 0
+			}
+			for i := 0; i < hmax*vmax; i++ {
+				bx, by := mx*hmax+i%hmax, my*vmax+i/hmax
+				p := image.Pt(bounds.Min.X+8*bx, bounds.Min.Y+8*by)
+				switch {
+				case gray != nil:
+					grayToY(gray, p, &b)
+				case rgba != nil:
+					rgbaToYCbCr(rgba, p, &b, &cb[i], &cr[i])
+				case ycbcr != nil:
+					yCbCrToYCbCr(ycbcr, p, &b, &cb[i], &cr[i])
+				default:
+					toYCbCr(m, p, &b, &cb[i], &cr[i])
+				}
+				e.quantize(&b, &e.comp[0], ox*hmax+i%hmax, oy*vmax+i/hmax)
+			}
+			if len(e.comp) == 3 {
+				scale(&b, &cb, hmax, vmax)
+				e.quantize(&b, &e.comp[1], ox, oy)
+				scale(&b, &cr, hmax, vmax)
+				e.quantize(&b, &e.comp[2], ox, oy)
+			}
+			if baseline != nil {
+				e.writeMCU(*baseline, ox, oy, &prevDC)
+			}
+		}
+	}
+}
+
+// writeBlock writes the coefficients from ss to se, inclusive, of a block of
+// quantized coefficients in zig-zag order, returning the DC coefficient of
+// the block.
+func (e *encoder) writeBlock(b *[blockSize]int16, q quantIndex, ss, se int, prevDC int32) int32 {
+	dc := int32(b[0])
+	if ss == 0 {
+		// Emit the DC delta.
+		e.emitHuffRLE(huffIndex(2*q+0), 0, dc-prevDC)
+		ss = 1
+	}
+	// Emit the AC components.
+	h, runLength := huffIndex(2*q+1), int32(0)
+	for zig := ss; zig <= se; zig++ {
+		ac := int32(b[zig])
+		if ac == 0 {
+			runLength++
+		} else {
+			for runLength > 15 {
+				e.emitHuff(h, 0xf0)
+				runLength -= 16
+			}
+			e.emitHuffRLE(h, runLength, ac)
+			runLength = 0
+		}
+	}
+	if runLength > 0 {
+		e.emitHuff(h, 0x00)
+	}
+	return dc
+}
+
+// writeMCU writes the coefficients of s of the blocks of the MCU at (mx, my)
+// in the stored coefficients.  prevDC holds the DC coefficients of the
+// previous blocks of each component of s.
+func (e *encoder) writeMCU(s scan, mx, my int, prevDC *[3]int32) {
+	for i, ci := range s.comps {
+		c := &e.comp[ci]
+		for by := my * c.v; by < (my+1)*c.v; by++ {
+			for bx := mx * c.h; bx < (mx+1)*c.h; bx++ {
+				prevDC[i] = e.writeBlock(&c.coeffs[by*c.bw+bx], c.q, s.ss, s.se, prevDC[i])
+			}
+		}
+	}
+}
+
+// writeSOS writes the StartOfScan marker of s.
+func (e *encoder) writeSOS(s scan) {
+	markerlen := 6 + 2*len(s.comps)
+	e.writeMarkerHeader(sosMarker, markerlen)
+	e.buf[0] = uint8(len(s.comps))
+	for i, ci := range s.comps {
+		e.buf[2*i+1] = uint8(ci + 1)
+		// The DC and AC Huffman tables share the index of the
+		// quantization table.
+		e.buf[2*i+2] = uint8(e.comp[ci].q<<4 | e.comp[ci].q)
+	}
+	n := 2*len(s.comps) + 1
+	// Spectral selection start and end, and successive approximation
+	// bit positions, which are always zero.
+	e.buf[n], e.buf[n+1], e.buf[n+2] = uint8(s.ss), uint8(s.se), 0x00
+	e.write(e.buf[:n+3])
+}
+
+// endScan pads the last byte of a scan with 1's, discarding any remaining
+// padding bits so that they are not included in the next scan.
+func (e *encoder) endScan() {
+	e.emit(0x7f, 7)
+	e.bits, e.nBits = 0, 0
+}
+
+// writeScan writes the StartOfScan marker and the stored coefficients of s.
+func (e *encoder) writeScan(s scan) {
+	e.writeSOS(s)
+
+	// DC components are delta-encoded.
+	var prevDC [3]int32
+	if len(s.comps) == 1 {
+		// Non-interleaved scans only include the blocks that overlap the
+		// component, rather than every block of the padded MCUs.  See
+		// Section A.2.2 of the spec.
+		c := &e.comp[s.comps[0]]
+		hmax, vmax := e.comp[0].h, e.comp[0].v
+		bw := ((e.size.X*c.h+hmax-1)/hmax + 7) / 8
+		bh := ((e.size.Y*c.v+vmax-1)/vmax + 7) / 8
+		for y := 0; y < bh; y++ {
+			for x := 0; x < bw; x++ {
+				prevDC[0] = e.writeBlock(&c.coeffs[y*c.bw+x], c.q, s.ss, s.se, prevDC[0])
+			}
+		}
+	} else {
+		mcusX, mcusY := e.comp[0].bw/e.comp[0].h, e.comp[0].bh/e.comp[0].v
+		for my := 0; my < mcusY; my++ {
+			for mx := 0; mx < mcusX; mx++ {
+				e.writeMCU(s, mx, my, &prevDC)
+			}
+		}
+	}
+	e.endScan()
+}
+
+// DefaultQuality is the default quality encoding parameter.
+const DefaultQuality = 75
+
+// Subsampling is a chroma subsampling ratio.
+type Subsampling int
+
+const (
+	Subsampling420 Subsampling = iota // half horizontal and vertical chroma resolution
+	Subsampling422                    // half horizontal chroma resolution
+	Subsampling444                    // full chroma resolution
+)
+
+// Options are the encoding parameters.
+type Options struct {
+	// Quality ranges from 1 to 100 inclusive, higher is better.
+	Quality int
+
+	// Progressive, when true, encodes the image as a progressive JPEG,
+	// which can be displayed at increasing levels of detail as it is
+	// downloaded.  Otherwise the image is encoded as a baseline JPEG.
+	Progressive bool
+
+	// Subsampling is the chroma subsampling ratio of color images.
+	Subsampling Subsampling
+}
+
+// Encode writes the Image m to w in JPEG format with the given options.
+// Default parameters are used if a nil *[Options] is passed, which encode the
+// image as a 4:2:0 baseline JPEG, the same as the standard library's
+// image/jpeg package.
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	b := m.Bounds()
+	if b.Dx() >= 1<<16 || b.Dy() >= 1<<16 {
+		return errors.New("jpeg: image is too large to encode")
+	}
+	var e encoder
+	if ww, ok := w.(writer); ok {
+		e.w = ww
+	} else {
+		e.w = bufio.NewWriter(w)
+	}
+	opts := Options{Quality: DefaultQuality}
+	if o != nil {
+		opts = *o
+	}
+	// Clip quality to [1, 100].
+	quality := opts.Quality
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+	// Convert from a quality rating to a scaling factor.
+	var scale int
+	if quality < 50 {
+		scale = 5000 / quality
+	} else {
+		scale = 200 - quality*2
+	}
+	// Initialize the quantization tables.
+	for i := range e.quant {
+		for j := range e.quant[i] {
+			x := int(unscaledQuant[i][j])
+			x = (x*scale + 50) / 100
+			if x < 1 {
+				x = 1
+			} else if x > 255 {
+				x = 255
+			}
+			e.quant[i][j] = uint8(x)
+		}
+	}
+	// Determine the image components based on input image type.
+	e.size = b.Size()
+	scans := progressiveScans
+	switch m.(type) {
+	case *image.Gray:
+		// No subsampling for grayscale image.
+		e.comp = []component{{h: 1, v: 1, q: quantIndexLuminance}}
+		scans = progressiveScansGray
+	default:
+		h, v := 2, 2
+		switch opts.Subsampling {
+		case Subsampling422:
+			v = 1
+		case Subsampling444:
+			h, v = 1, 1
+		}
+		e.comp = []component{
+			{h: h, v: v, q: quantIndexLuminance},
+			{h: 1, v: 1, q: quantIndexChrominance},
+			{h: 1, v: 1, q: quantIndexChrominance},
+		}
+	}
+	// Write the Start Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd8
+	e.write(e.buf[:2])
+	// Write the quantization tables.
+	e.writeDQT()
+	// Write the image dimensions.
+	if opts.Progressive {
+		e.writeSOF(sof2Marker)
+	} else {
+		e.writeSOF(sof0Marker)
+	}
+	// Write the Huffman tables.
+	e.writeDHT()
+	// Write the image data.
+	if opts.Progressive {
+		e.transform(m, nil)
+		for _, s := range scans {
+			e.writeScan(s)
+		}
+	} else {
+		// Baseline images have a single scan of all coefficients, which
+		// is written as the image is transformed, like the standard
+		// library does.
+		all := make([]int, len(e.comp))
+		for i := range all {
+			all[i] = i
+		}
+		s := scan{all, 0, blockSize - 1}
+		e.writeSOS(s)
+		e.transform(m, &s)
+		e.endScan()
+	}
+	// Write the End Of Image marker.
+	e.buf[0] = 0xff
+	e.buf[1] = 0xd9
+	e.write(e.buf[:2])
+	e.flush()
+	return e.err
+}
@@ -0,0 +1,83 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package jpeg
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+)
+
+// randomImages returns images of each type handled by the encoder, filled
+// with random pixels, with a size that is not a whole number of MCUs.
+func randomImages() map[string]image.Image {
+	r := rand.New(rand.NewSource(1))
+	b := image.Rect(3, 5, 3+37, 5+19)
+
+	rgba := image.NewRGBA(b)
+	r.Read(rgba.Pix)
+	gray := image.NewGray(b)
+	r.Read(gray.Pix)
+	ycbcr := image.NewYCbCr(b, image.YCbCrSubsampleRatio420)
+	r.Read(ycbcr.Y)
+	r.Read(ycbcr.Cb)
+	r.Read(ycbcr.Cr)
+	nrgba := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			nrgba.Set(x, y, color.NRGBA{uint8(r.Intn(256)), uint8(r.Intn(256)), uint8(r.Intn(256)), 255})
+		}
+	}
+
+	return map[string]image.Image{
+		"rgba":  rgba,
+		"gray":  gray,
+		"ycbcr": ycbcr,
+		"nrgba": nrgba,
+	}
+}
+
+func TestEncode_Baseline(t *testing.T) {
+	// baseline 4:2:0 JPEGs are identical to those of the standard library
+	for name, m := range randomImages() {
+		for _, quality := range []int{1, 50, DefaultQuality, 95, 100} {
+			var want, got bytes.Buffer
+			if err := jpeg.Encode(&want, m, &jpeg.Options{Quality: quality}); err != nil {
+				t.Fatalf("image/jpeg Encode returned unexpected error: %v", err)
+			}
+			if err := Encode(&got, m, &Options{Quality: quality}); err != nil {
+				t.Fatalf("Encode(%s, quality %d) returned unexpected error: %v", name, quality, err)
+			}
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Errorf("Encode(%s, quality %d) differs from image/jpeg", name, quality)
+			}
+		}
+	}
+}
+
+func TestEncode_Options(t *testing.T) {
+	for name, m := range randomImages() {
+		for _, progressive := range []bool{false, true} {
+			for _, subsampling := range []Subsampling{Subsampling420, Subsampling422, Subsampling444} {
+				o := &Options{Quality: 100, Progressive: progressive, Subsampling: subsampling}
+				var buf bytes.Buffer
+				if err := Encode(&buf, m, o); err != nil {
+					t.Fatalf("Encode(%s, %+v) returned unexpected error: %v", name, o, err)
+				}
+				d, err := jpeg.Decode(&buf)
+				if err != nil {
+					t.Errorf("Encode(%s, %+v) returned invalid JPEG: %v", name, o, err)
+					continue
+				}
+				if got, want := d.Bounds().Size(), m.Bounds().Size(); got != want {
+					t.Errorf("Encode(%s, %+v) returned image of size %v, want %v", name, o, got, want)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// reThumborPath matches the portion of a Thumbor URL path that follows the
+// signature, adapted from the URL pattern used by Thumbor itself.  Options
+// that have no equivalent in imageproxy, such as alignment, are matched so
+// that they are not mistaken for part of the image URL, but are ignored.
+var reThumborPath = regexp.MustCompile(`^` +
+	`(?:(?P<trim>trim(?::(?:top-left|bottom-right))?(?::\d+)?)/)?` +
+	`(?:(?P<crop_left>\d+)x(?P<crop_top>\d+):(?P<crop_right>\d+)x(?P<crop_bottom>\d+)/)?` +
+	`(?:(?P<fit_in>fit-in)/)?` +
+	`(?:(?P<flip_h>-)?(?P<width>\d+|orig)?x(?P<flip_v>-)?(?P<height>\d+|orig)?/)?` +
+	`(?:(?P<halign>left|right|center)/)?` +
+	`(?:(?P<valign>top|bottom|middle)/)?` +
+	`(?:(?P<smart>smart)/)?` +
+	`(?:filters:(?P<filters>.+?\))/)?` +
+	`(?P<image>.+)$`)
+
+// reThumborFilter matches a single filter in the filters option of a
+// Thumbor URL, such as "quality(80)".
+var reThumborFilter = regexp.MustCompile(`(\w+)\(([^)]*)\)`)
+
+// newThumborRequest parses an http.Request that uses Thumbor URL syntax into
+// an imageproxy Request.  path is the escaped request path relative to
+// p.ThumborPrefix, formatted as:
+//
+//	{signature}/[trim/][AxB:CxD/][fit-in/][-]Ex[-]F/[halign/][valign/][smart/][filters:...]/{image}
+//
+// where signature is either "unsafe" or a Thumbor HMAC-SHA1 signature of the
+// remainder of the path, which is verified using p.SignatureKeys.  Requests
+// with a valid signature are allowed regardless of p.AllowHosts, and
+// requests with an invalid signature are rejected.  The
+// supported filters are quality, format (jpeg, png, and webp), and rotate; other
+// filters are ignored.  If p.PresetsOnly is true, the options must match one
+// of p.Presets.
+//
+// The image may be percent-encoded.  If it has no scheme, it is resolved
+// relative to p.DefaultBaseURL, or treated as an http URL if there is no
+// default base URL, as Thumbor does.
+func (p *Proxy) newThumborRequest(r *http.Request, path string) (*Request, error) {
+	req := &Request{Original: r}
+
+	sig, path, ok := strings.Cut(path, "/")
+	if !ok {
+		return nil, URLError{"too few path segments", r.URL}
+	}
+	var key []byte // key used to sign the request, if any
+	if sig != "unsafe" {
+		if key = thumborSignatureKey(p.SignatureKeys, sig, path); key == nil {
+			return nil, URLError{"invalid Thumbor signature", r.URL}
+		}
+	}
+
+	m := reThumborPath.FindStringSubmatch(path)
+	if m == nil {
+		return nil, URLError{"invalid Thumbor URL", r.URL}
+	}
+	group := func(name string) string {
+		return m[reThumborPath.SubexpIndex(name)]
+	}
+	atof := func(name string) float64 {
+		f, _ := strconv.ParseFloat(group(name), 64)
+		return f
+	}
+
+	opt := &req.Options
+	opt.Trim = group("trim") != ""
+	if group("crop_left") != "" {
+		left, top := atof("crop_left"), atof("crop_top")
+		right, bottom := atof("crop_right"), atof("crop_bottom")
+		if right > left && bottom > top {
+			opt.CropX, opt.CropY = left, top
+			opt.CropWidth, opt.CropHeight = right-left, bottom-top
+		}
+	}
+	opt.Fit = group("fit_in") != ""
+	opt.Width = atof("width") // "orig" parses as 0, scaling proportionally
+	opt.Height = atof("height")
+	opt.FlipHorizontal = group("flip_h") != ""
+	opt.FlipVertical = group("flip_v") != ""
+	opt.SmartCrop = group("smart") != ""
+
+	for _, f := range reThumborFilter.FindAllStringSubmatch(group("filters"), -1) {
+		name, arg := f[1], f[2]
+		switch name {
+		case "quality":
+			if q, err := strconv.Atoi(arg); err == nil {
+				opt.Quality = q
+			}
+		case "format":
+			switch arg {
+			case "jpeg", "jpg":
+				opt.Format = optFormatJPEG
+			case "png":
+				opt.Format = optFormatPNG
+			case "webp":
+				opt.Format = optFormatWEBP
+			}
+		case "rotate":
+			// Thumbor rotates counter-clockwise, as do Options
+			if deg, err := strconv.Atoi(arg); err == nil && deg%90 == 0 {
+				opt.Rotate = (deg%360 + 360) % 360
+			}
+		}
+	}
+
+	if err := p.presetOptions(*opt); err != nil {
+		return nil, URLError{err.Error(), r.URL}
+	}
+
+	u, err := p.thumborImageURL(group("image"))
+	if err != nil {
+		return nil, URLError{fmt.Sprintf("unable to parse remote URL: %v", err), r.URL}
+	}
+	req.URL = u
+
+	if key != nil {
+		// Translate the verified Thumbor signature into the equivalent
+		// imageproxy signature of the remote URL, so that the request
+		// is authorized like any other signed request.
+		opt.Signature = urlSignature(key, u)
+	}
+	return req, nil
+}
+
+// thumborImageURL parses the image portion of a Thumbor URL path as a remote
+// URL.
+func (p *Proxy) thumborImageURL(s string) (*url.URL, error) {
+	s, err := url.PathUnescape(s)
+	if err != nil {
+		return nil, err
+	}
+	s = reCleanedURL.ReplaceAllString(s, "$1://$2")
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if !u.IsAbs() {
+		if p.DefaultBaseURL != nil {
+			u = p.DefaultBaseURL.ResolveReference(u)
+		} else if u, err = url.Parse("http://" + s); err != nil {
+			return nil, err
+		}
+	}
+	if !isHTTP(u) {
+		return nil, fmt.Errorf("remote URL must have http or https scheme")
+	}
+	return u, nil
+}
+
+// thumborSignatureKey returns the key in keys with which sig is a valid
+// Thumbor signature of path, or nil if there is none.  Thumbor signatures
+// are the URL safe base64 encoded HMAC-SHA1 of the URL path following the
+// signature.
+func thumborSignatureKey(keys [][]byte, sig, path string) []byte {
+	if m := len(sig) % 4; m != 0 { // add padding if missing
+		sig += strings.Repeat("=", 4-m)
+	}
+	got, err := base64.URLEncoding.DecodeString(sig)
+	if err != nil {
+		return nil
+	}
+
+	for _, key := range keys {
+		if len(key) == 0 {
+			continue
+		}
+		mac := hmac.New(sha1.New, key)
+		_, _ = mac.Write([]byte(path))
+		if hmac.Equal(got, mac.Sum(nil)) {
+			return key
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2013 The imageproxy authors.
+// SPDX-License-Identifier: Apache-2.0
+
+package imageproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestNewThumborRequest(t *testing.T) {
+	tests := []struct {
+		URL         string  // input URL to parse as an imageproxy request
+		RemoteURL   string  // expected URL of remote image parsed from input
+		Options     Options // expected options parsed from input
+		ExpectError bool    // whether an error is expected from newRequest
+	}{
+		// invalid URLs
+		{"http://localhost/", "", emptyOptions, true},
+		{"http://localhost/unsafe", "", emptyOptions, true},
+		{"http://localhost/unsafe/ftp://example.com/foo", "", emptyOptions, true},
+		{"http://localhost/badsig/example.com/foo", "", emptyOptions, true},
+
+		// valid URLs
+		{"http://localhost/unsafe/example.com/foo", "http://example.com/foo", emptyOptions, false},
+		{"http://localhost/unsafe/https://example.com/foo", "https://example.com/foo", emptyOptions, false},
+		{"http://localhost/unsafe/https:/example.com/foo", "https://example.com/foo", emptyOptions, false},
+		{"http://localhost/unsafe/https%3A%2F%2Fexample.com%2Ffoo%3Fbar", "https://example.com/foo?bar", emptyOptions, false},
+		{"http://localhost/unsafe/300x200/example.com/foo", "http://example.com/foo", Options{Width: 300, Height: 200}, false},
+		{"http://localhost/unsafe/300x/example.com/foo", "http://example.com/foo", Options{Width: 300}, false},
+		{"http://localhost/unsafe/origx200/example.com/foo", "http://example.com/foo", Options{Height: 200}, false},
+		{"http://localhost/unsafe/-300x-200/example.com/foo", "http://example.com/foo", Options{Width: 300, Height: 200, FlipHorizontal: true, FlipVertical: true}, false},
+		{"http://localhost/unsafe/fit-in/300x200/example.com/foo", "http://example.com/foo", Options{Width: 300, Height: 200, Fit: true}, false},
+		{"http://localhost/unsafe/300x200/smart/example.com/foo", "http://example.com/foo", Options{Width: 300, Height: 200, SmartCrop: true}, false},
+		{"http://localhost/unsafe/300x200/left/top/example.com/foo", "http://example.com/foo", Options{Width: 300, Height: 200}, false},
+		{"http://localhost/unsafe/trim/example.com/foo", "http://example.com/foo", Options{Trim: true}, false},
+		{"http://localhost/unsafe/trim:top-left:10/example.com/foo", "http://example.com/foo", Options{Trim: true}, false},
+		{"http://localhost/unsafe/10x20:110x220/example.com/foo", "http://example.com/foo", Options{CropX: 10, CropY: 20, CropWidth: 100, CropHeight: 200}, false},
+		{"http://localhost/unsafe/0x0:0x0/example.com/foo", "http://example.com/foo", emptyOptions, false},
+		{
+			"http://localhost/unsafe/filters:quality(80):format(png):rotate(-90):blur(2)/example.com/foo",
+			"http://example.com/foo", Options{Quality: 80, Format: "png", Rotate: 270}, false,
+		},
+		{"http://localhost/unsafe/filters:format(webp)/example.com/foo", "http://example.com/foo", Options{Format: "webp"}, false},
+		{"http://localhost/unsafe/filters:format(avif)/example.com/foo", "http://example.com/foo", emptyOptions, false},
+		{
+			"http://localhost/unsafe/trim/10x20:110x220/fit-in/-300x200/smart/filters:quality(80)/example.com/foo",
+			"http://example.com/foo",
+			Options{Trim: true, CropX: 10, CropY: 20, CropWidth: 100, CropHeight: 200, Fit: true, Width: 300, Height: 200, FlipHorizontal: true, SmartCrop: true, Quality: 80},
+			false,
+		},
+	}
+
+	p := &Proxy{ThumborPrefix: "/"}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", tt.URL, nil)
+		if err != nil {
+			t.Errorf("http.NewRequest(%q) returned error: %v", tt.URL, err)
+			continue
+		}
+
+		r, err := p.newRequest(req)
+		if tt.ExpectError {
+			if err == nil {
+				t.Errorf("newRequest(%v) did not return expected error", req)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("newRequest(%v) returned unexpected error: %v", req, err)
+			continue
+		}
+
+		if got, want := r.URL.String(), tt.RemoteURL; got != want {
+			t.Errorf("newRequest(%q) request URL = %v, want %v", tt.URL, got, want)
+		}
+		if got, want := r.Options, tt.Options; got != want {
+			t.Errorf("newRequest(%q) request options = %v, want %v", tt.URL, got, want)
+		}
+	}
+}
+
+func TestNewThumborRequest_BaseURL(t *testing.T) {
+	base, _ := url.Parse("https://example.com/images/")
+	p := &Proxy{ThumborPrefix: "/thumbor/", DefaultBaseURL: base}
+
+	req := httptest.NewRequest("GET", "http://localhost/thumbor/unsafe/300x/foo.jpg", nil)
+	r, err := p.newRequest(req)
+	if err != nil {
+		t.Fatalf("newRequest(%v) returned unexpected error: %v", req, err)
+	}
+	if got, want := r.URL.String(), "https://example.com/images/foo.jpg"; got != want {
+		t.Errorf("newRequest(%v) request URL = %v, want %v", req, got, want)
+	}
+
+	// requests outside of the Thumbor prefix use the standard syntax
+	req = httptest.NewRequest("GET", "http://localhost/300x/foo.jpg", nil)
+	r, err = p.newRequest(req)
+	if err != nil {
+		t.Fatalf("newRequest(%v) returned unexpected error: %v", req, err)
+	}
+	if got, want := r.Options, (Options{Width: 300}); got != want {
+		t.Errorf("newRequest(%v) request options = %v, want %v", req, got, want)
+	}
+}
+
+func TestNewThumborRequest_PresetsOnly(t *testing.T) {
+	p := &Proxy{
+		ThumborPrefix: "/",
+		Presets:       map[string]string{"thumb": "300x200,sc"},
+		PresetsOnly:   true,
+	}
+
+	tests := []struct {
+		url         string
+		expectError bool
+	}{
+		{"http://localhost/unsafe/example.com/foo", false},
+		{"http://localhost/unsafe/300x200/smart/example.com/foo", false},
+		{"http://localhost/unsafe/300x200/example.com/foo", true},
+		{"http://localhost/unsafe/filters:quality(80)/example.com/foo", true},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		_, err := p.newRequest(req)
+		if got, want := err != nil, tt.expectError; got != want {
+			t.Errorf("newRequest(%v) returned error %v, want error: %t", req, err, want)
+		}
+	}
+}
+
+func TestNewThumborRequest_Signature(t *testing.T) {
+	p := &Proxy{
+		ThumborPrefix: "/",
+		AllowHosts:    []string{"good.test"},
+		SignatureKeys: [][]byte{[]byte("c0ffee")},
+	}
+
+	tests := []struct {
+		url     string
+		valid   bool // whether the signature is valid
+		allowed bool // whether the request is allowed
+	}{
+		{"http://localhost/3ss8sudA1XoC1sW66iSKImadnWU=/300x200/smart/good.test/png", true, true},
+		{"http://localhost/3ss8sudA1XoC1sW66iSKImadnWU/300x200/smart/good.test/png", true, true}, // no padding
+		{"http://localhost/3ss8sudA1XoC1sW66iSKImadnWU=/300x201/smart/good.test/png", false, false},
+		{"http://localhost/VInF-MBqnwP8KxYbpW6pRCIglGA=/fit-in/100x0/bad.test/png", true, true},
+		{"http://localhost/unsafe/fit-in/100x0/bad.test/png", true, false},
+		{"http://localhost/unsafe/fit-in/100x0/good.test/png", true, true},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		r, err := p.newRequest(req)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("newRequest(%q) did not return expected error", tt.url)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("newRequest(%q) returned unexpected error: %v", tt.url, err)
+			continue
+		}
+
+		if got, want := p.allowed(r), tt.allowed; (got == nil) != want {
+			t.Errorf("allowed(%q) returned %v, want %v", tt.url, got, want)
+		}
+	}
+}
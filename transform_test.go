@@ -6,6 +6,8 @@ package imageproxy
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"image"
 	"image/color"
 	"image/draw"
@@ -18,6 +20,7 @@ import (
 
 	"github.com/disintegration/imaging"
 	"golang.org/x/image/bmp"
+	"willnorris.com/go/imageproxy/third_party/avif"
 )
 
 var (
@@ -156,6 +159,49 @@ func TestTranform_ImageTooLarge(t *testing.T) {
 	}
 }
 
+func TestTransformWithLimits(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, newImage(4, 4, red)); err != nil {
+		t.Fatalf("error encoding reference image: %v", err)
+	}
+	img := buf.Bytes()
+	anim := newAnimatedGIF(t) // 3 frames of 4x4
+
+	tests := []struct {
+		img    []byte
+		opt    Options
+		limits Limits
+		err    error // expected error
+	}{
+		{img, Options{Width: 2}, Limits{MaxInputBytes: int64(len(img))}, nil},
+		{img, Options{Width: 2}, Limits{MaxInputBytes: 10}, errInputTooLarge},
+		{img, emptyOptions, Limits{MaxInputBytes: 10}, nil}, // not transformed
+		{img, Options{Width: 2}, Limits{MaxPixels: 16}, nil},
+		{img, Options{Width: 2}, Limits{MaxPixels: 15}, errImageTooLarge},
+		{[]byte("not an image"), Options{Width: 2}, Limits{}, errDecodeImage},
+		{img, Options{Width: 2}, Limits{MaxOutputWidth: 2, MaxOutputHeight: 2}, nil},
+		{img, Options{Format: "png"}, Limits{MaxOutputWidth: 2}, errOutputTooLarge},
+		{img, Options{Width: 2, ScaleUp: true}, Limits{MaxOutputHeight: 2}, nil},
+		{img, Options{Width: 8, ScaleUp: true}, Limits{MaxOutputHeight: 4}, errOutputTooLarge},
+		{anim, Options{MaxFrames: 3}, Limits{MaxPixels: 16, MaxAnimationPixels: 48}, nil},
+		{anim, Options{Width: 2}, Limits{MaxPixels: 15}, errImageTooLarge},
+		{anim, Options{MaxFrames: 3}, Limits{MaxAnimationPixels: 47}, errImageTooLarge},
+		// resized frames, 36 pixels in all, are composited onto a 16 pixel canvas
+		{anim, Options{Width: 2}, Limits{MaxAnimationPixels: 52}, nil},
+		{anim, Options{Width: 2}, Limits{MaxAnimationPixels: 51}, errImageTooLarge},
+		// and each is kept at full size for formats other than gif
+		{anim, Options{Format: "apng"}, Limits{MaxAnimationPixels: 100}, nil},
+		{anim, Options{Format: "apng"}, Limits{MaxAnimationPixels: 99}, errImageTooLarge},
+	}
+
+	for i, tt := range tests {
+		_, err := TransformWithLimits(tt.img, tt.opt, tt.limits)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%d. TransformWithLimits(%v, %+v) returned error %v, want %v", i, tt.opt, tt.limits, err, tt.err)
+		}
+	}
+}
+
 func TestTransform_InvalidFormat(t *testing.T) {
 	src := newImage(2, 2, red, green, blue, yellow)
 	buf := new(bytes.Buffer)
@@ -463,3 +509,592 @@ func TestTrimEdges(t *testing.T) {
 		})
 	}
 }
+
+func TestTransform_AutoFormat(t *testing.T) {
+	opaque := newImage(2, 2, red)
+	transparent := newImage(2, 2, red, green, blue, color.NRGBA{0, 0, 0, 0})
+
+	tests := []struct {
+		name   string
+		src    image.Image
+		opt    Options
+		format string // expected output format
+	}{
+		{"opaque jpeg", opaque, Options{AutoFormat: true, Format: "jpeg"}, "jpeg"},
+		{"transparent jpeg", transparent, Options{AutoFormat: true, Format: "jpeg"}, "png"},
+		{"transparent png", transparent, Options{AutoFormat: true, Format: "png"}, "png"},
+		{"transparent webp", transparent, Options{AutoFormat: true, Format: "webp"}, "webp"},
+		{"opaque webp", opaque, Options{AutoFormat: true, Format: "webp"}, "webp"}, // png is lossless
+		{"explicit jpeg", transparent, Options{Format: "jpeg"}, "jpeg"},
+	}
+
+	for _, tt := range tests {
+		buf := new(bytes.Buffer)
+		if err := png.Encode(buf, tt.src); err != nil {
+			t.Fatalf("error encoding reference image: %v", err)
+		}
+
+		out, err := Transform(buf.Bytes(), tt.opt)
+		if err != nil {
+			t.Errorf("Transform(%s) returned unexpected error: %v", tt.name, err)
+			continue
+		}
+		if _, format, _ := image.DecodeConfig(bytes.NewReader(out)); format != tt.format {
+			t.Errorf("Transform(%s) returned format %q, want %q", tt.name, format, tt.format)
+		}
+	}
+
+	// opaque jpeg images are not encoded as lossless webp
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, opaque, nil); err != nil {
+		t.Fatalf("error encoding reference image: %v", err)
+	}
+	for _, tt := range []struct {
+		opt    Options
+		format string
+	}{
+		{Options{AutoFormat: true, Format: "webp"}, "jpeg"},
+		{Options{Format: "webp"}, "webp"},
+	} {
+		out, err := Transform(buf.Bytes(), tt.opt)
+		if err != nil {
+			t.Fatalf("Transform returned unexpected error: %v", err)
+		}
+		if _, format, _ := image.DecodeConfig(bytes.NewReader(out)); format != tt.format {
+			t.Errorf("Transform(%v) of jpeg returned format %q, want %q", tt.opt, format, tt.format)
+		}
+	}
+
+	// animated GIFs are left as GIFs
+	buf = new(bytes.Buffer)
+	if err := gif.Encode(buf, opaque, nil); err != nil {
+		t.Fatalf("error encoding reference image: %v", err)
+	}
+	out, err := Transform(buf.Bytes(), Options{AutoFormat: true, Format: "jpeg"})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	if _, format, _ := image.DecodeConfig(bytes.NewReader(out)); format != "gif" {
+		t.Errorf("Transform of gif returned format %q, want %q", format, "gif")
+	}
+}
+
+func TestTransform_WebP(t *testing.T) {
+	src := newImage(2, 2, red, green, blue, yellow)
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, src); err != nil {
+		t.Fatalf("error encoding reference image: %v", err)
+	}
+
+	out, err := Transform(buf.Bytes(), Options{Format: "webp"})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	got, format, err := image.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("error decoding transformed image: %v", err)
+	}
+	if format != "webp" {
+		t.Errorf("Transform returned format %q, want %q", format, "webp")
+	}
+
+	// webp output is lossless, so pixels should be unchanged
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			gr, gg, gb, ga := got.At(x, y).RGBA()
+			wr, wg, wb, wa := src.At(x, y).RGBA()
+			if gr != wr || gg != wg || gb != wb || ga != wa {
+				t.Errorf("Transform returned pixel %v at (%d, %d), want %v", got.At(x, y), x, y, src.At(x, y))
+			}
+		}
+	}
+}
+
+func TestTransform_JPEGEncoding(t *testing.T) {
+	src := newImage(32, 32, red, green, blue, yellow)
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, src); err != nil {
+		t.Fatalf("error encoding reference image: %v", err)
+	}
+
+	tests := []struct {
+		opt         Options
+		progressive bool // whether output should be a progressive JPEG
+		ratio       image.YCbCrSubsampleRatio
+	}{
+		{Options{Format: "jpeg"}, false, image.YCbCrSubsampleRatio420},
+		{Options{Format: "jpeg", Progressive: true}, true, image.YCbCrSubsampleRatio420},
+		{Options{Format: "jpeg", Subsampling: "422"}, false, image.YCbCrSubsampleRatio422},
+		{Options{Format: "jpeg", Progressive: true, Subsampling: "444"}, true, image.YCbCrSubsampleRatio444},
+	}
+
+	for _, tt := range tests {
+		out, err := Transform(buf.Bytes(), tt.opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+
+		// progressive JPEGs use the SOF2 marker rather than SOF0
+		if got := bytes.Contains(out, []byte{0xff, 0xc2}); got != tt.progressive {
+			t.Errorf("Transform(%v) returned progressive JPEG %t, want %t", tt.opt, got, tt.progressive)
+		}
+
+		m, err := jpeg.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("Transform(%v) returned invalid JPEG: %v", tt.opt, err)
+			continue
+		}
+		ycbcr, ok := m.(*image.YCbCr)
+		if !ok {
+			t.Errorf("Transform(%v) returned %T image, want *image.YCbCr", tt.opt, m)
+			continue
+		}
+		if got, want := ycbcr.SubsampleRatio, tt.ratio; got != want {
+			t.Errorf("Transform(%v) returned image with subsample ratio %v, want %v", tt.opt, got, want)
+		}
+	}
+}
+
+func TestHeifOrientation(t *testing.T) {
+	// box returns an ISO base media file box of type typ containing data.
+	box := func(typ string, data ...[]byte) []byte {
+		b := binary.BigEndian.AppendUint32(nil, 0)
+		b = append(b, typ...)
+		for _, d := range data {
+			b = append(b, d...)
+		}
+		binary.BigEndian.PutUint32(b, uint32(len(b)))
+		return b
+	}
+	fullBox := func(typ string, version byte, flags byte, data ...[]byte) []byte {
+		return box(typ, append([][]byte{{version, 0, 0, flags}}, data...)...)
+	}
+	// heif returns a HEIF image with primary item 1, which has the
+	// properties at the 1-based indices of props.
+	heif := func(props []byte, ipco ...[]byte) []byte {
+		return append(box("ftyp", []byte("avif")), fullBox("meta", 0, 0,
+			fullBox("pitm", 0, 0, []byte{0, 1}),
+			box("iprp",
+				box("ipco", ipco...),
+				fullBox("ipma", 0, 0, []byte{0, 0, 0, 2},
+					[]byte{0, 2, 1, 0x81}, // item 2 has property 1 (essential)
+					[]byte{0, 1, byte(len(props))}, props),
+			),
+		)...)
+	}
+
+	irot := func(angle byte) []byte { return box("irot", []byte{angle}) }
+	imir := func(axis byte) []byte { return box("imir", []byte{axis}) }
+	ispe := box("ispe", make([]byte, 12))
+
+	tests := []struct {
+		name string
+		img  []byte
+		want Options
+	}{
+		{"empty", nil, emptyOptions},
+		{"not heif", []byte("not a heif image"), emptyOptions},
+		{"no transform", heif([]byte{1}, ispe), emptyOptions},
+		{"other item", heif([]byte{}, irot(1)), emptyOptions},
+		{"rotate 90", heif([]byte{1, 2}, ispe, irot(1)), Options{Rotate: 90}},
+		{"rotate 270", heif([]byte{2, 0x81}, irot(3), ispe), Options{Rotate: 270}},
+		{"mirror vertical axis", heif([]byte{1}, imir(0)), Options{FlipHorizontal: true}},
+		{"mirror horizontal axis", heif([]byte{1}, imir(1)), Options{FlipVertical: true}},
+		{"rotate then mirror", heif([]byte{1, 2}, irot(1), imir(0)), Options{Rotate: 90, FlipHorizontal: true}},
+		{"mirror then rotate", heif([]byte{2, 1}, irot(1), imir(0)), Options{Rotate: 270, FlipHorizontal: true}},
+		{"invalid property", heif([]byte{3}, irot(1)), emptyOptions},
+	}
+
+	for _, tt := range tests {
+		if got := heifOrientation(tt.img); got != tt.want {
+			t.Errorf("heifOrientation(%s) returned %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTransform_AVIF(t *testing.T) {
+	src := newImage(16, 8, red)
+	buf := new(bytes.Buffer)
+	if err := avif.Encode(buf, src); err != nil {
+		t.Fatalf("error encoding reference image: %v", err)
+	}
+	if brand := string(buf.Bytes()[8:12]); brand != "avif" {
+		t.Fatalf("reference image has major brand %q, want %q", brand, "avif")
+	}
+
+	// many avif images use the generic "mif1" major brand, and only list
+	// "avif" in their compatible brands
+	mif1 := bytes.Clone(buf.Bytes())
+	copy(mif1[8:12], "mif1")
+
+	for _, img := range [][]byte{buf.Bytes(), mif1} {
+		brand := string(img[8:12])
+		out, err := Transform(img, Options{Width: 8})
+		if err != nil {
+			t.Errorf("Transform of %q image returned unexpected error: %v", brand, err)
+			continue
+		}
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("error decoding transformed %q image: %v", brand, err)
+			continue
+		}
+		if want := "jpeg"; format != want {
+			t.Errorf("Transform of %q image returned format %q, want %q", brand, format, want)
+		}
+		if cfg.Width != 8 || cfg.Height != 4 {
+			t.Errorf("Transform of %q image returned image size %dx%d, want 8x4", brand, cfg.Width, cfg.Height)
+		}
+	}
+}
+
+func TestHeifBrand(t *testing.T) {
+	// ftyp returns a file type box with major and compatible brands.
+	ftyp := func(major string, compatible ...string) []byte {
+		b := binary.BigEndian.AppendUint32(nil, uint32(16+4*len(compatible)))
+		b = append(b, "ftyp"+major+"\x00\x00\x00\x00"...)
+		for _, c := range compatible {
+			b = append(b, c...)
+		}
+		return b
+	}
+
+	tests := []struct {
+		header []byte
+		want   string
+	}{
+		{nil, ""},
+		{[]byte("not a heif image"), ""},
+		{ftyp("avif", "mif1", "miaf"), "avif"},
+		{ftyp("heic", "mif1", "heic"), "heic"},
+		{ftyp("mif1", "mif1", "heic"), "mif1"},
+		{ftyp("mif1", "mif1", "miaf", "avif"), "avif"},
+		{ftyp("msf1", "msf1", "avis"), "avis"},
+		{ftyp("heic", "avif"), "heic"},
+		// brands after the end of the box are ignored
+		{append(ftyp("mif1", "mif1"), "avif"...), "mif1"},
+	}
+
+	for _, tt := range tests {
+		if got := heifBrand(tt.header); got != tt.want {
+			t.Errorf("heifBrand(%q) returned %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestIsSVG(t *testing.T) {
+	tests := []struct {
+		img  string
+		want bool
+	}{
+		{`<svg xmlns="http://www.w3.org/2000/svg"></svg>`, true},
+		{"\xef\xbb\xbf\n  <svg></svg>", true},
+		{`<?xml version="1.0" encoding="ISO-8859-1"?><!-- comment --><!DOCTYPE svg><svg></svg>`, true},
+		{`<?xml version="1.0"?><html></html>`, false},
+		{`<svg`, false},
+		{"\x89PNG\r\n\x1a\n", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := isSVG([]byte(tt.img)); got != tt.want {
+			t.Errorf("isSVG(%q) returned %t, want %t", tt.img, got, tt.want)
+		}
+	}
+}
+
+func TestCheckSVG(t *testing.T) {
+	tests := []struct {
+		img     string
+		w, h    float64
+		wantErr bool
+	}{
+		{`<svg width="20" height="10px"><rect width="1" height="1"/></svg>`, 20, 10, false},
+		{`<svg width="100%" height="2em"><g width="5" height="5"/></svg>`, 0, 0, false},
+		{`<svg><defs><path id="a" d="M0 0h1"/></defs><use href="#a"/></svg>`, 0, 0, false},
+
+		// disallowed content
+		{`<svg><script>alert(1)</script></svg>`, 0, 0, true},
+		{`<svg><foreignObject><div/></foreignObject></svg>`, 0, 0, true},
+		{`<svg><image href="data:image/png;base64,"/></svg>`, 0, 0, true},
+		{`<svg onload="alert(1)"></svg>`, 0, 0, true},
+		{`<svg xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="http://example.com/a.svg#a"/></svg>`, 0, 0, true},
+		{`<svg><defs><g id="a"><use href="#a"/></g></defs><use href="#a"/></svg>`, 0, 0, true},
+		{`<!DOCTYPE svg [<!ENTITY a "aaaa">]><svg><text>&a;</text></svg>`, 0, 0, true},
+		{`<svg><rect></svg>`, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		w, h, err := checkSVG([]byte(tt.img))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checkSVG(%q) returned error %v, want error: %t", tt.img, err, tt.wantErr)
+		}
+		if w != tt.w || h != tt.h {
+			t.Errorf("checkSVG(%q) returned size %vx%v, want %vx%v", tt.img, w, h, tt.w, tt.h)
+		}
+	}
+}
+
+func TestTransform_SVG(t *testing.T) {
+	// 20x10 image, with the left half red and the right half transparent
+	src := []byte(`<?xml version="1.0"?>
+<svg xmlns="http://www.w3.org/2000/svg" width="20" height="10" viewBox="0 0 4 2">
+  <rect x="0" y="0" width="2" height="2" fill="red"/>
+</svg>`)
+
+	tests := []struct {
+		opt    Options
+		format string // expected output format
+		w, h   int    // expected output size
+	}{
+		{Options{Rotate: 90}, "png", 10, 20},
+		{Options{Width: 40}, "png", 40, 20},
+		{Options{Height: 40}, "png", 80, 40},
+		{Options{Width: 0.5}, "png", 10, 5},
+		{Options{Width: 10, Height: 10}, "png", 10, 10},
+		{Options{Width: 10, Height: 10, Fit: true}, "png", 10, 5},
+		{Options{Width: 40, Format: "jpeg"}, "jpeg", 40, 20},
+	}
+
+	for _, tt := range tests {
+		out, err := Transform(src, tt.opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+		m, format, err := image.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("Transform(%v) returned undecodable image: %v", tt.opt, err)
+			continue
+		}
+		if format != tt.format {
+			t.Errorf("Transform(%v) returned format %q, want %q", tt.opt, format, tt.format)
+		}
+		if got := m.Bounds().Size(); got.X != tt.w || got.Y != tt.h {
+			t.Errorf("Transform(%v) returned image size %dx%d, want %dx%d", tt.opt, got.X, got.Y, tt.w, tt.h)
+		}
+	}
+
+	// check rendered pixels, including the background of jpeg images
+	for _, tt := range []struct {
+		opt         Options
+		left, right color.Color
+	}{
+		{Options{Width: 40}, red, color.NRGBA{}},
+		{Options{Width: 40, Format: "jpeg"}, red, color.White},
+	} {
+		out, err := Transform(src, tt.opt)
+		if err != nil {
+			t.Fatalf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+		}
+		m, _, err := image.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("Transform(%v) returned undecodable image: %v", tt.opt, err)
+		}
+		if got := color.NRGBAModel.Convert(m.At(5, 10)); !colorClose(got, tt.left) {
+			t.Errorf("Transform(%v) returned left pixel %v, want %v", tt.opt, got, tt.left)
+		}
+		if got := color.NRGBAModel.Convert(m.At(35, 10)); !colorClose(got, tt.right) {
+			t.Errorf("Transform(%v) returned right pixel %v, want %v", tt.opt, got, tt.right)
+		}
+	}
+
+	// unsafe SVGs are not rasterized
+	unsafe := []byte(`<svg width="10" height="10"><script>alert(1)</script></svg>`)
+	if _, err := Transform(unsafe, Options{Width: 5}); err == nil {
+		t.Errorf("Transform of unsafe svg did not return expected error")
+	}
+}
+
+// colorClose returns whether the colors a and b are within a small distance
+// of each other in each channel, to allow for lossy compression.
+func colorClose(a, b color.Color) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	near := func(x, y uint32) bool {
+		return max(x, y)-min(x, y) < 0x800
+	}
+	return near(ar, br) && near(ag, bg) && near(ab, bb) && near(aa, ba)
+}
+
+// newAnimatedGIF returns an encoded 4x4 animated GIF with three frames: solid
+// red, solid green, and then blue in the top left 2x2 corner only.
+func newAnimatedGIF(t *testing.T) []byte {
+	t.Helper()
+	p := color.Palette{red, green, blue, color.Transparent}
+	frame := func(r image.Rectangle, c uint8) *image.Paletted {
+		m := image.NewPaletted(r, p)
+		for i := range m.Pix {
+			m.Pix[i] = c
+		}
+		return m
+	}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 4, 4), 0),
+			frame(image.Rect(0, 0, 4, 4), 1),
+			frame(image.Rect(0, 0, 2, 2), 2),
+		},
+		Delay:    []int{10, 20, 30},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalNone, gif.DisposalNone},
+	}
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, g); err != nil {
+		t.Fatalf("error encoding reference image: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestGIFFrames(t *testing.T) {
+	img := newAnimatedGIF(t)
+	if got, err := gifFrames(img); err != nil || got != 3 {
+		t.Errorf("gifFrames returned %d, %v, want 3, nil", got, err)
+	}
+	if _, err := gifFrames(img[:len(img)/2]); err == nil {
+		t.Errorf("gifFrames of truncated image did not return expected error")
+	}
+}
+
+func TestTransform_Animation(t *testing.T) {
+	img := newAnimatedGIF(t)
+
+	// countFrames returns the number of frames in the encoded animation b.
+	countFrames := func(b []byte, format string) int {
+		switch format {
+		case "gif":
+			g, err := gif.DecodeAll(bytes.NewReader(b))
+			if err != nil {
+				t.Fatalf("error decoding gif: %v", err)
+			}
+			return len(g.Image)
+		case "apng":
+			i := bytes.Index(b, []byte("acTL"))
+			if i < 0 {
+				return 1
+			}
+			return int(binary.BigEndian.Uint32(b[i+4:]))
+		case "webp":
+			return max(bytes.Count(b, []byte("ANMF")), 1)
+		}
+		return 1
+	}
+
+	tests := []struct {
+		opt    Options
+		format string // expected output format
+		frames int    // expected number of frames
+		pixels []color.Color
+	}{
+		{Options{Width: 2}, "gif", 3, nil},
+		{Options{MaxFrames: 2}, "gif", 2, nil},
+		{Options{Static: true}, "gif", 1, []color.Color{red, red}},
+		{Options{Static: true, Frame: 1, Format: "png"}, "png", 1, []color.Color{green, green}},
+		{Options{Static: true, Frame: 9, Format: "png"}, "png", 1, []color.Color{blue, green}},
+		{Options{Format: "apng"}, "apng", 3, []color.Color{red, red}},
+		{Options{MaxFrames: 2, Format: "webp"}, "webp", 2, nil},
+		{Options{Static: true, AutoFormat: true, Format: "png"}, "png", 1, nil},
+	}
+
+	for _, tt := range tests {
+		out, err := Transform(img, tt.opt)
+		if err != nil {
+			t.Errorf("Transform(%v) returned unexpected error: %v", tt.opt, err)
+			continue
+		}
+		// x/image/webp does not decode animated images, so check for
+		// the webp container directly
+		_, format, err := image.DecodeConfig(bytes.NewReader(out))
+		if bytes.HasPrefix(out, []byte("RIFF")) && bytes.Contains(out[:16], []byte("WEBP")) {
+			format, err = "webp", nil
+		}
+		if err != nil {
+			t.Errorf("Transform(%v) returned undecodable image: %v", tt.opt, err)
+			continue
+		}
+		if tt.format == "apng" && format == "png" {
+			format = "apng"
+		}
+		if format != tt.format {
+			t.Errorf("Transform(%v) returned format %q, want %q", tt.opt, format, tt.format)
+		}
+		if got := countFrames(out, format); got != tt.frames {
+			t.Errorf("Transform(%v) returned %d frames, want %d", tt.opt, got, tt.frames)
+		}
+		// check top left and bottom right pixels of the first frame
+		if tt.pixels != nil {
+			m, _, err := image.Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("Transform(%v) returned undecodable image: %v", tt.opt, err)
+			}
+			b := m.Bounds()
+			for i, p := range []image.Point{b.Min, b.Max.Sub(image.Pt(1, 1))} {
+				if got := m.At(p.X, p.Y); !colorClose(got, tt.pixels[i]) {
+					t.Errorf("Transform(%v) returned pixel %v at %v, want %v", tt.opt, got, p, tt.pixels[i])
+				}
+			}
+		}
+	}
+}
+
+func TestTransform_AnimationFrames(t *testing.T) {
+	img := newAnimatedGIF(t)
+	src, err := gif.DecodeAll(bytes.NewReader(img))
+	if err != nil {
+		t.Fatalf("error decoding reference image: %v", err)
+	}
+
+	// frames that are not resized keep their original bounds and palette
+	out, err := Transform(img, Options{MaxFrames: 3})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Transform returned undecodable image: %v", err)
+	}
+	for i, frame := range g.Image {
+		if got, want := frame.Bounds(), src.Image[i].Bounds(); got != want {
+			t.Errorf("frame %d has bounds %v, want %v", i, got, want)
+		}
+		if !reflect.DeepEqual(frame.Palette, src.Image[i].Palette) {
+			t.Errorf("frame %d has palette %v, want %v", i, frame.Palette, src.Image[i].Palette)
+		}
+	}
+
+	// resized frames are composited onto the full canvas
+	out, err = Transform(img, Options{Width: 2})
+	if err != nil {
+		t.Fatalf("Transform returned unexpected error: %v", err)
+	}
+	if g, err = gif.DecodeAll(bytes.NewReader(out)); err != nil {
+		t.Fatalf("Transform returned undecodable image: %v", err)
+	}
+	for i, frame := range g.Image {
+		if got, want := frame.Bounds(), image.Rect(0, 0, 2, 2); got != want {
+			t.Errorf("resized frame %d has bounds %v, want %v", i, got, want)
+		}
+	}
+	last := g.Image[2]
+	if got := last.At(1, 1); !colorClose(got, green) {
+		t.Errorf("resized last frame has pixel %v at (1, 1), want %v", got, green)
+	}
+}
+
+func TestTransform_AnimationTooLarge(t *testing.T) {
+	// two 1x1 frames on a 100 megapixel canvas
+	frame := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{red})
+	g := &gif.GIF{
+		Image:  []*image.Paletted{frame, frame},
+		Delay:  []int{0, 0},
+		Config: image.Config{Width: 10_000, Height: 10_000, ColorModel: color.Palette{red}},
+	}
+	buf := new(bytes.Buffer)
+	if err := gif.EncodeAll(buf, g); err != nil {
+		t.Fatalf("error encoding reference image: %v", err)
+	}
+
+	if _, err := Transform(buf.Bytes(), Options{Width: 1}); err == nil {
+		t.Errorf("Transform did not return expected error for oversized animation")
+	}
+}